@@ -1,20 +1,117 @@
 package service
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Restart conditions for a RestartPolicy
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// Cache policies, which decide whether an image built for an identical service
+// configuration may be reused rather than built again
+const (
+	CacheRebuild = "rebuild"
+	CacheReuse   = "reuse"
+)
+
+// Source types, given as the prefix of a service's source, e.g. git+https://github.com/jhkolb/demosvc
+const (
+	SourceGit     = "git"
+	SourceHTTP    = "http"
+	SourceHTTPS   = "https"
+	SourceArchive = "archive"
+	SourceImage   = "image"
+)
+
+// Defaults for unset RestartPolicy durations
+const (
+	DefaultInitialBackoff = 1 * time.Second
+	DefaultMaxBackoff     = 5 * time.Minute
+	DefaultResetWindow    = 10 * time.Minute
+)
+
+// Defaults for unset HealthCheck fields
+const (
+	DefaultHealthInterval = 30 * time.Second
+	DefaultHealthTimeout  = 10 * time.Second
+	DefaultHealthRetries  = 3
+)
+
 type Configuration struct {
-	Name                string   `yaml:"name"`
-	BaseImage           string   `yaml:"image"`
-	Source              string   `yaml:"source"`
-	BW2Entity           string   `yaml:"bw2Entity"`
-	CPUShares           uint64   `yaml:"cpuShares"`
-	Memory              uint64   `yaml:"memory"`
-	Build               []string `yaml:"build,omitempty"`
-	Run                 []string `yaml:"run"`
-	IncludedFiles       []string `yaml:"includedFiles,omitempty"`
-	IncludedDirectories []string `yaml:"includedDirectories,omitempty"`
-	AutoRestart         bool     `yaml:"autoRestart,omitempty"`
-	UseHostNet          bool     `yaml:"useHostNet,omitempty"`
-	Volumes             []string `yaml:"volumes,omitempty"`
-	Devices             []string `yaml:"devices,omitempty"`
+	Name                 string            `yaml:"name"`
+	BaseImage            string            `yaml:"image"`
+	Source               string            `yaml:"source"`
+	SourceRef            string            `yaml:"sourceRef,omitempty"`
+	SourceChecksum       string            `yaml:"sourceChecksum,omitempty"`
+	SourceArchive        string            `yaml:"sourceArchive,omitempty"`
+	BW2Entity            string            `yaml:"bw2Entity"`
+	CPUShares            uint64            `yaml:"cpuShares"`
+	Memory               uint64            `yaml:"memory"`
+	Build                []string          `yaml:"build,omitempty"`
+	Dockerfile           string            `yaml:"dockerfile,omitempty"`
+	CachePolicy          string            `yaml:"cachePolicy,omitempty"`
+	Run                  []string          `yaml:"run"`
+	IncludedFiles        []string          `yaml:"includedFiles,omitempty"`
+	IncludedDirectories  []string          `yaml:"includedDirectories,omitempty"`
+	AutoRestart          bool              `yaml:"autoRestart,omitempty"`
+	RestartPolicy        *RestartPolicy    `yaml:"restartPolicy,omitempty"`
+	HealthCheck          *HealthCheck      `yaml:"healthCheck,omitempty"`
+	Environment          map[string]string `yaml:"environment,omitempty"`
+	Secrets              []Secret          `yaml:"secrets,omitempty"`
+	Ports                []Port            `yaml:"ports,omitempty"`
+	UseHostNet           bool              `yaml:"useHostNet,omitempty"`
+	Volumes              []string          `yaml:"volumes,omitempty"`
+	Devices              []string          `yaml:"devices,omitempty"`
+	Constraints          map[string]string `yaml:"constraints,omitempty"`
+	DependsOn            []string          `yaml:"dependsOn,omitempty"`
+	StopWithDependencies bool              `yaml:"stopWithDependencies,omitempty"`
+}
+
+// RestartPolicy governs how a service's container is restarted after it terminates
+// A MaxRetries of 0 means the service is restarted indefinitely
+type RestartPolicy struct {
+	Condition      string        `yaml:"condition"`
+	MaxRetries     uint          `yaml:"maxRetries,omitempty"`
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff,omitempty"`
+	ResetWindow    time.Duration `yaml:"resetWindow,omitempty"`
+}
+
+// HealthCheck probes a running service, either by executing Command inside its
+// container or by expecting a message to be published on URI within each Timeout
+// The service is unhealthy after Retries consecutive failed probes
+type HealthCheck struct {
+	Command          []string      `yaml:"command,omitempty"`
+	URI              string        `yaml:"uri,omitempty"`
+	Interval         time.Duration `yaml:"interval,omitempty"`
+	Timeout          time.Duration `yaml:"timeout,omitempty"`
+	Retries          uint          `yaml:"retries,omitempty"`
+	RestartUnhealthy bool          `yaml:"restartUnhealthy,omitempty"`
+}
+
+// Secret is delivered to a service's container as an environment variable, but
+// is never written to its image or to the daemon's service snapshot. When
+// deploying with spawnclient, its value may instead be read from File on the
+// deploying host.
+type Secret struct {
+	Name  string `yaml:"name"`
+	File  string `yaml:"file,omitempty"`
+	Value string `yaml:"value,omitempty"`
+}
+
+// Port publishes a port of a service's container on a port of the Spawnpoint host
+// Protocol is either "tcp", the default, or "udp"
+type Port struct {
+	Host      uint16 `yaml:"host"`
+	Container uint16 `yaml:"container"`
+	Protocol  string `yaml:"protocol,omitempty"`
 }
 
 func (config *Configuration) DeepCopy() *Configuration {
@@ -22,11 +119,27 @@ func (config *Configuration) DeepCopy() *Configuration {
         Name: config.Name,
         BaseImage: config.BaseImage,
         Source: config.Source,
+        SourceRef: config.SourceRef,
+        SourceChecksum: config.SourceChecksum,
+        SourceArchive: config.SourceArchive,
         BW2Entity: config.BW2Entity,
         CPUShares: config.CPUShares,
         Memory: config.Memory,
+        Dockerfile: config.Dockerfile,
+        CachePolicy: config.CachePolicy,
         AutoRestart: config.AutoRestart,
         UseHostNet: config.UseHostNet,
+        StopWithDependencies: config.StopWithDependencies,
+    }
+    if config.RestartPolicy != nil {
+        restartPolicy := *config.RestartPolicy
+        newConfig.RestartPolicy = &restartPolicy
+    }
+    if config.HealthCheck != nil {
+        healthCheck := *config.HealthCheck
+        healthCheck.Command = make([]string, len(config.HealthCheck.Command))
+        copy(healthCheck.Command, config.HealthCheck.Command)
+        newConfig.HealthCheck = &healthCheck
     }
 
     newConfig.Build = make([]string, len(config.Build))
@@ -41,15 +154,216 @@ func (config *Configuration) DeepCopy() *Configuration {
     copy(newConfig.Volumes, config.Volumes)
     newConfig.Devices = make([]string, len(config.Devices))
     copy(newConfig.Devices, config.Devices)
+    if config.Environment != nil {
+        newConfig.Environment = make(map[string]string, len(config.Environment))
+        for name, value := range config.Environment {
+            newConfig.Environment[name] = value
+        }
+    }
+    newConfig.Secrets = make([]Secret, len(config.Secrets))
+    copy(newConfig.Secrets, config.Secrets)
+    newConfig.Ports = make([]Port, len(config.Ports))
+    copy(newConfig.Ports, config.Ports)
+    if config.Constraints != nil {
+        newConfig.Constraints = make(map[string]string, len(config.Constraints))
+        for label, value := range config.Constraints {
+            newConfig.Constraints[label] = value
+        }
+    }
+    newConfig.DependsOn = make([]string, len(config.DependsOn))
+    copy(newConfig.DependsOn, config.DependsOn)
 
     return &newConfig
 }
 
+// Redacted returns a deep copy of the configuration without any secret values
+func (config *Configuration) Redacted() *Configuration {
+	redacted := config.DeepCopy()
+	for i := range redacted.Secrets {
+		redacted.Secrets[i].Value = ""
+	}
+	return redacted
+}
+
+// CheckConstraints verifies that a host's labels satisfy constraints on where a
+// service may run, each of which requires a label to have a particular value
+func CheckConstraints(constraints map[string]string, labels map[string]string) error {
+	keys := make([]string, 0, len(constraints))
+	for key := range constraints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value, ok := labels[key]; !ok {
+			return fmt.Errorf("Host has no %s label, want %s", key, constraints[key])
+		} else if value != constraints[key] {
+			return fmt.Errorf("Host label %s is %s, want %s", key, value, constraints[key])
+		}
+	}
+	return nil
+}
+
+// EffectiveRestartPolicy fills in defaults for the service's restart policy
+// Services without a policy fall back to the legacy autoRestart flag
+func (config *Configuration) EffectiveRestartPolicy() RestartPolicy {
+	var policy RestartPolicy
+	if config.RestartPolicy != nil {
+		policy = *config.RestartPolicy
+	} else if config.AutoRestart {
+		policy.Condition = RestartAlways
+	}
+
+	if len(policy.Condition) == 0 {
+		policy.Condition = RestartNever
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = DefaultInitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = DefaultMaxBackoff
+	}
+	if policy.ResetWindow == 0 {
+		policy.ResetWindow = DefaultResetWindow
+	}
+	return policy
+}
+
+// EffectiveHealthCheck fills in defaults for the service's health check
+// It returns nil if the service has no health check
+func (config *Configuration) EffectiveHealthCheck() *HealthCheck {
+	if config.HealthCheck == nil {
+		return nil
+	}
+	check := *config.HealthCheck
+	if check.Interval == 0 {
+		check.Interval = DefaultHealthInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = DefaultHealthTimeout
+	}
+	if check.Retries == 0 {
+		check.Retries = DefaultHealthRetries
+	}
+	return &check
+}
+
+// SplitSource separates a service's source into its location and the git ref,
+// i.e. a commit, branch, or tag, that it is pinned to. The ref is either given
+// as a fragment, e.g. git+https://github.com/jhkolb/demosvc#v1.2.0, or by
+// sourceRef, with the fragment taking precedence.
+func (config *Configuration) SplitSource() (string, string) {
+	location, ref := config.Source, config.SourceRef
+	if i := strings.LastIndex(config.Source, "#"); i >= 0 {
+		location, ref = config.Source[:i], config.Source[i+1:]
+	}
+	return location, ref
+}
+
+// SourceType separates a service's source location into its type and the
+// remainder, e.g. "git" and "https://github.com/jhkolb/demosvc"
+// A service without a source has an empty type
+func (config *Configuration) SourceType() (string, string) {
+	location, _ := config.SplitSource()
+	parts := strings.SplitN(location, "+", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func (port Port) EffectiveProtocol() string {
+	if len(port.Protocol) == 0 {
+		return "tcp"
+	}
+	return strings.ToLower(port.Protocol)
+}
+
 type LogMessage struct {
 	Contents  string
 	Timestamp int64
 }
 
+// Operations that a ServiceStatus reports on
+// Monitor covers what the daemon does on its own, e.g. restarting a crashed service
+const (
+	OperationDeploy  = "deploy"
+	OperationUpdate  = "update"
+	OperationRestart = "restart"
+	OperationStop    = "stop"
+	OperationRemove  = "remove"
+	OperationMonitor = "monitor"
+)
+
+// Phases of a ServiceStatus
+const (
+	PhaseProgress  = "progress"
+	PhaseWarning   = "warning"
+	PhaseSucceeded = "succeeded"
+	PhaseFailed    = "failed"
+)
+
+// ServiceStatus reports progress toward, or the outcome of, an operation on a service
+// Code is an HTTP status code: 202 for progress, 200 for success or a warning, and
+// the error's code for a failure
+type ServiceStatus struct {
+	Operation string
+	Phase     string
+	Code      int
+	Message   string
+	// ID of the service's container, empty if it has none
+	ServiceID string
+	Timestamp int64
+}
+
+// String formats a status as it appears in a service's log
+func (status ServiceStatus) String() string {
+	switch status.Phase {
+	case PhaseSucceeded:
+		return "[SUCCESS] " + status.Message
+	case PhaseWarning:
+		return "[WARNING] " + status.Message
+	case PhaseFailed:
+		return fmt.Sprintf("[ERROR %d] %s", status.Code, status.Message)
+	default:
+		return "[INFO] " + status.Message
+	}
+}
+
+// Kinds of BuildEvent
+const (
+	BuildStep   = "step"
+	BuildCached = "cached"
+	BuildOutput = "output"
+	BuildError  = "error"
+)
+
+// BuildEvent reports progress while a service's image is built
+// Step and Steps are zero before the first step of a build, e.g. while its source is fetched
+type BuildEvent struct {
+	Kind      string
+	Step      int
+	Steps     int
+	Message   string
+	ExitCode  int
+	Timestamp int64
+}
+
+func (ev BuildEvent) String() string {
+	switch ev.Kind {
+	case BuildStep:
+		return fmt.Sprintf("Step %d/%d : %s", ev.Step, ev.Steps, ev.Message)
+	case BuildCached:
+		return fmt.Sprintf("Step %d/%d : Using cache", ev.Step, ev.Steps)
+	case BuildError:
+		if ev.Step > 0 {
+			return fmt.Sprintf("Step %d/%d failed with exit code %d: %s", ev.Step, ev.Steps, ev.ExitCode, ev.Message)
+		}
+		return fmt.Sprintf("Build failed: %s", ev.Message)
+	default:
+		return ev.Message
+	}
+}
+
 type Event int
 
 const (
@@ -58,4 +372,5 @@ const (
 	Stop    = iota
 	Die     = iota
 	Adopt   = iota
+	Exit    = iota
 )
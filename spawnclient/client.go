@@ -4,69 +4,82 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/daemon"
-	bw2 "github.com/immesys/bw2bind"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/transport"
 	"github.com/mholt/archiver"
 	"github.com/pkg/errors"
 )
 
 type Client struct {
-	bwClient *bw2.BW2Client
+	transport transport.Transport
+}
+
+// deliveryGate keeps a subscription's handler from sending on its channel once the
+// subscription's context is done and the channel has been closed
+type deliveryGate struct {
+	lock   sync.Mutex
+	closed bool
+}
+
+// deliver runs send unless the channel is closed, holding off closing it until send returns
+// send must give up once the subscription's context is done
+func (gate *deliveryGate) deliver(send func()) {
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+	if !gate.closed {
+		send()
+	}
+}
+
+// close closes the channel via closeChan once any delivery in progress has finished
+func (gate *deliveryGate) close(closeChan func()) {
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+	gate.closed = true
+	closeChan()
 }
 
 func New(router, entityFile string) (*Client, error) {
-	bw2.SilenceLog()
-	client, err := bw2.Connect(router)
+	bw, err := transport.NewBosswave(router, entityFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to connect to BW2")
-	}
-	if _, err := client.SetEntityFile(entityFile); err != nil {
-		return nil, errors.Wrap(err, "Failed to set BW2 entity file")
+		return nil, errors.Wrap(err, "Failed to initialize BW2 transport")
 	}
+	return &Client{transport: bw}, nil
+}
 
-	return &Client{bwClient: client}, nil
+// NewLoopback creates a client that talks to daemons in the same process
+// over the loopback transport rather than Bosswave
+func NewLoopback() *Client {
+	return &Client{transport: transport.DefaultLoopback}
 }
 
 func (sc *Client) Scan(baseURI string) (map[string]daemon.Heartbeat, error) {
-	namespace := strings.Split(baseURI, "/")[0]
-	vk, _, err := sc.bwClient.ResolveLongAlias(namespace)
-	aliased := (err == nil)
-	var encodedVk string
-	if aliased {
-		encodedVk = base64.URLEncoding.EncodeToString(vk)
-	}
-
-	svcClient := sc.bwClient.NewServiceClient(baseURI, "s.spawnpoint")
-	iFaceClient := svcClient.AddInterface("daemon", "i.spawnpoint")
-	heartbeatMsgs, err := sc.bwClient.Query(&bw2.QueryParams{
-		URI: iFaceClient.SignalURI("heartbeat"),
-	})
+	iface := transport.NewInterface(baseURI, "s.spawnpoint", "daemon", "i.spawnpoint")
+	heartbeatMsgs, err := sc.transport.QuerySignal(iface, "heartbeat")
 	if err != nil {
-		return nil, errors.Wrap(err, "Bosswave query failed")
+		return nil, errors.Wrap(err, "Heartbeat query failed")
 	}
 
 	spawnpoints := make(map[string]daemon.Heartbeat)
-	for msg := range heartbeatMsgs {
-		for _, po := range msg.POs {
-			if po.IsTypeDF(bw2.PODFSpawnpointHeartbeat) {
+	for _, msg := range heartbeatMsgs {
+		for _, po := range msg.Objects {
+			if po.Type() == transport.HeartbeatPayload {
 				var hb daemon.Heartbeat
-				if err := po.(bw2.MsgPackPayloadObject).ValueInto(&hb); err != nil {
+				if err := po.ValueInto(&hb); err != nil {
 					// Ignore this query result
 					continue
 				}
 				rawURI := msg.URI[:len(msg.URI)-len("/s.spawnpoint/daemon/i.spawnpoint/signal/heartbeat")]
-				if aliased {
-					convertedURI := strings.Replace(rawURI, encodedVk, namespace, 1)
-					spawnpoints[convertedURI] = hb
-				} else {
-					spawnpoints[rawURI] = hb
-				}
+				spawnpoints[rawURI] = hb
 			}
 		}
 	}
@@ -74,6 +87,20 @@ func (sc *Client) Scan(baseURI string) (map[string]daemon.Heartbeat, error) {
 	return spawnpoints, nil
 }
 
+// ScanMatching scans a base URI for spawnpoints whose labels satisfy a set of constraints
+func (sc *Client) ScanMatching(baseURI string, constraints map[string]string) (map[string]daemon.Heartbeat, error) {
+	spawnpoints, err := sc.Scan(baseURI)
+	if err != nil {
+		return nil, err
+	}
+	for uri, hb := range spawnpoints {
+		if service.CheckConstraints(constraints, hb.Labels) != nil {
+			delete(spawnpoints, uri)
+		}
+	}
+	return spawnpoints, nil
+}
+
 func (sc *Client) Inspect(uri string) (*daemon.Heartbeat, map[string]daemon.ServiceHeartbeat, error) {
 	daemonHbs, err := sc.Scan(uri)
 	if err != nil {
@@ -89,20 +116,17 @@ func (sc *Client) Inspect(uri string) (*daemon.Heartbeat, map[string]daemon.Serv
 		daemonHb = hb
 	}
 
-	svcClient := sc.bwClient.NewServiceClient(uri, "s.spawnpoint")
-	iFaceClient := svcClient.AddInterface("+", "i.spawnable")
-	svcHeartbeatMsgs, err := sc.bwClient.Query(&bw2.QueryParams{
-		URI: iFaceClient.SignalURI("heartbeat"),
-	})
+	iface := transport.NewInterface(uri, "s.spawnpoint", "+", "i.spawnable")
+	svcHeartbeatMsgs, err := sc.transport.QuerySignal(iface, "heartbeat")
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Bosswave query failed")
+		return nil, nil, errors.Wrap(err, "Service heartbeat query failed")
 	}
 	svcHeartbeats := make(map[string]daemon.ServiceHeartbeat)
-	for svcHbMsg := range svcHeartbeatMsgs {
-		for _, po := range svcHbMsg.POs {
-			if po.IsTypeDF(bw2.PODFSpawnpointSvcHb) {
+	for _, svcHbMsg := range svcHeartbeatMsgs {
+		for _, po := range svcHbMsg.Objects {
+			if po.Type() == transport.ServiceHeartbeatPayload {
 				var svcHb daemon.ServiceHeartbeat
-				if err := po.(bw2.MsgPackPayloadObject).ValueInto(&svcHb); err != nil {
+				if err := po.ValueInto(&svcHb); err != nil {
 					// Ignore this query result
 					continue
 				}
@@ -116,74 +140,159 @@ func (sc *Client) Inspect(uri string) (*daemon.Heartbeat, map[string]daemon.Serv
 	return &daemonHb, svcHeartbeats, nil
 }
 
-func (sc *Client) Deploy(config *service.Configuration, uri string) error {
-	if err := validateConfig(config); err != nil {
-		return errors.Wrap(err, "Invalid service configuration")
-	}
+// How long to wait for a daemon to acknowledge an operation before giving up
+const operationAckTimeout = 30 * time.Second
 
-	workingConfig := config.DeepCopy()
-	encodedEntity, err := encodeEntityFile(workingConfig.BW2Entity)
+// How long to wait for a service to be built and started before giving up
+const serviceStartTimeout = 15 * time.Minute
+
+// OperationError is a daemon's refusal or failure to carry out an operation
+type OperationError struct {
+	Operation string
+	Code      int
+	Message   string
+}
+
+func (err *OperationError) Error() string {
+	return fmt.Sprintf("[ERROR %d] %s", err.Code, err.Message)
+}
+
+// Deploy sends a service to a daemon and returns once the daemon has either
+// begun launching it or refused it, in which case the error is an *OperationError
+func (sc *Client) Deploy(config *service.Configuration, uri string) (*service.ServiceStatus, error) {
+	return sc.deploy(config, uri, operationAckTimeout, acknowledged)
+}
+
+// DeployAndWait sends a service to a daemon like Deploy, but returns only once
+// the service has been built and started, or has failed to
+func (sc *Client) DeployAndWait(config *service.Configuration, uri string) (*service.ServiceStatus, error) {
+	return sc.deploy(config, uri, serviceStartTimeout, finished)
+}
+
+func (sc *Client) deploy(config *service.Configuration, uri string, timeout time.Duration,
+	done func(*service.ServiceStatus) bool) (*service.ServiceStatus, error) {
+	workingConfig, err := prepareConfig(config)
 	if err != nil {
-		return errors.Wrap(err, "Could not encode BW2 entity")
+		return nil, err
 	}
-	workingConfig.BW2Entity = encodedEntity
 
-	if len(workingConfig.IncludedFiles) > 0 {
-		encodedFiles, err := encodeIncludedFiles(workingConfig.IncludedFiles, workingConfig.IncludedDirectories)
-		if err != nil {
-			return errors.Wrap(err, "Could not encode included files for transmission")
+	daemonIface := transport.NewInterface(uri, "s.spawnpoint", "daemon", "i.spawnpoint")
+	configPo := transport.Payload{Type: transport.ConfigPayload, Value: workingConfig}
+	return sc.awaitStatus(uri, config.Name, service.OperationDeploy, timeout, done, func() error {
+		if err := sc.transport.PublishSlot(daemonIface, "config", configPo); err != nil {
+			return errors.Wrap(err, "Could not publish service configuration")
 		}
-		workingConfig.IncludedFiles = append(workingConfig.IncludedFiles, encodedFiles)
-	}
+		return nil
+	})
+}
 
-	svcClient := sc.bwClient.NewServiceClient(uri, "s.spawnpoint")
-	ifaceClient := svcClient.AddInterface("daemon", "i.spawnpoint")
-	configPo, err := bw2.CreateYAMLPayloadObject(bw2.PONumSpawnpointConfig, workingConfig)
+// Update replaces a running service with a new configuration of the same name
+// The old version keeps running until the new one has been built
+func (sc *Client) Update(config *service.Configuration, uri string) (*service.ServiceStatus, error) {
+	workingConfig, err := prepareConfig(config)
 	if err != nil {
-		return errors.Wrap(err, "Could not serialize service configuration")
-	}
-	if err := ifaceClient.PublishSlot("config", configPo); err != nil {
-		return errors.Wrap(err, "Could not publish service configuration")
+		return nil, err
 	}
 
-	return nil
+	iface := transport.NewInterface(uri, "s.spawnpoint", config.Name, "i.spawnable")
+	configPo := transport.Payload{Type: transport.ConfigPayload, Value: workingConfig}
+	return sc.awaitStatus(uri, config.Name, service.OperationUpdate, operationAckTimeout, acknowledged, func() error {
+		if err := sc.transport.PublishSlot(iface, "update", configPo); err != nil {
+			return errors.Wrap(err, "Could not publish to update slot")
+		}
+		return nil
+	})
 }
 
-func (sc *Client) Stop(uri string, svcName string) error {
-	svcClient := sc.bwClient.NewServiceClient(uri, "s.spawnpoint")
-	iFaceClient := svcClient.AddInterface(svcName, "i.spawnable")
-	if err := iFaceClient.PublishSlot("stop"); err != nil {
-		return errors.Wrap(err, "Could not publish to stop slot")
-	}
-	return nil
+func (sc *Client) Stop(uri string, svcName string) (*service.ServiceStatus, error) {
+	iface := transport.NewInterface(uri, "s.spawnpoint", svcName, "i.spawnable")
+	return sc.awaitStatus(uri, svcName, service.OperationStop, operationAckTimeout, acknowledged, func() error {
+		if err := sc.transport.PublishSlot(iface, "stop"); err != nil {
+			return errors.Wrap(err, "Could not publish to stop slot")
+		}
+		return nil
+	})
 }
 
-func (sc *Client) Restart(uri string, svcName string) error {
-	svcClient := sc.bwClient.NewServiceClient(uri, "s.spawnpoint")
-	iFaceClient := svcClient.AddInterface(svcName, "i.spawnable")
-	if err := iFaceClient.PublishSlot("restart"); err != nil {
-		return errors.Wrap(err, "Could not publish to restart slot")
+func (sc *Client) Restart(uri string, svcName string) (*service.ServiceStatus, error) {
+	iface := transport.NewInterface(uri, "s.spawnpoint", svcName, "i.spawnable")
+	return sc.awaitStatus(uri, svcName, service.OperationRestart, operationAckTimeout, acknowledged, func() error {
+		if err := sc.transport.PublishSlot(iface, "restart"); err != nil {
+			return errors.Wrap(err, "Could not publish to restart slot")
+		}
+		return nil
+	})
+}
+
+func acknowledged(status *service.ServiceStatus) bool {
+	return true
+}
+
+func finished(status *service.ServiceStatus) bool {
+	return status.Phase == service.PhaseSucceeded || status.Phase == service.PhaseFailed
+}
+
+// awaitStatus carries out a request and waits for the daemon to publish a
+// status about that operation on the service that satisfies done
+func (sc *Client) awaitStatus(uri string, svcName string, operation string, timeout time.Duration,
+	done func(*service.ServiceStatus) bool, request func() error) (*service.ServiceStatus, error) {
+	iface := transport.NewInterface(uri, "s.spawnpoint", svcName, "i.spawnable")
+	statusChan := make(chan service.ServiceStatus, 1)
+	handle, err := sc.transport.SubscribeSignal(iface, "status", func(msg *transport.Message) {
+		for _, po := range msg.Objects {
+			var status service.ServiceStatus
+			if po.Type() != transport.StatusPayload || po.ValueInto(&status) != nil {
+				continue
+			}
+			if status.Operation == operation && done(&status) {
+				select {
+				case statusChan <- status:
+				default:
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to subscribe to service status")
+	}
+	defer sc.transport.Unsubscribe(handle)
+
+	if err = request(); err != nil {
+		return nil, err
+	}
+	select {
+	case status := <-statusChan:
+		if status.Phase == service.PhaseFailed {
+			return &status, &OperationError{Operation: operation, Code: status.Code, Message: status.Message}
+		}
+		return &status, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Spawnpoint did not report on %s of service %s within %s", operation, svcName, timeout)
 	}
-	return nil
 }
 
 func (sc *Client) Tail(ctx context.Context, svcName string, uri string) (<-chan service.LogMessage, <-chan error) {
-	svcClient := sc.bwClient.NewServiceClient(uri, "s.spawnpoint")
-	iFaceClient := svcClient.AddInterface(svcName, "i.spawnable")
+	iface := transport.NewInterface(uri, "s.spawnpoint", svcName, "i.spawnable")
 	errChan := make(chan error, 1)
 	logChan := make(chan service.LogMessage, 20)
+	var gate deliveryGate
 
-	handle, err := iFaceClient.SubscribeSignalH("log", func(msg *bw2.SimpleMessage) {
-		if len(msg.POs) > 0 {
-			messagePo, ok := msg.POs[0].(bw2.MsgPackPayloadObject)
-			if !ok {
+	handle, err := sc.transport.SubscribeSignal(iface, "log", func(msg *transport.Message) {
+		if len(msg.Objects) > 0 {
+			messagePo := msg.Objects[0]
+			if messagePo.Type() != transport.LogPayload {
 				return
 			}
 			var logMessage service.LogMessage
-			if err := bw2.MsgPackPayloadObject.ValueInto(messagePo, &logMessage); err != nil {
+			if err := messagePo.ValueInto(&logMessage); err != nil {
 				return
 			}
-			logChan <- logMessage
+			gate.deliver(func() {
+				select {
+				case logChan <- logMessage:
+				case <-ctx.Done():
+				}
+			})
 		}
 	})
 	if err != nil {
@@ -194,8 +303,8 @@ func (sc *Client) Tail(ctx context.Context, svcName string, uri string) (<-chan
 
 	// Publish keep-alive log messages
 	go func() {
-		if err := iFaceClient.PublishSlot("keepLogAlive"); err != nil {
-			close(logChan)
+		if err := sc.transport.PublishSlot(iface, "keepLogAlive"); err != nil {
+			gate.close(func() { close(logChan) })
 			errChan <- errors.Wrap(err, "Failed to publish log keep-alive message")
 			return
 		}
@@ -203,17 +312,17 @@ func (sc *Client) Tail(ctx context.Context, svcName string, uri string) (<-chan
 		for {
 			select {
 			case <-tick:
-				if err := iFaceClient.PublishSlot("keepLogAlive"); err != nil {
-					close(logChan)
+				if err := sc.transport.PublishSlot(iface, "keepLogAlive"); err != nil {
+					gate.close(func() { close(logChan) })
 					errChan <- errors.Wrap(err, "Failed to publish log keep-alive message")
 					return
 				}
 
 			case <-ctx.Done():
-				if err := sc.bwClient.Unsubscribe(handle); err != nil {
+				if err := sc.transport.Unsubscribe(handle); err != nil {
 					errChan <- errors.Wrap(err, "Failed to unsubscribe from log channel")
 				}
-				close(logChan)
+				gate.close(func() { close(logChan) })
 				return
 			}
 		}
@@ -222,6 +331,88 @@ func (sc *Client) Tail(ctx context.Context, svcName string, uri string) (<-chan
 	return logChan, errChan
 }
 
+// WatchBuild delivers the progress of a service's builds, whether for a deployment,
+// an update, or a restart after the daemon recovers, as typed events
+func (sc *Client) WatchBuild(ctx context.Context, svcName string, uri string) (<-chan service.BuildEvent, <-chan error) {
+	iface := transport.NewInterface(uri, "s.spawnpoint", svcName, "i.spawnable")
+	errChan := make(chan error, 1)
+	eventChan := make(chan service.BuildEvent, 20)
+	var gate deliveryGate
+
+	handle, err := sc.transport.SubscribeSignal(iface, "build", func(msg *transport.Message) {
+		for _, po := range msg.Objects {
+			if po.Type() != transport.BuildEventPayload {
+				continue
+			}
+			var event service.BuildEvent
+			if err := po.ValueInto(&event); err != nil {
+				continue
+			}
+			gate.deliver(func() {
+				select {
+				case eventChan <- event:
+				case <-ctx.Done():
+				}
+			})
+		}
+	})
+	if err != nil {
+		close(eventChan)
+		errChan <- errors.Wrap(err, "Failed to subscribe to service build events")
+		return eventChan, errChan
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := sc.transport.Unsubscribe(handle); err != nil {
+			errChan <- errors.Wrap(err, "Failed to unsubscribe from build events")
+		}
+		gate.close(func() { close(eventChan) })
+	}()
+	return eventChan, errChan
+}
+
+// WatchStatus delivers the outcome of every operation on a service, including
+// those requested by other clients and those the daemon carries out on its own
+func (sc *Client) WatchStatus(ctx context.Context, svcName string, uri string) (<-chan service.ServiceStatus, <-chan error) {
+	iface := transport.NewInterface(uri, "s.spawnpoint", svcName, "i.spawnable")
+	errChan := make(chan error, 1)
+	statusChan := make(chan service.ServiceStatus, 20)
+	var gate deliveryGate
+
+	handle, err := sc.transport.SubscribeSignal(iface, "status", func(msg *transport.Message) {
+		for _, po := range msg.Objects {
+			if po.Type() != transport.StatusPayload {
+				continue
+			}
+			var status service.ServiceStatus
+			if err := po.ValueInto(&status); err != nil {
+				continue
+			}
+			gate.deliver(func() {
+				select {
+				case statusChan <- status:
+				case <-ctx.Done():
+				}
+			})
+		}
+	})
+	if err != nil {
+		close(statusChan)
+		errChan <- errors.Wrap(err, "Failed to subscribe to service status")
+		return statusChan, errChan
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := sc.transport.Unsubscribe(handle); err != nil {
+			errChan <- errors.Wrap(err, "Failed to unsubscribe from service status")
+		}
+		gate.close(func() { close(statusChan) })
+	}()
+	return statusChan, errChan
+}
+
 func encodeEntityFile(fileName string) (string, error) {
 	absPath, _ := filepath.Abs(fileName)
 	contents, err := ioutil.ReadFile(absPath)
@@ -231,6 +422,57 @@ func encodeEntityFile(fileName string) (string, error) {
 	return base64.StdEncoding.EncodeToString(contents), nil
 }
 
+// prepareConfig produces a copy of a configuration with all local files it
+// refers to encoded inline, ready to be sent to a daemon
+func prepareConfig(config *service.Configuration) (*service.Configuration, error) {
+	if err := validateConfig(config); err != nil {
+		return nil, errors.Wrap(err, "Invalid service configuration")
+	}
+
+	workingConfig := config.DeepCopy()
+	encodedEntity, err := encodeEntityFile(workingConfig.BW2Entity)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not encode BW2 entity")
+	}
+	workingConfig.BW2Entity = encodedEntity
+
+	for i, secret := range workingConfig.Secrets {
+		if len(secret.File) == 0 {
+			continue
+		}
+		contents, err := ioutil.ReadFile(secret.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not read secret %s", secret.Name)
+		}
+		workingConfig.Secrets[i].Value = strings.TrimSuffix(string(contents), "\n")
+		workingConfig.Secrets[i].File = ""
+	}
+
+	if kind, location := workingConfig.SourceType(); kind == service.SourceArchive && len(workingConfig.SourceArchive) == 0 {
+		encodedArchive, err := encodeSourceArchive(location)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not encode source archive for transmission")
+		}
+		workingConfig.SourceArchive = encodedArchive
+		// The daemon has no use for a path on the deploying host
+		workingConfig.Source = service.SourceArchive + "+" + filepath.Base(location)
+	}
+
+	// A custom dockerfile travels with the included files
+	if len(workingConfig.Dockerfile) > 0 && !includesFile(workingConfig.IncludedFiles, workingConfig.Dockerfile) {
+		workingConfig.IncludedFiles = append(workingConfig.IncludedFiles, workingConfig.Dockerfile)
+	}
+
+	if len(workingConfig.IncludedFiles) > 0 {
+		encodedFiles, err := encodeIncludedFiles(workingConfig.IncludedFiles, workingConfig.IncludedDirectories)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not encode included files for transmission")
+		}
+		workingConfig.IncludedFiles = append(workingConfig.IncludedFiles, encodedFiles)
+	}
+	return workingConfig, nil
+}
+
 func validateConfig(config *service.Configuration) error {
 	if config.BW2Entity == "" {
 		return errors.New("Configuration does not specify BW2 entity")
@@ -243,6 +485,38 @@ func validateConfig(config *service.Configuration) error {
 	return nil
 }
 
+// includesFile checks for a file in a list of included files, which are
+// identified by base name once they reach the daemon
+func includesFile(includedFiles []string, fileName string) bool {
+	for _, includedFile := range includedFiles {
+		if filepath.Base(includedFile) == filepath.Base(fileName) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeSourceArchive reads an archive source, which is either a tar archive,
+// optionally gzipped, or a directory to be archived
+func encodeSourceArchive(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not find source archive")
+	}
+
+	var contents []byte
+	if info.IsDir() {
+		var buffer bytes.Buffer
+		if err = archiver.Tar.Write(&buffer, []string{path}); err != nil {
+			return "", errors.Wrap(err, "Could not archive source directory")
+		}
+		contents = buffer.Bytes()
+	} else if contents, err = ioutil.ReadFile(path); err != nil {
+		return "", errors.Wrap(err, "Could not read source archive")
+	}
+	return base64.StdEncoding.EncodeToString(contents), nil
+}
+
 func encodeIncludedFiles(includedFiles []string, includedDirs []string) (string, error) {
 	var buffer bytes.Buffer
 	if err := archiver.Tar.Write(&buffer, includedFiles); err != nil {
@@ -0,0 +1,133 @@
+package spawnclient
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/daemon"
+	"github.com/pkg/errors"
+)
+
+// Spawnpoints that have not sent a heartbeat within this long are considered down
+const HeartbeatHorizon = 25 * time.Second
+
+// PlacementStrategy ranks the spawnpoints that are able to host a service
+// The spawnpoint with the highest score is chosen
+type PlacementStrategy interface {
+	Score(config *service.Configuration, hb *daemon.Heartbeat) float64
+}
+
+// MostFreeMemory prefers the spawnpoint with the most memory left over
+type MostFreeMemory struct{}
+
+func (MostFreeMemory) Score(config *service.Configuration, hb *daemon.Heartbeat) float64 {
+	return float64(hb.AvailableMemory - config.Memory)
+}
+
+// BinPack prefers the spawnpoint with the least CPU and memory left over,
+// keeping other spawnpoints free for larger services
+type BinPack struct{}
+
+func (BinPack) Score(config *service.Configuration, hb *daemon.Heartbeat) float64 {
+	remainingCPU := float64(hb.AvailableCPU-config.CPUShares) / float64(hb.TotalCPU)
+	remainingMemory := float64(hb.AvailableMemory-config.Memory) / float64(hb.TotalMemory)
+	return -(remainingCPU + remainingMemory)
+}
+
+// Spread prefers the spawnpoint running the fewest services
+type Spread struct{}
+
+func (Spread) Score(config *service.Configuration, hb *daemon.Heartbeat) float64 {
+	return -float64(len(hb.Services))
+}
+
+// LabelAffinity prefers the spawnpoint whose labels match the most of the
+// given labels, falling back to the most free memory among equally good matches
+type LabelAffinity map[string]string
+
+func (labels LabelAffinity) Score(config *service.Configuration, hb *daemon.Heartbeat) float64 {
+	matches := 0
+	for key, value := range labels {
+		if hb.Labels[key] == value {
+			matches++
+		}
+	}
+	// Memory is a fraction of the total, so it never outweighs a matching label
+	return float64(matches) + float64(hb.AvailableMemory-config.Memory)/float64(hb.TotalMemory+1)
+}
+
+// Candidate is a spawnpoint that was considered for a service
+// Rejection explains why it cannot host the service, and is empty if it can
+type Candidate struct {
+	URI       string
+	Heartbeat daemon.Heartbeat
+	Score     float64
+	Rejection string
+}
+
+// Placement is the spawnpoint chosen for a service, along with every
+// spawnpoint that was considered, best first
+type Placement struct {
+	URI        string
+	Candidates []Candidate
+}
+
+// Place scans for spawnpoints under a base URI and chooses one to host a
+// service according to a strategy. If none is suitable, the error is
+// accompanied by the rejected candidates.
+func (sc *Client) Place(config *service.Configuration, baseURI string, strategy PlacementStrategy) (*Placement, error) {
+	heartbeats, err := sc.Scan(baseURI)
+	if err != nil {
+		return nil, errors.Wrap(err, "Spawnpoint scan failed")
+	}
+	placement := placeService(config, heartbeats, strategy, time.Now())
+	if len(placement.URI) == 0 {
+		return placement, fmt.Errorf("None of the %d spawnpoints found can host service %s",
+			len(placement.Candidates), config.Name)
+	}
+	return placement, nil
+}
+
+func placeService(config *service.Configuration, heartbeats map[string]daemon.Heartbeat,
+	strategy PlacementStrategy, now time.Time) *Placement {
+	placement := &Placement{Candidates: make([]Candidate, 0, len(heartbeats))}
+	for uri, hb := range heartbeats {
+		candidate := Candidate{URI: uri, Heartbeat: hb}
+		if candidate.Rejection = rejectCandidate(config, &hb, now); len(candidate.Rejection) == 0 {
+			candidate.Score = strategy.Score(config, &hb)
+		}
+		placement.Candidates = append(placement.Candidates, candidate)
+	}
+
+	sort.Slice(placement.Candidates, func(i, j int) bool {
+		a, b := placement.Candidates[i], placement.Candidates[j]
+		if (len(a.Rejection) == 0) != (len(b.Rejection) == 0) {
+			return len(a.Rejection) == 0
+		} else if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.URI < b.URI
+	})
+	if len(placement.Candidates) > 0 && len(placement.Candidates[0].Rejection) == 0 {
+		placement.URI = placement.Candidates[0].URI
+	}
+	return placement
+}
+
+// rejectCandidate explains why a spawnpoint can't host a service, if it can't
+func rejectCandidate(config *service.Configuration, hb *daemon.Heartbeat, now time.Time) string {
+	if age := now.Sub(time.Unix(0, hb.Time)); age > HeartbeatHorizon {
+		return fmt.Sprintf("Last seen %s ago", age.Truncate(time.Second))
+	} else if runsService(hb, config.Name) {
+		return "Service is already running there"
+	} else if err := service.CheckConstraints(config.Constraints, hb.Labels); err != nil {
+		return err.Error()
+	} else if hb.AvailableCPU < config.CPUShares {
+		return fmt.Sprintf("Insufficient CPU shares: have %d, want %d", hb.AvailableCPU, config.CPUShares)
+	} else if hb.AvailableMemory < config.Memory {
+		return fmt.Sprintf("Insufficient memory: have %d, want %d", hb.AvailableMemory, config.Memory)
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package spawnclient
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/daemon"
+)
+
+func TestPlaceService(t *testing.T) {
+	now := time.Now()
+	heartbeats := map[string]daemon.Heartbeat{
+		"ns/spawnpoint/roomy": {Time: now.UnixNano(), TotalCPU: 4096, TotalMemory: 8192,
+			AvailableCPU: 4096, AvailableMemory: 8192, Services: []string{"a", "b"}},
+		"ns/spawnpoint/snug": {Time: now.UnixNano(), TotalCPU: 2048, TotalMemory: 2048,
+			AvailableCPU: 1024, AvailableMemory: 600, Labels: map[string]string{"arch": "arm64"}},
+		"ns/spawnpoint/full": {Time: now.UnixNano(), TotalCPU: 1024, TotalMemory: 1024,
+			AvailableCPU: 1024, AvailableMemory: 256},
+		"ns/spawnpoint/stale": {Time: now.Add(-time.Minute).UnixNano(), TotalCPU: 8192, TotalMemory: 16384,
+			AvailableCPU: 8192, AvailableMemory: 16384},
+		"ns/spawnpoint/taken": {Time: now.UnixNano(), TotalCPU: 8192, TotalMemory: 16384,
+			AvailableCPU: 8192, AvailableMemory: 16384, Services: []string{"demosvc"}},
+	}
+	config := &service.Configuration{Name: "demosvc", CPUShares: 512, Memory: 512}
+
+	for _, test := range []struct {
+		strategy PlacementStrategy
+		expected string
+	}{
+		{MostFreeMemory{}, "ns/spawnpoint/roomy"},
+		{BinPack{}, "ns/spawnpoint/snug"},
+		{Spread{}, "ns/spawnpoint/snug"},
+		{LabelAffinity{"arch": "arm64"}, "ns/spawnpoint/snug"},
+		{LabelAffinity{"arch": "amd64"}, "ns/spawnpoint/roomy"},
+	} {
+		placement := placeService(config, heartbeats, test.strategy, now)
+		if placement.URI != test.expected {
+			t.Errorf("Expected %T to choose %s, found %s", test.strategy, test.expected, placement.URI)
+		}
+	}
+
+	placement := placeService(config, heartbeats, MostFreeMemory{}, now)
+	rejections := make(map[string]string)
+	for _, candidate := range placement.Candidates {
+		rejections[candidate.URI] = candidate.Rejection
+	}
+	for uri, reason := range map[string]string{
+		"ns/spawnpoint/full":  "Insufficient memory",
+		"ns/spawnpoint/stale": "Last seen",
+		"ns/spawnpoint/taken": "Service is already running",
+	} {
+		if !strings.HasPrefix(rejections[uri], reason) {
+			t.Errorf("Expected %s to be rejected with %q, found %q", uri, reason, rejections[uri])
+		}
+	}
+
+	config.Constraints = map[string]string{"arch": "arm64"}
+	if placement = placeService(config, heartbeats, MostFreeMemory{}, now); placement.URI != "ns/spawnpoint/snug" {
+		t.Errorf("Expected constraints to choose ns/spawnpoint/snug, found %s", placement.URI)
+	}
+
+	config.Memory = 1 << 20
+	if placement = placeService(config, heartbeats, MostFreeMemory{}, now); len(placement.URI) > 0 {
+		t.Errorf("Expected no spawnpoint to fit, found %s", placement.URI)
+	}
+}
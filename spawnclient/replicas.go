@@ -0,0 +1,270 @@
+package spawnclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/daemon"
+	"github.com/pkg/errors"
+)
+
+// States of a replica that are not reported by the daemon itself
+const (
+	ReplicaAbsent      = "absent"
+	ReplicaUnreachable = "unreachable"
+)
+
+// ReplicaSet is a service that should run on a number of spawnpoints at once,
+// chosen from a list of candidates
+type ReplicaSet struct {
+	Replicas    int                   `yaml:"replicas"`
+	Spawnpoints []string              `yaml:"spawnpoints"`
+	Service     service.Configuration `yaml:"service"`
+}
+
+// Replica is the state of a replica set's service on one candidate spawnpoint
+type Replica struct {
+	URI    string
+	State  string
+	Health string
+	Detail string
+}
+
+// Available reports whether the replica is running and not known to be unhealthy
+func (replica *Replica) Available() bool {
+	return replica.State == daemon.ServiceRunning && replica.Health != daemon.HealthUnhealthy
+}
+
+func (replica *Replica) present() bool {
+	return replica.State != ReplicaAbsent && replica.State != ReplicaUnreachable
+}
+
+// ReplicaSetStatus aggregates the state of a replica set across its candidate spawnpoints
+type ReplicaSetStatus struct {
+	Name      string
+	Desired   int
+	Available int
+	Replicas  []Replica
+}
+
+// ReplicaAction is a deployment or stop carried out to reconcile a replica set
+type ReplicaAction struct {
+	Operation string
+	URI       string
+	Err       error
+}
+
+// ReconcileReport describes one pass of reconciling a replica set
+type ReconcileReport struct {
+	Status  *ReplicaSetStatus
+	Actions []ReplicaAction
+	Err     error
+}
+
+// spawnpointView is what a client can see of one spawnpoint
+type spawnpointView struct {
+	heartbeat    *daemon.Heartbeat
+	svcHeartbeat *daemon.ServiceHeartbeat
+	err          error
+}
+
+// ValidateReplicaSet checks a replica set's specification before anything is deployed
+func ValidateReplicaSet(set *ReplicaSet) error {
+	if len(set.Service.Name) == 0 {
+		return errors.New("Replica set's service has no name")
+	} else if set.Replicas < 1 {
+		return errors.New("Replica set must have at least one replica")
+	} else if set.Replicas > len(set.Spawnpoints) {
+		return fmt.Errorf("Replica set wants %d replicas but has only %d candidate spawnpoints",
+			set.Replicas, len(set.Spawnpoints))
+	}
+	seen := make(map[string]bool)
+	for _, uri := range set.Spawnpoints {
+		if seen[uri] {
+			return fmt.Errorf("Spawnpoint %s is listed more than once", uri)
+		}
+		seen[uri] = true
+	}
+	return validateConfig(&set.Service)
+}
+
+// ReplicaStatus inspects each of a replica set's candidate spawnpoints
+func (sc *Client) ReplicaStatus(set *ReplicaSet) *ReplicaSetStatus {
+	return assessReplicas(set, sc.viewSpawnpoints(set), time.Now())
+}
+
+// ReconcileReplicas deploys a replica set's service to as many spawnpoints as
+// it is missing from, chosen by a placement strategy, and stops any replicas
+// beyond the desired number, preferring those that are not available
+func (sc *Client) ReconcileReplicas(set *ReplicaSet, strategy PlacementStrategy) *ReconcileReport {
+	views := sc.viewSpawnpoints(set)
+	now := time.Now()
+	status := assessReplicas(set, views, now)
+	deploys, stops := planReconcile(set, status, views, strategy, now)
+
+	report := &ReconcileReport{Status: status}
+	for _, uri := range deploys {
+		config := set.Service
+		_, err := sc.Deploy(&config, uri)
+		report.Actions = append(report.Actions, ReplicaAction{Operation: service.OperationDeploy, URI: uri, Err: err})
+	}
+	for _, uri := range stops {
+		_, err := sc.Stop(uri, set.Service.Name)
+		report.Actions = append(report.Actions, ReplicaAction{Operation: service.OperationStop, URI: uri, Err: err})
+	}
+	if len(deploys) < set.Replicas-status.Available {
+		report.Err = fmt.Errorf("Only %d of %d missing replicas could be placed",
+			len(deploys), set.Replicas-status.Available)
+	}
+	return report
+}
+
+// MaintainReplicas reconciles a replica set immediately and then periodically
+// until the context is cancelled, reporting on each pass
+func (sc *Client) MaintainReplicas(ctx context.Context, set *ReplicaSet, strategy PlacementStrategy,
+	interval time.Duration) <-chan *ReconcileReport {
+	reports := make(chan *ReconcileReport, 1)
+	go func() {
+		defer close(reports)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case reports <- sc.ReconcileReplicas(set, strategy):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return reports
+}
+
+// RestartReplicas restarts every present replica of a replica set
+func (sc *Client) RestartReplicas(set *ReplicaSet) []ReplicaAction {
+	return sc.actOnReplicas(set, service.OperationRestart, sc.Restart)
+}
+
+// StopReplicas stops every present replica of a replica set
+func (sc *Client) StopReplicas(set *ReplicaSet) []ReplicaAction {
+	return sc.actOnReplicas(set, service.OperationStop, sc.Stop)
+}
+
+func (sc *Client) actOnReplicas(set *ReplicaSet, operation string,
+	act func(uri string, svcName string) (*service.ServiceStatus, error)) []ReplicaAction {
+	var actions []ReplicaAction
+	for _, replica := range sc.ReplicaStatus(set).Replicas {
+		if replica.present() {
+			_, err := act(replica.URI, set.Service.Name)
+			actions = append(actions, ReplicaAction{Operation: operation, URI: replica.URI, Err: err})
+		}
+	}
+	return actions
+}
+
+func (sc *Client) viewSpawnpoints(set *ReplicaSet) map[string]spawnpointView {
+	views := make(map[string]spawnpointView)
+	for _, uri := range set.Spawnpoints {
+		views[uri] = sc.viewSpawnpoint(uri, set.Service.Name)
+	}
+	return views
+}
+
+// viewSpawnpoint inspects a spawnpoint and its heartbeat for one service
+func (sc *Client) viewSpawnpoint(uri string, svcName string) spawnpointView {
+	hb, svcHbs, err := sc.Inspect(uri)
+	if err != nil {
+		return spawnpointView{err: err}
+	}
+	view := spawnpointView{heartbeat: hb}
+	if svcHb, ok := svcHbs[svcName]; ok {
+		view.svcHeartbeat = &svcHb
+	}
+	return view
+}
+
+func assessReplicas(set *ReplicaSet, views map[string]spawnpointView, now time.Time) *ReplicaSetStatus {
+	status := &ReplicaSetStatus{Name: set.Service.Name, Desired: set.Replicas}
+	for _, uri := range set.Spawnpoints {
+		replica := assessReplica(uri, views[uri], set.Service.Name, now)
+		if replica.Available() {
+			status.Available++
+		}
+		status.Replicas = append(status.Replicas, replica)
+	}
+	return status
+}
+
+// assessReplica determines the state of a service on one spawnpoint
+func assessReplica(uri string, view spawnpointView, svcName string, now time.Time) Replica {
+	replica := Replica{URI: uri, State: ReplicaAbsent}
+	if view.err != nil {
+		replica.State = ReplicaUnreachable
+		replica.Detail = view.err.Error()
+	} else if age := now.Sub(time.Unix(0, view.heartbeat.Time)); age > HeartbeatHorizon {
+		replica.State = ReplicaUnreachable
+		replica.Detail = fmt.Sprintf("Last seen %s ago", age.Truncate(time.Second))
+	} else if runsService(view.heartbeat, svcName) {
+		// The daemon only lists services whose containers have started
+		replica.State = daemon.ServiceRunning
+		if svcHb := view.svcHeartbeat; svcHb != nil && now.Sub(time.Unix(0, svcHb.Time)) <= HeartbeatHorizon {
+			// Older daemons do not report service state
+			if len(svcHb.State) > 0 {
+				replica.State = svcHb.State
+			}
+			replica.Health = svcHb.Health
+		}
+	}
+	return replica
+}
+
+// planReconcile decides where to deploy and stop replicas of a replica set
+// Nothing is stopped while replicas are missing, since a degraded replica is
+// better than none until its replacement is up
+func planReconcile(set *ReplicaSet, status *ReplicaSetStatus, views map[string]spawnpointView,
+	strategy PlacementStrategy, now time.Time) (deploys []string, stops []string) {
+	if missing := set.Replicas - status.Available; missing > 0 {
+		heartbeats := make(map[string]daemon.Heartbeat)
+		for _, replica := range status.Replicas {
+			if replica.State == ReplicaAbsent {
+				heartbeats[replica.URI] = *views[replica.URI].heartbeat
+			}
+		}
+		for _, candidate := range placeService(&set.Service, heartbeats, strategy, now).Candidates {
+			if len(candidate.Rejection) == 0 && len(deploys) < missing {
+				deploys = append(deploys, candidate.URI)
+			}
+		}
+		return deploys, nil
+	}
+
+	var present []Replica
+	for _, replica := range status.Replicas {
+		if replica.present() {
+			present = append(present, replica)
+		}
+	}
+	sort.SliceStable(present, func(i, j int) bool {
+		return !present[i].Available() && present[j].Available()
+	})
+	for i := 0; i < len(present)-set.Replicas; i++ {
+		stops = append(stops, present[i].URI)
+	}
+	return nil, stops
+}
+
+func runsService(hb *daemon.Heartbeat, svcName string) bool {
+	for _, name := range hb.Services {
+		if name == svcName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package spawnclient
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/daemon"
+)
+
+func TestReconcileReplicas(t *testing.T) {
+	now := time.Now()
+	set := &ReplicaSet{
+		Replicas:    2,
+		Spawnpoints: []string{"ns/spawnpoint/a", "ns/spawnpoint/b", "ns/spawnpoint/c", "ns/spawnpoint/d"},
+		Service:     service.Configuration{Name: "driver", CPUShares: 256, Memory: 256},
+	}
+	spawnpoint := func(services ...string) spawnpointView {
+		return spawnpointView{heartbeat: &daemon.Heartbeat{Time: now.UnixNano(), TotalCPU: 1024, TotalMemory: 1024,
+			AvailableCPU: 1024, AvailableMemory: 1024, Services: services}}
+	}
+	views := map[string]spawnpointView{
+		"ns/spawnpoint/a": spawnpoint("driver"),
+		"ns/spawnpoint/b": {err: errors.New("No spawnpoints found at URI")},
+		"ns/spawnpoint/c": spawnpoint("other"),
+		"ns/spawnpoint/d": spawnpoint(),
+	}
+
+	// One replica is running and the other's spawnpoint has gone away
+	status := assessReplicas(set, views, now)
+	states := make([]string, len(status.Replicas))
+	for i, replica := range status.Replicas {
+		states[i] = replica.State
+	}
+	if expected := []string{daemon.ServiceRunning, ReplicaUnreachable, ReplicaAbsent, ReplicaAbsent}; !reflect.DeepEqual(states, expected) {
+		t.Fatalf("Expected replica states %v, found %v", expected, states)
+	} else if status.Available != 1 {
+		t.Fatalf("Expected 1 available replica, found %d", status.Available)
+	}
+	deploys, stops := planReconcile(set, status, views, Spread{}, now)
+	if !reflect.DeepEqual(deploys, []string{"ns/spawnpoint/d"}) || len(stops) > 0 {
+		t.Fatalf("Expected to deploy to spawnpoint d only, found deploys %v and stops %v", deploys, stops)
+	}
+
+	// A crash-looping replica is replaced, then stopped once its replacement is up
+	views["ns/spawnpoint/d"] = spawnpoint("driver")
+	views["ns/spawnpoint/a"] = spawnpointView{
+		heartbeat:    views["ns/spawnpoint/a"].heartbeat,
+		svcHeartbeat: &daemon.ServiceHeartbeat{Time: now.UnixNano(), State: daemon.ServiceCrashLooping},
+	}
+	views["ns/spawnpoint/c"] = spawnpoint("other", "driver")
+	status = assessReplicas(set, views, now)
+	if status.Available != 2 {
+		t.Fatalf("Expected 2 available replicas, found %d", status.Available)
+	}
+	deploys, stops = planReconcile(set, status, views, Spread{}, now)
+	if len(deploys) > 0 || !reflect.DeepEqual(stops, []string{"ns/spawnpoint/a"}) {
+		t.Fatalf("Expected to stop spawnpoint a only, found deploys %v and stops %v", deploys, stops)
+	}
+}
@@ -0,0 +1,156 @@
+package spawnclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+)
+
+// Stack is a group of cooperating services, possibly on different spawnpoints,
+// that are started in the order listed and torn down in reverse
+type Stack struct {
+	Name     string         `yaml:"name"`
+	Services []StackService `yaml:"services"`
+}
+
+// StackService is one of a stack's services and the spawnpoint it runs on
+type StackService struct {
+	Spawnpoint string                `yaml:"spawnpoint"`
+	Service    service.Configuration `yaml:"service"`
+}
+
+// StackResult is the outcome of an operation on one of a stack's services
+// Detail explains what happened when no operation was carried out, or when
+// the result of one was later undone
+type StackResult struct {
+	Name   string
+	URI    string
+	Status *service.ServiceStatus
+	Err    error
+	Detail string
+}
+
+// StackServiceState is the state of one of a stack's services
+type StackServiceState struct {
+	Name string
+	Replica
+}
+
+// ValidateStack checks a stack's specification before anything is deployed
+func ValidateStack(stack *Stack) error {
+	if len(stack.Name) == 0 {
+		return errors.New("Stack has no name")
+	} else if len(stack.Services) == 0 {
+		return errors.New("Stack has no services")
+	}
+	seen := make(map[string]bool)
+	for i, entry := range stack.Services {
+		if len(entry.Service.Name) == 0 {
+			return fmt.Errorf("Service %d has no name", i+1)
+		} else if len(entry.Spawnpoint) == 0 {
+			return fmt.Errorf("Service %s has no spawnpoint", entry.Service.Name)
+		}
+		key := entry.Spawnpoint + "/" + entry.Service.Name
+		if seen[key] {
+			return fmt.Errorf("Service %s is listed more than once for %s", entry.Service.Name, entry.Spawnpoint)
+		}
+		seen[key] = true
+		if err := validateConfig(&entry.Service); err != nil {
+			return errors.Wrapf(err, "Invalid configuration for service %s", entry.Service.Name)
+		}
+	}
+	return nil
+}
+
+// StackUp deploys a stack's services in order, waiting for each to start
+// before deploying the next. Services that are already running are left as
+// they are. If a service fails to start, the services started before it are
+// stopped again and the rest are not deployed.
+func (sc *Client) StackUp(stack *Stack) ([]StackResult, error) {
+	results := make([]StackResult, len(stack.Services))
+	for i, entry := range stack.Services {
+		results[i] = StackResult{Name: entry.Service.Name, URI: entry.Spawnpoint}
+	}
+
+	for i, entry := range stack.Services {
+		config := entry.Service
+		results[i].Status, results[i].Err = sc.DeployAndWait(&config, entry.Spawnpoint)
+		if opErr, ok := results[i].Err.(*OperationError); ok && opErr.Code == 409 && sc.isRunning(entry) {
+			results[i].Err = nil
+			results[i].Detail = "Service is already running"
+		} else if results[i].Err != nil {
+			for j := i + 1; j < len(results); j++ {
+				results[j].Detail = "Not deployed"
+			}
+			stopped := sc.rollbackStack(results[:i], entry.Service.Name)
+			return results, fmt.Errorf("Service %s of stack %s failed to start, stopped %d service(s) started before it",
+				entry.Service.Name, stack.Name, stopped)
+		}
+	}
+	return results, nil
+}
+
+// isRunning checks whether a stack's service is reported by its spawnpoint,
+// since a deploy is also refused with a conflict over host ports
+func (sc *Client) isRunning(entry StackService) bool {
+	view := sc.viewSpawnpoint(entry.Spawnpoint, entry.Service.Name)
+	replica := assessReplica(entry.Spawnpoint, view, entry.Service.Name, time.Now())
+	return replica.present()
+}
+
+// rollbackStack stops the services that StackUp started, in reverse order
+func (sc *Client) rollbackStack(results []StackResult, failedName string) int {
+	stopped := 0
+	for i := len(results) - 1; i >= 0; i-- {
+		if len(results[i].Detail) > 0 {
+			// Already running before the stack was brought up
+			continue
+		}
+		if _, err := sc.Stop(results[i].URI, results[i].Name); err != nil {
+			results[i].Detail = fmt.Sprintf("Failed to stop after failure of %s: %s", failedName, err)
+		} else {
+			results[i].Detail = fmt.Sprintf("Stopped after failure of %s", failedName)
+			stopped++
+		}
+	}
+	return stopped
+}
+
+// StackDown stops a stack's services in reverse order
+// Services that are not running are skipped
+func (sc *Client) StackDown(stack *Stack) ([]StackResult, error) {
+	var results []StackResult
+	failures := 0
+	for i := len(stack.Services) - 1; i >= 0; i-- {
+		entry := stack.Services[i]
+		result := StackResult{Name: entry.Service.Name, URI: entry.Spawnpoint}
+		result.Status, result.Err = sc.Stop(entry.Spawnpoint, entry.Service.Name)
+		if opErr, ok := result.Err.(*OperationError); ok && opErr.Code == 404 {
+			result.Err = nil
+			result.Detail = "Service is not running"
+		} else if result.Err != nil {
+			failures++
+		}
+		results = append(results, result)
+	}
+	if failures > 0 {
+		return results, fmt.Errorf("Failed to stop %d service(s) of stack %s", failures, stack.Name)
+	}
+	return results, nil
+}
+
+// StackStatus inspects the spawnpoint of each of a stack's services
+func (sc *Client) StackStatus(stack *Stack) []StackServiceState {
+	now := time.Now()
+	states := make([]StackServiceState, len(stack.Services))
+	for i, entry := range stack.Services {
+		view := sc.viewSpawnpoint(entry.Spawnpoint, entry.Service.Name)
+		states[i] = StackServiceState{
+			Name:    entry.Service.Name,
+			Replica: assessReplica(entry.Spawnpoint, view, entry.Service.Name, now),
+		}
+	}
+	return states
+}
@@ -47,7 +47,48 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "uri, u",
-					Usage:  "BW2 URI of the destination Spawnpoint",
+					Usage:  "BW2 URI of the destination Spawnpoint, or the base URI to search with --auto",
+					Value:  "",
+					EnvVar: "SPAWNPOINT_DEFAULT_URI",
+				},
+				cli.BoolFlag{
+					Name:  "auto, a",
+					Usage: "Choose a Spawnpoint under the base URI that can host the service",
+				},
+				cli.StringFlag{
+					Name:  "strategy, s",
+					Usage: "How --auto chooses: most-free-memory, bin-pack, spread, or label-affinity",
+					Value: "most-free-memory",
+				},
+				cli.StringSliceFlag{
+					Name:  "prefer-label, l",
+					Usage: "Host label, as key=value, preferred by the label-affinity strategy",
+				},
+				cli.StringFlag{
+					Name:  "configuration, c",
+					Usage: "YAML service configuration file",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "name, n",
+					Usage: "Name of the service",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "timeout, t",
+					Usage: "Timeout duration (optional)",
+					Value: "",
+				},
+			},
+		},
+		{
+			Name:   "update",
+			Usage:  "Replace a running service with a new configuration, rolling back if it fails",
+			Action: actionUpdate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "uri, u",
+					Usage:  "BW2 URI of the host Spawnpoint",
 					Value:  "",
 					EnvVar: "SPAWNPOINT_DEFAULT_URI",
 				},
@@ -148,6 +189,16 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:        "replicas",
+			Usage:       "Manage a service replicated across several Spawnpoints",
+			Subcommands: replicaCommands,
+		},
+		{
+			Name:        "stack",
+			Usage:       "Manage a group of services deployed as a unit",
+			Subcommands: stackCommands,
+		},
 		{
 			Name:   "scan",
 			Usage:  "Scan a base URI for running Spawnpoints",
@@ -158,6 +209,10 @@ func main() {
 					Usage: "Base BW2 URI to scan",
 					Value: "",
 				},
+				cli.StringSliceFlag{
+					Name:  "constraint",
+					Usage: "Only show Spawnpoints with this label, as key=value (optional)",
+				},
 			},
 		},
 	}
@@ -166,6 +221,16 @@ func main() {
 }
 
 func actionDeploy(c *cli.Context) error {
+	return submitService(c, false)
+}
+
+func actionUpdate(c *cli.Context) error {
+	return submitService(c, true)
+}
+
+// submitService sends a service configuration to a Spawnpoint, either as a new
+// deployment or as an update of a running service, and then tails the service's logs
+func submitService(c *cli.Context, update bool) error {
 	entity := c.GlobalString("entity")
 	if len(entity) == 0 {
 		fmt.Println("Missing 'entity' parameter")
@@ -213,24 +278,44 @@ func actionDeploy(c *cli.Context) error {
 		}
 	}
 
-	currentDir, err := os.Getwd()
-	if err != nil {
-		fmt.Println("Warning: Unable to get current working directory to save info for deploy-last")
-	} else if err = saveDeployment(currentDir, deployment{
-		BW2Entity:     entity,
-		URI:           spawnpointURI,
-		Name:          svcName,
-		Configuration: cfgFile,
-		Timeout:       timeoutStr,
-	}, getDeploymentHistoryFile()); err != nil {
-		fmt.Println("Warning: Failed to save deployment info for deploy-last")
-	}
-
 	spawnClient, err := spawnclient.New(c.GlobalString("router"), entity)
 	if err != nil {
 		fmt.Printf("Could not create spawnpoint client: %s\n", err)
 		os.Exit(1)
 	}
+	if !update && c.Bool("auto") {
+		strategy, err := parsePlacementStrategy(c.String("strategy"), c.StringSlice("prefer-label"))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		placement, err := spawnClient.Place(config, fixBaseURI(spawnpointURI), strategy)
+		if placement != nil {
+			printPlacement(placement)
+		}
+		if err != nil {
+			fmt.Printf("Failed to place service: %s\n", err)
+			os.Exit(1)
+		}
+		spawnpointURI = placement.URI
+	}
+
+	// Only new deployments are recorded for deploy-last, with the chosen Spawnpoint if placed automatically
+	if !update {
+		currentDir, err := os.Getwd()
+		if err != nil {
+			fmt.Println("Warning: Unable to get current working directory to save info for deploy-last")
+		} else if err = saveDeployment(currentDir, deployment{
+			BW2Entity:     entity,
+			URI:           spawnpointURI,
+			Name:          svcName,
+			Configuration: cfgFile,
+			Timeout:       timeoutStr,
+		}, getDeploymentHistoryFile()); err != nil {
+			fmt.Println("Warning: Failed to save deployment info for deploy-last")
+		}
+	}
+
 	age, err := checkSpawnpointHealth(spawnClient, spawnpointURI)
 	if err != nil {
 		fmt.Printf("Failed to check spawnpoint health: %s\n", err)
@@ -262,7 +347,12 @@ func actionDeploy(c *cli.Context) error {
 	default:
 	}
 
-	if err = spawnClient.Deploy(config, spawnpointURI); err != nil {
+	if update {
+		if _, err = spawnClient.Update(config, spawnpointURI); err != nil {
+			fmt.Printf("Failed to update service: %s\n", err)
+			os.Exit(1)
+		}
+	} else if _, err = spawnClient.Deploy(config, spawnpointURI); err != nil {
 		fmt.Printf("Failed to deploy service: %s\n", err)
 		os.Exit(1)
 	}
@@ -379,12 +469,12 @@ func manipulateService(c *cli.Context, command string) error {
 
 	switch command {
 	case "stop":
-		if err = spawnClient.Stop(spawnpointURI, svcName); err != nil {
+		if _, err = spawnClient.Stop(spawnpointURI, svcName); err != nil {
 			fmt.Printf("Could not stop service: %s\n", err)
 			os.Exit(1)
 		}
 	case "restart":
-		if err = spawnClient.Restart(spawnpointURI, svcName); err != nil {
+		if _, err = spawnClient.Restart(spawnpointURI, svcName); err != nil {
 			fmt.Printf("Could not restart service: %s\n", err)
 			os.Exit(1)
 		}
@@ -431,13 +521,19 @@ func actionScan(c *cli.Context) error {
 		os.Exit(1)
 	}
 
+	constraints, err := parseLabels(c.StringSlice("constraint"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	spawnClient, err := spawnclient.New(c.GlobalString("router"), entity)
 	if err != nil {
 		fmt.Printf("Could not create spawnpoint client: %s\n", err)
 		os.Exit(1)
 	}
 
-	heartbeats, err := spawnClient.Scan(baseURI)
+	heartbeats, err := spawnClient.ScanMatching(baseURI, constraints)
 	if err != nil {
 		fmt.Printf("Scan failed: %s\n", err)
 		os.Exit(1)
@@ -481,6 +577,41 @@ func fixBaseURI(uri string) string {
 	return uri + "/*"
 }
 
+// parsePlacementStrategy interprets the strategy named on the command line
+func parsePlacementStrategy(name string, preferredLabels []string) (spawnclient.PlacementStrategy, error) {
+	switch name {
+	case "most-free-memory":
+		return spawnclient.MostFreeMemory{}, nil
+	case "bin-pack":
+		return spawnclient.BinPack{}, nil
+	case "spread":
+		return spawnclient.Spread{}, nil
+	case "label-affinity":
+		labels, err := parseLabels(preferredLabels)
+		if err != nil {
+			return nil, err
+		} else if len(labels) == 0 {
+			return nil, errors.New("The label-affinity strategy requires at least one --prefer-label")
+		}
+		return spawnclient.LabelAffinity(labels), nil
+	default:
+		return nil, fmt.Errorf("Unknown placement strategy %s", name)
+	}
+}
+
+// parseLabels interprets labels given on the command line as key=value
+func parseLabels(pairs []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range pairs {
+		pair := strings.SplitN(label, "=", 2)
+		if len(pair) != 2 || len(pair[0]) == 0 {
+			return nil, fmt.Errorf("Illegal label %s, must be of the form key=value", label)
+		}
+		labels[pair[0]] = pair[1]
+	}
+	return labels, nil
+}
+
 func parseSvcConfig(configFile string) (*service.Configuration, error) {
 	contents, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnclient"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/daemon"
 )
 
@@ -17,6 +19,7 @@ func printSpawnpointStatus(uri string, hb *daemon.Heartbeat) {
 	fmt.Printf("[%s] seen %s (%s) ago at %s\n", alias, lastSeen.Format(time.RFC822), duration.String(), uri)
 	fmt.Printf("Available CPU Shares: %v/%v\n", hb.AvailableCPU, hb.TotalCPU)
 	fmt.Printf("Available Memory: %v/%v\n", hb.AvailableMemory, hb.TotalMemory)
+	printLabels(hb.Labels)
 
 	fmt.Printf("%v Running Service(s)\n", len(hb.Services))
 	for _, service := range hb.Services {
@@ -24,6 +27,19 @@ func printSpawnpointStatus(uri string, hb *daemon.Heartbeat) {
 	}
 }
 
+// printLabels lists a Spawnpoint's labels, if it has any
+func printLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	fmt.Printf("Labels: %s\n", strings.Join(pairs, ", "))
+}
+
 func printSpawnpointDetails(uri string, daemonHb *daemon.Heartbeat, svcHbs map[string]daemon.ServiceHeartbeat) {
 	tokens := strings.Split(uri, "/")
 	alias := tokens[len(tokens)-1]
@@ -33,6 +49,7 @@ func printSpawnpointDetails(uri string, daemonHb *daemon.Heartbeat, svcHbs map[s
 	fmt.Printf("[%s] seen %s (%s) ago at %s\n", alias, lastSeen.Format(time.RFC822), duration.String(), uri)
 	fmt.Printf("Available CPU Shares: %v/%v\n", daemonHb.AvailableCPU, daemonHb.TotalCPU)
 	fmt.Printf("Available Memory: %v/%v\n", daemonHb.AvailableMemory, daemonHb.TotalMemory)
+	printLabels(daemonHb.Labels)
 
 	fmt.Printf("%v Running Service(s)\n", len(daemonHb.Services))
 	for name, svcHb := range svcHbs {
@@ -42,6 +59,100 @@ func printSpawnpointDetails(uri string, daemonHb *daemon.Heartbeat, svcHbs map[s
 			fmt.Printf("• [%s] seen %s (%s) ago.\n", name, lastSeen.Format(time.RFC822), duration.String())
 			fmt.Printf("  CPU: ~%.2f/%d Shares. Memory: %.2f/%d MiB\n", svcHb.UsedCPUShares, svcHb.CPUShares,
 				svcHb.UsedMemory, svcHb.Memory)
+			// Older daemons do not report service state
+			if len(svcHb.State) > 0 {
+				fmt.Printf("  State: %s\n", svcHb.State)
+			}
+			if len(svcHb.Health) > 0 {
+				fmt.Printf("  Health: %s\n", svcHb.Health)
+			}
+			if len(svcHb.SourceCommit) > 0 {
+				fmt.Printf("  Source Commit: %s\n", svcHb.SourceCommit)
+			}
+		}
+	}
+}
+
+func printPlacement(placement *spawnclient.Placement) {
+	fmt.Printf("Considered %v Spawnpoint(s)\n", len(placement.Candidates))
+	for _, candidate := range placement.Candidates {
+		tokens := strings.Split(candidate.URI, "/")
+		alias := tokens[len(tokens)-1]
+		if len(candidate.Rejection) > 0 {
+			fmt.Printf("  ✗ [%s] rejected: %s\n", alias, candidate.Rejection)
+		} else if candidate.URI == placement.URI {
+			fmt.Printf("  ✓ [%s] chosen (score %.2f)\n", alias, candidate.Score)
+		} else {
+			fmt.Printf("  • [%s] score %.2f\n", alias, candidate.Score)
+		}
+	}
+}
+
+func printReplicaSetStatus(status *spawnclient.ReplicaSetStatus) {
+	fmt.Printf("[%s] %v/%v Replica(s) Available\n", status.Name, status.Available, status.Desired)
+	for _, replica := range status.Replicas {
+		tokens := strings.Split(replica.URI, "/")
+		alias := tokens[len(tokens)-1]
+		fmt.Printf("  • [%s] %s", alias, replica.State)
+		if len(replica.Health) > 0 {
+			fmt.Printf(", %s", replica.Health)
+		}
+		if len(replica.Detail) > 0 {
+			fmt.Printf(": %s", replica.Detail)
+		}
+		fmt.Println()
+	}
+}
+
+func printReplicaActions(actions []spawnclient.ReplicaAction) {
+	for _, action := range actions {
+		tokens := strings.Split(action.URI, "/")
+		alias := tokens[len(tokens)-1]
+		if action.Err != nil {
+			fmt.Printf("  ✗ %s on [%s] failed: %s\n", action.Operation, alias, action.Err)
+		} else {
+			fmt.Printf("  ✓ %s on [%s]\n", action.Operation, alias)
+		}
+	}
+}
+
+func printReconcileReport(report *spawnclient.ReconcileReport) {
+	printReplicaSetStatus(report.Status)
+	if len(report.Actions) == 0 && report.Err == nil {
+		fmt.Println("Nothing to do")
+	}
+	printReplicaActions(report.Actions)
+	if report.Err != nil {
+		fmt.Printf("Error: %s\n", report.Err)
+	}
+}
+
+func printStackResults(results []spawnclient.StackResult) {
+	for _, result := range results {
+		tokens := strings.Split(result.URI, "/")
+		alias := tokens[len(tokens)-1]
+		if result.Err != nil {
+			fmt.Printf("  ✗ %s on [%s]: %s\n", result.Name, alias, result.Err)
+		} else if len(result.Detail) > 0 {
+			fmt.Printf("  • %s on [%s]: %s\n", result.Name, alias, result.Detail)
+		} else if result.Status != nil {
+			fmt.Printf("  ✓ %s on [%s]: %s\n", result.Name, alias, result.Status.Message)
+		}
+	}
+}
+
+func printStackStatus(name string, states []spawnclient.StackServiceState) {
+	fmt.Printf("[%s] %v Service(s)\n", name, len(states))
+	for _, state := range states {
+		tokens := strings.Split(state.URI, "/")
+		alias := tokens[len(tokens)-1]
+		fmt.Printf("  • %s on [%s]: %s", state.Name, alias, state.State)
+		if len(state.Health) > 0 {
+			fmt.Printf(", %s", state.Health)
+		}
+		if len(state.Detail) > 0 {
+			fmt.Printf(": %s", state.Detail)
 		}
+		fmt.Println()
 	}
 }
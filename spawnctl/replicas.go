@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnclient"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var replicaSetFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "configuration, c",
+		Usage: "YAML replica set specification file",
+		Value: "",
+	},
+}
+
+var replicaPlacementFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "strategy, s",
+		Usage: "How to place missing replicas: most-free-memory, bin-pack, spread, or label-affinity",
+		Value: "spread",
+	},
+	cli.StringSliceFlag{
+		Name:  "prefer-label, l",
+		Usage: "Host label, as key=value, preferred by the label-affinity strategy",
+	},
+	cli.StringFlag{
+		Name:  "watch, w",
+		Usage: "Keep reconciling at this interval, e.g. '1m', until CTRL-c (optional)",
+		Value: "",
+	},
+}
+
+var replicaCommands = []cli.Command{
+	{
+		Name:   "up",
+		Usage:  "Deploy missing replicas and stop any beyond the desired number",
+		Action: actionReplicasUp,
+		Flags:  append(replicaSetFlags, replicaPlacementFlags...),
+	},
+	{
+		Name:   "status",
+		Usage:  "Show the state of each replica",
+		Action: actionReplicasStatus,
+		Flags:  replicaSetFlags,
+	},
+	{
+		Name:   "restart",
+		Usage:  "Restart every replica",
+		Action: actionReplicasRestart,
+		Flags:  replicaSetFlags,
+	},
+	{
+		Name:   "down",
+		Usage:  "Stop every replica",
+		Action: actionReplicasDown,
+		Flags:  replicaSetFlags,
+	},
+}
+
+func actionReplicasUp(c *cli.Context) error {
+	spawnClient, set := replicaSetContext(c)
+	strategy, err := parsePlacementStrategy(c.String("strategy"), c.StringSlice("prefer-label"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var interval time.Duration
+	if intervalStr := c.String("watch"); len(intervalStr) > 0 {
+		if interval, err = time.ParseDuration(intervalStr); err != nil || interval <= 0 {
+			fmt.Println("Illegal watch interval, must be a positive Go time duration, e.g. '1m'")
+			os.Exit(1)
+		}
+	}
+	if interval == 0 {
+		report := spawnClient.ReconcileReplicas(set, strategy)
+		printReconcileReport(report)
+		if report.Err != nil || !allSucceeded(report.Actions) {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	fmt.Printf("Reconciling replica set every %s. Press CTRL-c to exit...\n", interval)
+	for report := range spawnClient.MaintainReplicas(context.Background(), set, strategy, interval) {
+		fmt.Printf("--- %s\n", time.Now().Format(time.RFC822))
+		printReconcileReport(report)
+	}
+	return nil
+}
+
+func actionReplicasStatus(c *cli.Context) error {
+	spawnClient, set := replicaSetContext(c)
+	status := spawnClient.ReplicaStatus(set)
+	printReplicaSetStatus(status)
+	if status.Available < status.Desired {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func actionReplicasRestart(c *cli.Context) error {
+	spawnClient, set := replicaSetContext(c)
+	actions := spawnClient.RestartReplicas(set)
+	printReplicaActions(actions)
+	if !allSucceeded(actions) {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func actionReplicasDown(c *cli.Context) error {
+	spawnClient, set := replicaSetContext(c)
+	actions := spawnClient.StopReplicas(set)
+	printReplicaActions(actions)
+	if !allSucceeded(actions) {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// replicaSetContext reads the replica set named on the command line and
+// creates a client to manage it, exiting if either fails
+func replicaSetContext(c *cli.Context) (*spawnclient.Client, *spawnclient.ReplicaSet) {
+	entity := c.GlobalString("entity")
+	if len(entity) == 0 {
+		fmt.Println("Missing 'entity' parameter")
+		os.Exit(1)
+	}
+	specFile := c.String("configuration")
+	if len(specFile) == 0 {
+		fmt.Println("Missing 'configuration' parameter")
+		os.Exit(1)
+	}
+	set, err := parseReplicaSet(specFile)
+	if err != nil {
+		fmt.Printf("Failed to parse replica set file: %s\n", err)
+		os.Exit(1)
+	}
+
+	spawnClient, err := spawnclient.New(c.GlobalString("router"), entity)
+	if err != nil {
+		fmt.Printf("Could not create spawnpoint client: %s\n", err)
+		os.Exit(1)
+	}
+	return spawnClient, set
+}
+
+func parseReplicaSet(specFile string) (*spawnclient.ReplicaSet, error) {
+	contents, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read replica set file")
+	}
+	var set spawnclient.ReplicaSet
+	if err = yaml.Unmarshal(contents, &set); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse replica set")
+	}
+	for i, uri := range set.Spawnpoints {
+		set.Spawnpoints[i] = fixURI(uri)
+	}
+	if err = spawnclient.ValidateReplicaSet(&set); err != nil {
+		return nil, errors.Wrap(err, "Invalid replica set")
+	}
+	return &set, nil
+}
+
+func allSucceeded(actions []spawnclient.ReplicaAction) bool {
+	for _, action := range actions {
+		if action.Err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnclient"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// stackFile is a stack as written by hand, where each service's configuration
+// is either given inline or read from its own file
+type stackFile struct {
+	Name     string `yaml:"name"`
+	Services []struct {
+		Spawnpoint    string                 `yaml:"spawnpoint"`
+		Configuration string                 `yaml:"configuration"`
+		Service       *service.Configuration `yaml:"service"`
+	} `yaml:"services"`
+}
+
+var stackFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "configuration, c",
+		Usage: "YAML stack file",
+		Value: "",
+	},
+}
+
+var stackCommands = []cli.Command{
+	{
+		Name:   "up",
+		Usage:  "Deploy the stack's services in order, stopping them all if one fails to start",
+		Action: actionStackUp,
+		Flags:  stackFlags,
+	},
+	{
+		Name:   "down",
+		Usage:  "Stop the stack's services in reverse order",
+		Action: actionStackDown,
+		Flags:  stackFlags,
+	},
+	{
+		Name:   "status",
+		Usage:  "Show the state of each of the stack's services",
+		Action: actionStackStatus,
+		Flags:  stackFlags,
+	},
+}
+
+func actionStackUp(c *cli.Context) error {
+	spawnClient, stack := stackContext(c)
+	fmt.Printf("Deploying %v service(s) of stack %s...\n", len(stack.Services), stack.Name)
+	results, err := spawnClient.StackUp(stack)
+	printStackResults(results)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func actionStackDown(c *cli.Context) error {
+	spawnClient, stack := stackContext(c)
+	fmt.Printf("Stopping %v service(s) of stack %s...\n", len(stack.Services), stack.Name)
+	results, err := spawnClient.StackDown(stack)
+	printStackResults(results)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func actionStackStatus(c *cli.Context) error {
+	spawnClient, stack := stackContext(c)
+	states := spawnClient.StackStatus(stack)
+	printStackStatus(stack.Name, states)
+	for _, state := range states {
+		if !state.Available() {
+			os.Exit(1)
+		}
+	}
+	return nil
+}
+
+// stackContext reads the stack named on the command line and creates a client
+// to manage it, exiting if either fails
+func stackContext(c *cli.Context) (*spawnclient.Client, *spawnclient.Stack) {
+	entity := c.GlobalString("entity")
+	if len(entity) == 0 {
+		fmt.Println("Missing 'entity' parameter")
+		os.Exit(1)
+	}
+	specFile := c.String("configuration")
+	if len(specFile) == 0 {
+		fmt.Println("Missing 'configuration' parameter")
+		os.Exit(1)
+	}
+	stack, err := parseStack(specFile)
+	if err != nil {
+		fmt.Printf("Failed to parse stack file: %s\n", err)
+		os.Exit(1)
+	}
+
+	spawnClient, err := spawnclient.New(c.GlobalString("router"), entity)
+	if err != nil {
+		fmt.Printf("Could not create spawnpoint client: %s\n", err)
+		os.Exit(1)
+	}
+	return spawnClient, stack
+}
+
+func parseStack(fileName string) (*spawnclient.Stack, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read stack file")
+	}
+	var file stackFile
+	if err = yaml.Unmarshal(contents, &file); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse stack")
+	}
+
+	stack := spawnclient.Stack{Name: file.Name}
+	for i, entry := range file.Services {
+		config := entry.Service
+		if len(entry.Configuration) > 0 {
+			if config != nil {
+				return nil, fmt.Errorf("Service %d has both a configuration file and an inline configuration", i+1)
+			} else if config, err = parseSvcConfig(entry.Configuration); err != nil {
+				return nil, errors.Wrapf(err, "Failed to read configuration of service %d", i+1)
+			}
+		} else if config == nil {
+			return nil, fmt.Errorf("Service %d has no configuration", i+1)
+		}
+		stack.Services = append(stack.Services, spawnclient.StackService{
+			Spawnpoint: fixURI(entry.Spawnpoint),
+			Service:    *config,
+		})
+	}
+	if err = spawnclient.ValidateStack(&stack); err != nil {
+		return nil, errors.Wrap(err, "Invalid stack")
+	}
+	return &stack, nil
+}
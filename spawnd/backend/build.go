@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+)
+
+var buildStepPattern = regexp.MustCompile(`^Step (\d+)/(\d+) : (.*)$`)
+
+// BuildError is returned when a step of a service's build fails, as opposed to
+// the backend failing to carry out the build at all
+type BuildError struct {
+	Step     int
+	Steps    int
+	ExitCode int
+	Message  string
+}
+
+func (err *BuildError) Error() string {
+	return err.Event().String()
+}
+
+// Event is the build event reporting the failure
+func (err *BuildError) Event() service.BuildEvent {
+	return service.BuildEvent{
+		Kind:     service.BuildError,
+		Step:     err.Step,
+		Steps:    err.Steps,
+		ExitCode: err.ExitCode,
+		Message:  err.Message,
+	}
+}
+
+// buildParser turns Docker's build output into build events
+// Output is attributed to the most recent step
+type buildParser struct {
+	step  int
+	steps int
+}
+
+// parse splits a chunk of build output into events, leaving out blank lines and
+// the IDs of intermediate containers and layers
+func (parser *buildParser) parse(output string) []service.BuildEvent {
+	var events []service.BuildEvent
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r ")
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		if match := buildStepPattern.FindStringSubmatch(line); match != nil {
+			parser.step, _ = strconv.Atoi(match[1])
+			parser.steps, _ = strconv.Atoi(match[2])
+			events = append(events, parser.event(service.BuildStep, match[3]))
+		} else if line == " ---> Using cache" {
+			events = append(events, parser.event(service.BuildCached, ""))
+		} else if strings.HasPrefix(line, " ---> ") || strings.HasPrefix(line, "Removing intermediate container") {
+			continue
+		} else {
+			events = append(events, parser.event(service.BuildOutput, line))
+		}
+	}
+	return events
+}
+
+// fail reports a failure of the current step
+func (parser *buildParser) fail(message string, exitCode int) *BuildError {
+	return &BuildError{
+		Step:     parser.step,
+		Steps:    parser.steps,
+		ExitCode: exitCode,
+		Message:  strings.TrimSpace(message),
+	}
+}
+
+func (parser *buildParser) event(kind string, message string) service.BuildEvent {
+	return service.BuildEvent{Kind: kind, Step: parser.step, Steps: parser.steps, Message: message}
+}
+
+// buildOutput is an event for a message from the backend itself rather than the build
+func buildOutput(format string, args ...interface{}) service.BuildEvent {
+	return service.BuildEvent{Kind: service.BuildOutput, Message: fmt.Sprintf(format, args...)}
+}
@@ -4,13 +4,16 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base32"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +24,7 @@ import (
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/volume"
 	docker "github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 	"github.com/pkg/errors"
 )
 
@@ -58,7 +62,19 @@ type dockerStatsResponse struct {
 }
 
 type imageBuildMessage struct {
-	Stream string `json:"stream"`
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+type imagePullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress string `json:"progress"`
+	Error    string `json:"error"`
 }
 
 func NewDocker(alias, bw2Router string) (*Docker, error) {
@@ -74,27 +90,73 @@ func NewDocker(alias, bw2Router string) (*Docker, error) {
 	}, nil
 }
 
-func (dkr *Docker) StartService(ctx context.Context, svcConfig *service.Configuration, log chan<- string) (string, error) {
-	defer close(log)
+func (dkr *Docker) StartService(ctx context.Context, svcConfig *service.Configuration, deployment Deployment, events chan<- service.BuildEvent) (string, error) {
+	imageName, err := dkr.BuildService(ctx, svcConfig, events)
+	if err != nil {
+		return "", err
+	}
+	return dkr.RunService(ctx, svcConfig, deployment, imageName)
+}
+
+func (dkr *Docker) BuildService(ctx context.Context, svcConfig *service.Configuration, events chan<- service.BuildEvent) (string, error) {
+	defer close(events)
 
+	if kind, location := svcConfig.SourceType(); kind == service.SourceImage {
+		if err := dkr.pullImage(ctx, location, svcConfig.CachePolicy == service.CacheReuse, events); err != nil {
+			return "", errors.Wrap(err, "Failed to pull service image")
+		}
+		return location, nil
+	}
 	baseImage := svcConfig.BaseImage
-	if len(baseImage) == 0 {
+	if len(baseImage) == 0 && len(svcConfig.Dockerfile) == 0 {
 		svcConfig.BaseImage = defaultSpawnpointImage
 	}
-	imageName, err := dkr.buildImage(ctx, svcConfig, log)
+	imageName, err := dkr.buildImage(ctx, svcConfig, events)
 	if err != nil {
 		return "", errors.Wrap(err, "Failed to build service Docker container")
 	}
+	return imageName, nil
+}
 
+// RunService creates and starts a container from an image produced by BuildService
+// A container that already holds the service's name, e.g. one being replaced
+// by an update, is renamed out of the way rather than removed
+func (dkr *Docker) RunService(ctx context.Context, svcConfig *service.Configuration, deployment Deployment, imageName string) (string, error) {
 	envVars := []string{
 		"BW2_DEFAULT_ENTITY=/srv/spawnpoint/entity.key",
 		"BW2_AGENT=" + dkr.bw2Router,
 	}
+	// Passed at container creation so that values never end up in an image layer
+	for name, value := range svcConfig.Environment {
+		envVars = append(envVars, fmt.Sprintf("%s=%s", name, value))
+	}
+	for _, secret := range svcConfig.Secrets {
+		envVars = append(envVars, fmt.Sprintf("%s=%s", secret.Name, secret.Value))
+	}
+	exposedPorts := make(nat.PortSet)
+	portBindings := make(nat.PortMap)
+	for _, port := range svcConfig.Ports {
+		containerPort := nat.Port(fmt.Sprintf("%d/%s", port.Container, port.EffectiveProtocol()))
+		exposedPorts[containerPort] = struct{}{}
+		portBindings[containerPort] = append(portBindings[containerPort], nat.PortBinding{
+			HostPort: strconv.Itoa(int(port.Host)),
+		})
+	}
+	// Prebuilt images keep their own working directory, and their entity is copied
+	// into the container rather than built into the image
+	prebuilt := false
+	workingDir := "/srv/spawnpoint"
+	if kind, _ := svcConfig.SourceType(); kind == service.SourceImage {
+		prebuilt = true
+		workingDir = ""
+	}
 	containerConfig := &container.Config{
 		Image:        imageName,
 		Cmd:          svcConfig.Run,
-		WorkingDir:   "/srv/spawnpoint",
+		WorkingDir:   workingDir,
 		Env:          envVars,
+		ExposedPorts: exposedPorts,
+		Labels:       manifestLabels(dkr.Alias, newManifest(svcConfig, deployment)),
 		AttachStderr: true,
 		AttachStdout: true,
 	}
@@ -112,9 +174,10 @@ func (dkr *Docker) StartService(ctx context.Context, svcConfig *service.Configur
 		}
 	}
 	hostConfig := &container.HostConfig{
-		NetworkMode: container.NetworkMode("bridge"),
-		LogConfig:   container.LogConfig{Config: map[string]string{"max-size": "50m"}},
-		Mounts:      mounts,
+		NetworkMode:  container.NetworkMode("bridge"),
+		LogConfig:    container.LogConfig{Config: map[string]string{"max-size": "50m"}},
+		Mounts:       mounts,
+		PortBindings: portBindings,
 		Resources: container.Resources{
 			CPUShares: int64(svcConfig.CPUShares),
 			Memory:    int64(svcConfig.Memory * 1024 * 1024),
@@ -126,10 +189,24 @@ func (dkr *Docker) StartService(ctx context.Context, svcConfig *service.Configur
 	}
 
 	containerName := fmt.Sprintf("%s_%s", dkr.Alias, svcConfig.Name)
+	existing, err := dkr.client.ContainerInspect(ctx, containerName)
+	if err == nil {
+		if err = dkr.client.ContainerRename(ctx, existing.ID, fmt.Sprintf("%s_%.12s", containerName, existing.ID)); err != nil {
+			return "", errors.Wrap(err, "Failed to rename existing Docker container")
+		}
+	} else if !docker.IsErrNotFound(err) {
+		return "", errors.Wrap(err, "Failed to inspect existing Docker container")
+	}
 	createdResult, err := dkr.client.ContainerCreate(ctx, containerConfig, hostConfig, nil, containerName)
 	if err != nil {
 		return "", errors.Wrap(err, "Failed to create Docker container")
 	}
+	if prebuilt {
+		if err = dkr.copyEntity(ctx, createdResult.ID, svcConfig.BW2Entity); err != nil {
+			dkr.client.ContainerRemove(ctx, createdResult.ID, types.ContainerRemoveOptions{})
+			return "", err
+		}
+	}
 	if err = dkr.client.ContainerStart(ctx, createdResult.ID, types.ContainerStartOptions{}); err != nil {
 		// Clean up the created container, but start error takes precedence
 		dkr.client.ContainerRemove(ctx, createdResult.ID, types.ContainerRemoveOptions{})
@@ -255,7 +332,11 @@ func (dkr *Docker) MonitorService(ctx context.Context, id string) (<-chan Event,
 			case event := <-evChan:
 				switch event.Action {
 				case "die":
-					transformedEvChan <- Die
+					if event.Actor.Attributes["exitCode"] == "0" {
+						transformedEvChan <- Exit
+					} else {
+						transformedEvChan <- Die
+					}
 				default:
 				}
 
@@ -288,6 +369,93 @@ func (dkr *Docker) ListServices(ctx context.Context) ([]string, error) {
 	return IDs, nil
 }
 
+// DiscoverServices lists all containers created by a daemon with the same alias, running or not
+func (dkr *Docker) DiscoverServices(ctx context.Context) ([]ContainerInfo, error) {
+	containers, err := dkr.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", labelAlias, dkr.Alias))),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list service containers")
+	}
+
+	infos := make([]ContainerInfo, len(containers))
+	for i, container := range containers {
+		infos[i] = ContainerInfo{ID: container.ID, Running: container.State == "running"}
+		// A container with malformed labels is still reported, so the caller knows it exists
+		infos[i].Manifest, _ = parseManifestLabels(container.Labels)
+	}
+	return infos, nil
+}
+
+// ListArtifacts reports the images and volumes created for services by a daemon with the same alias
+func (dkr *Docker) ListArtifacts(ctx context.Context) ([]Artifact, error) {
+	usage, err := dkr.client.DiskUsage(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve Docker disk usage")
+	}
+
+	var artifacts []Artifact
+	for _, image := range usage.Images {
+		if image.Labels[labelAlias] != dkr.Alias {
+			continue
+		}
+		name := image.ID
+		if len(image.RepoTags) > 0 {
+			name = image.RepoTags[0]
+		}
+		artifacts = append(artifacts, Artifact{
+			Kind:    ArtifactImage,
+			Name:    name,
+			Service: image.Labels[labelService],
+			Created: time.Unix(image.Created, 0),
+			Size:    image.Size,
+			InUse:   image.Containers > 0,
+		})
+	}
+	for _, volume := range usage.Volumes {
+		if volume.Labels[labelAlias] != dkr.Alias {
+			continue
+		}
+		artifact := Artifact{Kind: ArtifactVolume, Name: volume.Name, Size: -1}
+		// Volumes created by older versions of Docker may not record a creation time
+		artifact.Created, _ = time.Parse(time.RFC3339, volume.CreatedAt)
+		if volume.UsageData != nil {
+			artifact.Size = volume.UsageData.Size
+			artifact.InUse = volume.UsageData.RefCount > 0
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts, nil
+}
+
+func (dkr *Docker) RemoveArtifact(ctx context.Context, artifact Artifact) error {
+	switch artifact.Kind {
+	case ArtifactImage:
+		if _, err := dkr.client.ImageRemove(ctx, artifact.Name, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+			return errors.Wrap(err, "Failed to remove Docker image")
+		}
+	case ArtifactVolume:
+		if err := dkr.client.VolumeRemove(ctx, artifact.Name, false); err != nil {
+			return errors.Wrap(err, "Failed to remove Docker volume")
+		}
+	default:
+		return fmt.Errorf("Unknown artifact kind: %s", artifact.Kind)
+	}
+	return nil
+}
+
+// InspectService reads the manifest recorded in a service container's labels
+func (dkr *Docker) InspectService(ctx context.Context, id string) (*Manifest, error) {
+	info, err := dkr.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to inspect Docker container")
+	} else if info.Config == nil || info.Config.Labels[labelAlias] != dkr.Alias {
+		return nil, fmt.Errorf("Container %s is not a service container of this spawnpoint", id)
+	}
+	return parseManifestLabels(info.Config.Labels)
+}
+
 func (dkr *Docker) ProfileService(ctx context.Context, id string, period time.Duration) (<-chan Stats, <-chan error) {
 	statChan := make(chan Stats, 10)
 	errChan := make(chan error, 1)
@@ -343,8 +511,55 @@ func (dkr *Docker) ProfileService(ctx context.Context, id string, period time.Du
 	return statChan, errChan
 }
 
-func (dkr *Docker) buildImage(ctx context.Context, svcConfig *service.Configuration, log chan<- string) (string, error) {
-	buildCtxt, err := generateBuildContext(svcConfig)
+// ExecService runs a command inside a container and returns its exit code
+// The command is abandoned, although not killed, if ctx expires first
+func (dkr *Docker) ExecService(ctx context.Context, id string, cmd []string) (int, error) {
+	exec, err := dkr.client.ContainerExecCreate(ctx, id, types.ExecConfig{
+		Cmd:    cmd,
+		Detach: true,
+	})
+	if err != nil {
+		return -1, errors.Wrap(err, "Failed to create exec instance")
+	}
+	if err = dkr.client.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{Detach: true}); err != nil {
+		return -1, errors.Wrap(err, "Failed to start exec instance")
+	}
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		inspection, err := dkr.client.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return -1, errors.Wrap(err, "Failed to inspect exec instance")
+		} else if !inspection.Running {
+			return inspection.ExitCode, nil
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return -1, errors.Wrap(ctx.Err(), "Command did not complete")
+		}
+	}
+}
+
+func (dkr *Docker) buildImage(ctx context.Context, svcConfig *service.Configuration, events chan<- service.BuildEvent) (string, error) {
+	// Git sources are pinned to a commit before building, so that the image is reproducible
+	var commit string
+	if kind, url := svcConfig.SourceType(); kind == service.SourceGit {
+		var err error
+		_, ref := svcConfig.SplitSource()
+		if commit, err = resolveGitRef(ctx, url, ref); err != nil && len(ref) > 0 {
+			return "", errors.Wrap(err, "Failed to resolve source ref")
+		} else if err != nil {
+			events <- buildOutput("Cloning default branch, failed to resolve its commit: %s", err)
+		}
+	}
+	archive, err := fetchSourceArchive(ctx, svcConfig)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to retrieve source archive")
+	}
+	buildCtxt, err := generateBuildContext(svcConfig, commit, archive)
 	if err != nil {
 		return "", errors.Wrap(err, "Failed to generate Docker build context")
 	}
@@ -352,14 +567,32 @@ func (dkr *Docker) buildImage(ctx context.Context, svcConfig *service.Configurat
 	// Docker container names only tolerate a small set of characters
 	encodedName := base32.StdEncoding.EncodeToString([]byte(svcConfig.Name))
 	trimmedName := strings.TrimRight(encodedName, "=")
-	imgName := "spawnpoint_" + strings.ToLower(trimmedName)
-	resp, err := dkr.client.ImageBuild(ctx, buildCtxt, types.ImageBuildOptions{
+	// Images are tagged with a hash of their build context, which includes the
+	// dockerfile, so identical builds share a tag
+	contextHash := sha256.Sum256(buildCtxt)
+	imgName := fmt.Sprintf("spawnpoint_%s:%x", strings.ToLower(trimmedName), contextHash[:6])
+
+	reuse := svcConfig.CachePolicy == service.CacheReuse
+	if reuse {
+		if _, _, err = dkr.client.ImageInspectWithRaw(ctx, imgName); err == nil {
+			events <- buildOutput("Reusing cached image %s", imgName)
+			return imgName, nil
+		} else if !docker.IsErrNotFound(err) {
+			return "", errors.Wrap(err, "Failed to inspect cached image")
+		}
+	}
+	resp, err := dkr.client.ImageBuild(ctx, bytes.NewReader(buildCtxt), types.ImageBuildOptions{
 		Tags:        []string{imgName},
-		NoCache:     true,
-		Context:     buildCtxt,
+		NoCache:     !reuse,
 		Dockerfile:  "dockerfile",
 		Remove:      true,
 		ForceRemove: true,
+		// Containers inherit these labels, in addition to their own
+		Labels: map[string]string{
+			labelAlias:        dkr.Alias,
+			labelService:      svcConfig.Name,
+			labelSourceCommit: commit,
+		},
 	})
 	if err != nil {
 		return "", errors.Wrap(err, "Daemon failed to build image")
@@ -367,28 +600,134 @@ func (dkr *Docker) buildImage(ctx context.Context, svcConfig *service.Configurat
 
 	defer resp.Body.Close()
 	decoder := json.NewDecoder(resp.Body)
-	var msg imageBuildMessage
+	var parser buildParser
 	for {
+		var msg imageBuildMessage
 		if err := decoder.Decode(&msg); err != nil {
 			if err != io.EOF {
 				return "", errors.Wrap(err, "Failed to read image build output")
 			}
 			return imgName, nil
 		}
-		log <- msg.Stream
+		if len(msg.Error) > 0 {
+			// Docker only reports the exit code of a failed RUN instruction
+			buildErr := parser.fail(msg.Error, msg.ErrorDetail.Code)
+			events <- buildErr.Event()
+			return "", buildErr
+		}
+		for _, event := range parser.parse(msg.Stream) {
+			events <- event
+		}
+	}
+}
+
+// pullImage retrieves a prebuilt service image from its registry
+// Under the reuse cache policy, an image that is already present isn't pulled again
+func (dkr *Docker) pullImage(ctx context.Context, imageName string, reuse bool, events chan<- service.BuildEvent) error {
+	if reuse {
+		if _, _, err := dkr.client.ImageInspectWithRaw(ctx, imageName); err == nil {
+			events <- buildOutput("Reusing pulled image %s", imageName)
+			return nil
+		} else if !docker.IsErrNotFound(err) {
+			return errors.Wrap(err, "Failed to inspect pulled image")
+		}
+	}
+	resp, err := dkr.client.ImagePull(ctx, imageName, types.ImagePullOptions{})
+	if err != nil {
+		return errors.Wrap(err, "Daemon failed to pull image")
+	}
+
+	defer resp.Close()
+	decoder := json.NewDecoder(resp)
+	for {
+		var msg imagePullMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err != io.EOF {
+				return errors.Wrap(err, "Failed to read image pull output")
+			}
+			return nil
+		}
+		if len(msg.Error) > 0 {
+			return errors.New(msg.Error)
+		} else if len(msg.Progress) > 0 {
+			// Download progress is reported many times per layer
+			continue
+		} else if len(msg.ID) > 0 {
+			events <- buildOutput("%s: %s", msg.ID, msg.Status)
+		} else {
+			events <- buildOutput("%s", msg.Status)
+		}
+	}
+}
+
+// copyEntity places a service's entity in a container created from a prebuilt image
+func (dkr *Docker) copyEntity(ctx context.Context, id string, encodedEntity string) error {
+	entity, err := base64.StdEncoding.DecodeString(encodedEntity)
+	if err != nil {
+		return errors.Wrap(err, "Failed to decode BW2 entity")
+	}
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	if err = tarWriter.WriteHeader(&tar.Header{
+		Name:     "srv/spawnpoint/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	}); err != nil {
+		return errors.Wrap(err, "Failed to write entity directory tar header")
+	}
+	if err = tarWriter.WriteHeader(&tar.Header{
+		Name: "srv/spawnpoint/entity.key",
+		Size: int64(len(entity)),
+		Mode: 0644,
+	}); err != nil {
+		return errors.Wrap(err, "Failed to write entity file tar header")
 	}
+	if _, err = tarWriter.Write(entity); err != nil {
+		return errors.Wrap(err, "Failed to write entity file to tar")
+	}
+	if err = tarWriter.Close(); err != nil {
+		return errors.Wrap(err, "Failed to finish entity archive")
+	}
+
+	if err = dkr.client.CopyToContainer(ctx, id, "/", &buf, types.CopyToContainerOptions{}); err != nil {
+		return errors.Wrap(err, "Failed to copy entity into Docker container")
+	}
+	return nil
 }
 
-func generateDockerFile(config *service.Configuration) (*[]byte, error) {
+// generateDockerFile checks out the given commit of a git source, if there is one
+// A service's custom dockerfile is used instead, but still gets its entity and working directory
+func generateDockerFile(config *service.Configuration, commit string) (*[]byte, error) {
 	var dkrFileBuf bytes.Buffer
+	if len(config.Dockerfile) > 0 {
+		custom, err := readDockerfile(config)
+		if err != nil {
+			return nil, err
+		}
+		dkrFileBuf.Write(custom)
+		if len(custom) > 0 && custom[len(custom)-1] != '\n' {
+			dkrFileBuf.WriteString("\n")
+		}
+		dkrFileBuf.WriteString("WORKDIR /srv/spawnpoint\n")
+		dkrFileBuf.WriteString("COPY entity.key entity.key\n")
+		contents := dkrFileBuf.Bytes()
+		return &contents, nil
+	}
+
 	dkrFileBuf.WriteString(fmt.Sprintf("FROM %s\n", config.BaseImage))
-	if len(config.Source) > 0 {
-		sourceparts := strings.SplitN(config.Source, "+", 2)
-		switch sourceparts[0] {
-		case "git":
-			dkrFileBuf.WriteString(fmt.Sprintf("RUN git clone %s /srv/spawnpoint\n", sourceparts[1]))
+	if kind, location := config.SourceType(); len(kind) > 0 {
+		switch kind {
+		case service.SourceGit:
+			if len(commit) > 0 {
+				dkrFileBuf.WriteString(fmt.Sprintf("RUN git clone %s /srv/spawnpoint && git -C /srv/spawnpoint checkout -q %s\n",
+					location, commit))
+			} else {
+				dkrFileBuf.WriteString(fmt.Sprintf("RUN git clone %s /srv/spawnpoint\n", location))
+			}
+		case service.SourceHTTP, service.SourceHTTPS, service.SourceArchive:
+			dkrFileBuf.WriteString(fmt.Sprintf("COPY %s/ /srv/spawnpoint/\n", sourceContextDir))
 		default:
-			return nil, fmt.Errorf("Unkonwn source type: %s", config.Source)
+			return nil, fmt.Errorf("Unknown source type: %s", config.Source)
 		}
 	}
 	dkrFileBuf.WriteString("WORKDIR /srv/spawnpoint\n")
@@ -414,7 +753,7 @@ func generateDockerFile(config *service.Configuration) (*[]byte, error) {
 	return &contents, nil
 }
 
-func generateBuildContext(config *service.Configuration) (io.Reader, error) {
+func generateBuildContext(config *service.Configuration, commit string, archive []byte) ([]byte, error) {
 	var buildCtxtBuffer bytes.Buffer
 	tarWriter := tar.NewWriter(&buildCtxtBuffer)
 
@@ -434,7 +773,7 @@ func generateBuildContext(config *service.Configuration) (io.Reader, error) {
 	}
 
 	// Add synthetic dockerfile to the build context
-	dkrFileContents, err := generateDockerFile(config)
+	dkrFileContents, err := generateDockerFile(config, commit)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to generate dockerfile contents")
 	}
@@ -448,8 +787,21 @@ func generateBuildContext(config *service.Configuration) (io.Reader, error) {
 		return nil, errors.Wrap(err, "Failed to write Dockerfile to tar")
 	}
 
+	// Add the contents of a tarball or inline source, which the dockerfile copies into place
+	if archive != nil {
+		if err = unpackSourceArchive(tarWriter, archive); err != nil {
+			return nil, errors.Wrap(err, "Failed to add source archive to build context")
+		}
+	}
+
 	// Add any included files or directories to build context
 	// Last element of IncludedFiles is an encoded tar of files from client machine
+	// A custom dockerfile was merged into the generated one, and is left out so
+	// that it can't take the generated one's place
+	customDockerfile := ""
+	if len(config.Dockerfile) > 0 {
+		customDockerfile = filepath.Base(config.Dockerfile)
+	}
 	if len(config.IncludedFiles) > 0 {
 		encoding := config.IncludedFiles[len(config.IncludedFiles)-1]
 		decodedFiles, err := base64.StdEncoding.DecodeString(encoding)
@@ -464,13 +816,18 @@ func generateBuildContext(config *service.Configuration) (io.Reader, error) {
 				break
 			} else if err != nil {
 				return nil, errors.Wrap(err, "Failed to read included files archive")
+			} else if path.Clean(header.Name) == customDockerfile {
+				continue
 			}
 			tarWriter.WriteHeader(header)
 			io.Copy(tarWriter, tarReader)
 		}
 	}
 
-	return &buildCtxtBuffer, nil
+	if err = tarWriter.Close(); err != nil {
+		return nil, errors.Wrap(err, "Failed to finish build context")
+	}
+	return buildCtxtBuffer.Bytes(), nil
 }
 
 func (dkr *Docker) createMounts(ctx context.Context, volumeNames []string) ([]mount.Mount, error) {
@@ -483,7 +840,9 @@ func (dkr *Docker) createMounts(ctx context.Context, volumeNames []string) ([]mo
 	mounts := make([]mount.Mount, len(volumeNames))
 	for i, volumeName := range volumeNames {
 		if _, ok := existingVolumes[volumeName]; !ok {
-			if _, err := dkr.client.VolumeCreate(ctx, volume.VolumeCreateBody{Name: volumeName}); err != nil {
+			// Labeled so that the volume can be garbage collected once no service uses it
+			createBody := volume.VolumeCreateBody{Name: volumeName, Labels: map[string]string{labelAlias: dkr.Alias}}
+			if _, err := dkr.client.VolumeCreate(ctx, createBody); err != nil {
 				return nil, errors.Wrap(err, "Failed to create Docker volume")
 			}
 		}
@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+)
+
+// Instructions understood by Docker's builder
+var dockerfileInstructions = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true, "ENV": true,
+	"EXPOSE": true, "FROM": true, "HEALTHCHECK": true, "LABEL": true, "MAINTAINER": true,
+	"ONBUILD": true, "RUN": true, "SHELL": true, "STOPSIGNAL": true, "USER": true,
+	"VOLUME": true, "WORKDIR": true,
+}
+
+// ValidateDockerfile checks that a service's custom dockerfile, if it has one,
+// was included with its configuration and can be built
+func ValidateDockerfile(config *service.Configuration) error {
+	if len(config.Dockerfile) == 0 {
+		return nil
+	}
+	contents, err := readDockerfile(config)
+	if err != nil {
+		return err
+	}
+	return checkDockerfile(contents)
+}
+
+// readDockerfile finds a service's custom dockerfile among its included files
+// Last element of IncludedFiles is an encoded tar of files from client machine
+func readDockerfile(config *service.Configuration) ([]byte, error) {
+	name := filepath.Base(config.Dockerfile)
+	if len(config.IncludedFiles) == 0 {
+		return nil, fmt.Errorf("Dockerfile %s was not included with the configuration", name)
+	}
+	decodedFiles, err := base64.StdEncoding.DecodeString(config.IncludedFiles[len(config.IncludedFiles)-1])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decode included files")
+	}
+	tarReader := tar.NewReader(bytes.NewReader(decodedFiles))
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Dockerfile %s was not included with the configuration", name)
+		} else if err != nil {
+			return nil, errors.Wrap(err, "Failed to read included files archive")
+		}
+		if path.Clean(header.Name) == name {
+			return ioutil.ReadAll(tarReader)
+		}
+	}
+}
+
+// checkDockerfile applies the syntax checks that Docker's builder makes before
+// it runs anything: every instruction is known and has arguments, and nothing
+// but ARG comes before the first FROM
+func checkDockerfile(contents []byte) error {
+	escape := `\`
+	sawFrom := false
+	inDirectives := true
+	var instruction string
+	var start int
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		// Parser directives, e.g. "# escape=`", may only appear at the very top
+		if inDirectives && strings.HasPrefix(line, "#") {
+			directive := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), "=", 2)
+			if len(directive) == 2 && strings.ToLower(strings.TrimSpace(directive[0])) == "escape" {
+				escape = strings.TrimSpace(directive[1])
+				if escape != `\` && escape != "`" {
+					return fmt.Errorf("Line %d: invalid escape character %s", lineNum, escape)
+				}
+			}
+			continue
+		}
+		inDirectives = false
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if len(instruction) == 0 {
+			start = lineNum
+		}
+		instruction += " " + line
+		if strings.HasSuffix(instruction, escape) {
+			instruction = strings.TrimSuffix(instruction, escape)
+			continue
+		}
+
+		fields := strings.Fields(instruction)
+		instruction = ""
+		keyword := strings.ToUpper(fields[0])
+		if !dockerfileInstructions[keyword] {
+			return fmt.Errorf("Line %d: unknown instruction %s", start, fields[0])
+		} else if len(fields) < 2 {
+			return fmt.Errorf("Line %d: %s requires arguments", start, keyword)
+		} else if !sawFrom && keyword != "FROM" && keyword != "ARG" {
+			return fmt.Errorf("Line %d: %s comes before the first FROM", start, keyword)
+		}
+		sawFrom = sawFrom || keyword == "FROM"
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "Failed to read dockerfile")
+	} else if len(instruction) > 0 {
+		return fmt.Errorf("Line %d: instruction continues past the end of the dockerfile", start)
+	} else if !sawFrom {
+		return errors.New("Dockerfile has no FROM instruction")
+	}
+	return nil
+}
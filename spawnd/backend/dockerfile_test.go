@@ -0,0 +1,29 @@
+package backend
+
+import "testing"
+
+func TestCheckDockerfile(t *testing.T) {
+	valid := []string{
+		"FROM golang:1.10 AS build\nRUN go build -o demosvc\n\nFROM alpine\nCOPY --from=build /go/demosvc .\n",
+		"ARG VERSION=1.10\nFROM golang:${VERSION}\n# Build the service\nRUN go get -d && \\\n    # comments may interrupt a continuation\n    go build\n",
+		"# escape=`\nFROM microsoft/nanoserver\nRUN dir `\n    c:\\\n",
+	}
+	for _, contents := range valid {
+		if err := checkDockerfile([]byte(contents)); err != nil {
+			t.Errorf("Expected dockerfile to be valid, found %s:\n%s", err, contents)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"RUN go build\nFROM golang\n",
+		"FROM golang\nBUILD demosvc\n",
+		"FROM\n",
+		"FROM golang\nRUN go get -d && \\\n",
+	}
+	for _, contents := range invalid {
+		if err := checkDockerfile([]byte(contents)); err == nil {
+			t.Errorf("Expected dockerfile to be invalid:\n%s", contents)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+)
+
+// Fake is an in-memory ServiceBackend that never runs anything. Every
+// container lifecycle event it produces is either a direct consequence of a
+// call made by the daemon or explicitly injected by a test, which makes the
+// daemon's service state machine deterministic to exercise.
+type Fake struct {
+	Alias       string
+	mutex       sync.Mutex
+	nextID      uint64
+	services    map[string]*fakeService
+	images      map[string]*fakeImage
+	volumes     map[string]time.Time
+	buildLogs   map[string][]string
+	buildErrors map[string]error
+}
+
+type fakeService struct {
+	seq      uint64
+	name     string
+	manifest *Manifest
+	image    string
+	running  bool
+	logs     []string
+	stats    Stats
+	exitCode int
+	tails    []*fakeSubscriber
+	monitors []*fakeSubscriber
+	profiles []*fakeSubscriber
+}
+
+// fakeImage is a record of a completed build
+type fakeImage struct {
+	service      string
+	sourceCommit string
+	created      time.Time
+}
+
+type fakeSubscriber struct {
+	ctx  context.Context
+	msgs chan string
+	evs  chan Event
+	stts chan Stats
+}
+
+func NewFake(alias string) *Fake {
+	return &Fake{
+		Alias:       alias,
+		services:    make(map[string]*fakeService),
+		images:      make(map[string]*fakeImage),
+		volumes:     make(map[string]time.Time),
+		buildLogs:   make(map[string][]string),
+		buildErrors: make(map[string]error),
+	}
+}
+
+// InjectBuildLog sets the lines of Docker-like output emitted while "building" the named service
+func (fake *Fake) InjectBuildLog(svcName string, lines ...string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.buildLogs[svcName] = lines
+}
+
+// InjectBuildFailure causes subsequent attempts to start the named service to fail
+// A *BuildError is reported as a failed build step rather than a backend failure
+// Pass a nil error to clear a previously injected failure
+func (fake *Fake) InjectBuildFailure(svcName string, err error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if err == nil {
+		delete(fake.buildErrors, svcName)
+	} else {
+		fake.buildErrors[svcName] = err
+	}
+}
+
+// InjectArtifactAge backdates the creation of an image or volume
+func (fake *Fake) InjectArtifactAge(name string, age time.Duration) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if image, ok := fake.images[name]; ok {
+		image.created = time.Now().Add(-age)
+	} else if _, ok := fake.volumes[name]; ok {
+		fake.volumes[name] = time.Now().Add(-age)
+	} else {
+		return fmt.Errorf("Unknown artifact %s", name)
+	}
+	return nil
+}
+
+// InjectDie simulates the unexpected termination of a running container
+func (fake *Fake) InjectDie(id string) error {
+	return fake.injectTermination(id, Die)
+}
+
+// InjectExit simulates a running container exiting cleanly
+func (fake *Fake) InjectExit(id string) error {
+	return fake.injectTermination(id, Exit)
+}
+
+func (fake *Fake) injectTermination(id string, event Event) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return fmt.Errorf("Unknown container %s", id)
+	} else if !svc.running {
+		return fmt.Errorf("Container %s is not running", id)
+	}
+	svc.running = false
+	svc.emitEvent(event)
+	return nil
+}
+
+// InjectLog simulates a line of output written by a container
+func (fake *Fake) InjectLog(id string, msg string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return fmt.Errorf("Unknown container %s", id)
+	}
+	svc.logs = append(svc.logs, msg)
+	for _, sub := range svc.tails {
+		select {
+		case sub.msgs <- msg:
+		case <-sub.ctx.Done():
+		}
+	}
+	return nil
+}
+
+// InjectStats sets the resource consumption reported for a container
+// The new figures are emitted to all profilers immediately and then on every period
+func (fake *Fake) InjectStats(id string, stats Stats) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return fmt.Errorf("Unknown container %s", id)
+	}
+	svc.stats = stats
+	for _, sub := range svc.profiles {
+		select {
+		case sub.stts <- stats:
+		case <-sub.ctx.Done():
+		}
+	}
+	return nil
+}
+
+// InjectExecResult sets the exit code of commands subsequently executed in a container
+func (fake *Fake) InjectExecResult(id string, exitCode int) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return fmt.Errorf("Unknown container %s", id)
+	}
+	svc.exitCode = exitCode
+	return nil
+}
+
+// LookupService returns the ID of the most recently started container for a service
+func (fake *Fake) LookupService(svcName string) (string, bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var latestID string
+	var latestSeq uint64
+	for id, svc := range fake.services {
+		if svc.name == svcName && svc.seq > latestSeq {
+			latestID = id
+			latestSeq = svc.seq
+		}
+	}
+	return latestID, latestSeq > 0
+}
+
+// IsRunning reports whether a container exists and is currently running
+func (fake *Fake) IsRunning(id string) bool {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	return ok && svc.running
+}
+
+// IsMonitored reports whether anyone is subscribed to a container's events
+func (fake *Fake) IsMonitored(id string) bool {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	return ok && len(svc.monitors) > 0
+}
+
+func (fake *Fake) StartService(ctx context.Context, svcConfig *service.Configuration, deployment Deployment, events chan<- service.BuildEvent) (string, error) {
+	image, err := fake.BuildService(ctx, svcConfig, events)
+	if err != nil {
+		return "", err
+	}
+	return fake.RunService(ctx, svcConfig, deployment, image)
+}
+
+func (fake *Fake) BuildService(ctx context.Context, svcConfig *service.Configuration, events chan<- service.BuildEvent) (string, error) {
+	defer close(events)
+
+	fake.mutex.Lock()
+	buildLog := fake.buildLogs[svcConfig.Name]
+	buildErr := fake.buildErrors[svcConfig.Name]
+	fake.mutex.Unlock()
+
+	// Injected lines are parsed like Docker's build output
+	var parser buildParser
+	for _, line := range buildLog {
+		for _, event := range parser.parse(line) {
+			events <- event
+		}
+	}
+	if buildErr != nil {
+		if failedStep, ok := buildErr.(*BuildError); ok {
+			events <- failedStep.Event()
+		}
+		return "", errors.Wrap(buildErr, "Failed to build service container")
+	}
+
+	// Prebuilt images are "pulled" by name, and inline archives are checked like
+	// they are by Docker, but nothing is ever downloaded
+	switch kind, location := svcConfig.SourceType(); kind {
+	case service.SourceImage:
+		return location, nil
+	case service.SourceArchive:
+		if _, err := fetchSourceArchive(ctx, svcConfig); err != nil {
+			return "", errors.Wrap(err, "Failed to retrieve source archive")
+		}
+	}
+
+	// Like Docker images, fake images are tagged by the inputs to their build
+	inputs := fmt.Sprint(svcConfig.BaseImage, svcConfig.Source, svcConfig.SourceRef, svcConfig.SourceChecksum,
+		svcConfig.SourceArchive, svcConfig.BW2Entity, svcConfig.Build, svcConfig.Dockerfile, svcConfig.IncludedFiles,
+		svcConfig.IncludedDirectories)
+	hash := sha256.Sum256([]byte(inputs))
+	image := fmt.Sprintf("fake_%s:%x", svcConfig.Name, hash[:6])
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, ok := fake.images[image]; ok && svcConfig.CachePolicy == service.CacheReuse {
+		events <- buildOutput("Reusing cached image %s", image)
+		return image, nil
+	}
+	// Git sources "resolve" to a commit derived from their location and ref
+	var commit string
+	if kind, _ := svcConfig.SourceType(); kind == service.SourceGit {
+		location, ref := svcConfig.SplitSource()
+		commit = fmt.Sprintf("%x", sha1.Sum([]byte(location+"#"+ref)))
+	}
+	fake.images[image] = &fakeImage{service: svcConfig.Name, sourceCommit: commit, created: time.Now()}
+	return image, nil
+}
+
+func (fake *Fake) RunService(ctx context.Context, svcConfig *service.Configuration, deployment Deployment, image string) (string, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, volume := range svcConfig.Volumes {
+		if _, ok := fake.volumes[volume]; !ok {
+			fake.volumes[volume] = time.Now()
+		}
+	}
+	manifest := newManifest(svcConfig, deployment)
+	if built, ok := fake.images[image]; ok {
+		manifest.SourceCommit = built.sourceCommit
+	}
+	fake.nextID++
+	id := fmt.Sprintf("fake-%d", fake.nextID)
+	fake.services[id] = &fakeService{
+		seq:      fake.nextID,
+		name:     svcConfig.Name,
+		manifest: manifest,
+		image:    image,
+		running:  true,
+	}
+	return id, nil
+}
+
+func (fake *Fake) RestartService(ctx context.Context, id string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return fmt.Errorf("Could not restart container: no such container %s", id)
+	}
+	// Like Docker, restarting a running container kills it first
+	if svc.running {
+		svc.emitEvent(Die)
+	}
+	svc.running = true
+	return nil
+}
+
+func (fake *Fake) StopService(ctx context.Context, id string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return fmt.Errorf("Could not stop container: no such container %s", id)
+	}
+	if svc.running {
+		svc.running = false
+		svc.emitEvent(Die)
+	}
+	return nil
+}
+
+func (fake *Fake) RemoveService(ctx context.Context, id string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, ok := fake.services[id]; !ok {
+		return fmt.Errorf("Could not remove container: no such container %s", id)
+	}
+	delete(fake.services, id)
+	return nil
+}
+
+func (fake *Fake) ListServices(ctx context.Context) ([]string, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	IDs := make([]string, 0, len(fake.services))
+	for id, svc := range fake.services {
+		if svc.running {
+			IDs = append(IDs, id)
+		}
+	}
+	return IDs, nil
+}
+
+func (fake *Fake) TailService(ctx context.Context, id string, log bool) (<-chan string, <-chan error) {
+	msgChan := make(chan string, 20)
+	errChan := make(chan error, 1)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		close(msgChan)
+		errChan <- fmt.Errorf("Failed to attach to container: no such container %s", id)
+		return msgChan, errChan
+	}
+
+	sub := &fakeSubscriber{ctx: ctx, msgs: msgChan}
+	if log {
+		// Replay history in the background so that a long history can't block the caller
+		history := make([]string, len(svc.logs))
+		copy(history, svc.logs)
+		replay := make(chan string, 20)
+		sub.msgs = replay
+		go func() {
+			defer close(msgChan)
+			for _, msg := range history {
+				select {
+				case msgChan <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+			for msg := range replay {
+				select {
+				case msgChan <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		svc.tails = append(svc.tails, sub)
+		go fake.unsubscribeWhenDone(ctx, id, sub, func() { close(replay) })
+		return msgChan, errChan
+	}
+
+	svc.tails = append(svc.tails, sub)
+	go fake.unsubscribeWhenDone(ctx, id, sub, func() { close(msgChan) })
+	return msgChan, errChan
+}
+
+func (fake *Fake) MonitorService(ctx context.Context, id string) (<-chan Event, <-chan error) {
+	evChan := make(chan Event, 20)
+	errChan := make(chan error, 1)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		close(evChan)
+		errChan <- fmt.Errorf("Failed to initialize event monitor for container %s", id)
+		return evChan, errChan
+	}
+
+	sub := &fakeSubscriber{ctx: ctx, evs: evChan}
+	svc.monitors = append(svc.monitors, sub)
+	go fake.unsubscribeWhenDone(ctx, id, sub, func() { close(evChan) })
+	return evChan, errChan
+}
+
+func (fake *Fake) DiscoverServices(ctx context.Context) ([]ContainerInfo, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	infos := make([]ContainerInfo, 0, len(fake.services))
+	for id, svc := range fake.services {
+		infos = append(infos, ContainerInfo{ID: id, Running: svc.running, Manifest: svc.copyManifest()})
+	}
+	return infos, nil
+}
+
+func (fake *Fake) ListArtifacts(ctx context.Context) ([]Artifact, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	inUse := make(map[string]struct{})
+	for _, svc := range fake.services {
+		inUse[ArtifactImage+":"+svc.image] = struct{}{}
+		for _, volume := range svc.manifest.Config.Volumes {
+			inUse[ArtifactVolume+":"+volume] = struct{}{}
+		}
+	}
+
+	artifacts := make([]Artifact, 0, len(fake.images)+len(fake.volumes))
+	for tag, image := range fake.images {
+		_, used := inUse[ArtifactImage+":"+tag]
+		artifacts = append(artifacts, Artifact{
+			Kind:    ArtifactImage,
+			Name:    tag,
+			Service: image.service,
+			Created: image.created,
+			InUse:   used,
+		})
+	}
+	for name, created := range fake.volumes {
+		_, used := inUse[ArtifactVolume+":"+name]
+		artifacts = append(artifacts, Artifact{Kind: ArtifactVolume, Name: name, Created: created, InUse: used})
+	}
+	return artifacts, nil
+}
+
+func (fake *Fake) RemoveArtifact(ctx context.Context, artifact Artifact) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	switch artifact.Kind {
+	case ArtifactImage:
+		if _, ok := fake.images[artifact.Name]; !ok {
+			return fmt.Errorf("Could not remove image: no such image %s", artifact.Name)
+		}
+		delete(fake.images, artifact.Name)
+	case ArtifactVolume:
+		if _, ok := fake.volumes[artifact.Name]; !ok {
+			return fmt.Errorf("Could not remove volume: no such volume %s", artifact.Name)
+		}
+		delete(fake.volumes, artifact.Name)
+	default:
+		return fmt.Errorf("Unknown artifact kind: %s", artifact.Kind)
+	}
+	return nil
+}
+
+func (fake *Fake) InspectService(ctx context.Context, id string) (*Manifest, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return nil, fmt.Errorf("Could not inspect container: no such container %s", id)
+	}
+	return svc.copyManifest(), nil
+}
+
+func (fake *Fake) ProfileService(ctx context.Context, id string, period time.Duration) (<-chan Stats, <-chan error) {
+	statChan := make(chan Stats, 10)
+	errChan := make(chan error, 1)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		close(statChan)
+		errChan <- fmt.Errorf("Failed to initialize container stat collection: no such container %s", id)
+		return statChan, errChan
+	}
+
+	sub := &fakeSubscriber{ctx: ctx, stts: statChan}
+	svc.profiles = append(svc.profiles, sub)
+	// Emit current stats once per period, mirroring the Docker stats stream
+	// The channel is closed from here, once the context is canceled, so that no tick
+	// can be sent after it is closed
+	go func() {
+		tick := time.NewTicker(period)
+		defer tick.Stop()
+		defer fake.unsubscribeWhenDone(ctx, id, sub, func() { close(statChan) })
+		for {
+			select {
+			case <-tick.C:
+				fake.mutex.Lock()
+				svc, ok := fake.services[id]
+				if ok {
+					select {
+					case statChan <- svc.stats:
+					default:
+					}
+				}
+				fake.mutex.Unlock()
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return statChan, errChan
+}
+
+func (fake *Fake) ExecService(ctx context.Context, id string, cmd []string) (int, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	svc, ok := fake.services[id]
+	if !ok {
+		return -1, fmt.Errorf("Failed to create exec instance: no such container %s", id)
+	} else if !svc.running {
+		return -1, fmt.Errorf("Failed to create exec instance: container %s is not running", id)
+	}
+	return svc.exitCode, nil
+}
+
+// unsubscribeWhenDone detaches a subscriber once its context is canceled
+// Channels are closed while holding the lock so no injection can race with the close
+func (fake *Fake) unsubscribeWhenDone(ctx context.Context, id string, sub *fakeSubscriber, closeFunc func()) {
+	<-ctx.Done()
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if svc, ok := fake.services[id]; ok {
+		svc.tails = removeSubscriber(svc.tails, sub)
+		svc.monitors = removeSubscriber(svc.monitors, sub)
+		svc.profiles = removeSubscriber(svc.profiles, sub)
+	}
+	closeFunc()
+}
+
+func (svc *fakeService) emitEvent(event Event) {
+	for _, sub := range svc.monitors {
+		select {
+		case sub.evs <- event:
+		case <-sub.ctx.Done():
+		}
+	}
+}
+
+func removeSubscriber(subs []*fakeSubscriber, target *fakeSubscriber) []*fakeSubscriber {
+	for i, sub := range subs {
+		if sub == target {
+			return append(subs[:i], subs[i+1:]...)
+		}
+	}
+	return subs
+}
+
+func (svc *fakeService) copyManifest() *Manifest {
+	manifest := *svc.manifest
+	manifest.Config = svc.manifest.Config.DeepCopy()
+	return &manifest
+}
@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+)
+
+func startFakeService(t *testing.T, fake *Fake, name string) string {
+	log := make(chan service.BuildEvent, 20)
+	id, err := fake.StartService(context.Background(), &service.Configuration{Name: name}, Deployment{}, log)
+	if err != nil {
+		t.Fatalf("Failed to start fake service: %s", err)
+	}
+	return id
+}
+
+// Scripted build output is parsed into events, and injected build failures are reported
+func TestFakeBuild(t *testing.T) {
+	fake := NewFake("testing")
+	fake.InjectBuildLog("demosvc", "Step 1/2 : FROM alpine", " ---> Using cache", " ---> 3b1e0b6c2f5a",
+		"Step 2/2 : RUN make", "make: *** No targets specified and no makefile found.  Stop.")
+	fake.InjectBuildFailure("demosvc", &BuildError{Step: 2, Steps: 2, ExitCode: 2, Message: "RUN make failed"})
+
+	log := make(chan service.BuildEvent, 20)
+	_, err := fake.StartService(context.Background(), &service.Configuration{Name: "demosvc"}, Deployment{}, log)
+	if _, ok := errors.Cause(err).(*BuildError); !ok {
+		t.Fatalf("Expected injected build failure, got %v", err)
+	}
+	var kinds []string
+	for event := range log {
+		kinds = append(kinds, event.Kind)
+		if event.Kind == service.BuildOutput && event.Step != 2 {
+			t.Fatalf("Build output attributed to step %d", event.Step)
+		}
+	}
+	expected := []string{service.BuildStep, service.BuildCached, service.BuildStep, service.BuildOutput, service.BuildError}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("Expected build events %v, got %v", expected, kinds)
+	}
+
+	fake.InjectBuildFailure("demosvc", nil)
+	id := startFakeService(t, fake, "demosvc")
+	if found, ok := fake.LookupService("demosvc"); !ok || found != id {
+		t.Fatalf("Lookup returned %s, expected %s", found, id)
+	}
+}
+
+// Injected and implied die events reach monitors
+func TestFakeEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := NewFake("testing")
+	id := startFakeService(t, fake, "demosvc")
+	events, _ := fake.MonitorService(ctx, id)
+
+	if err := fake.InjectDie(id); err != nil {
+		t.Fatalf("Failed to inject die event: %s", err)
+	}
+	if ev := <-events; ev != Die {
+		t.Fatalf("Expected die event, got %v", ev)
+	}
+	if fake.IsRunning(id) {
+		t.Fatal("Service still running after die event")
+	}
+
+	// Restarting a dead container should not produce another die event
+	if err := fake.RestartService(ctx, id); err != nil {
+		t.Fatalf("Failed to restart service: %s", err)
+	}
+	if err := fake.StopService(ctx, id); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+	if ev := <-events; ev != Die {
+		t.Fatalf("Expected die event, got %v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("Unexpected event %v", ev)
+	default:
+	}
+
+	if err := fake.RemoveService(ctx, id); err != nil {
+		t.Fatalf("Failed to remove service: %s", err)
+	}
+	running, _ := fake.ListServices(ctx)
+	if len(running) != 0 {
+		t.Fatalf("Expected no running services, found %v", running)
+	}
+}
+
+// Logs and stats are replayed and streamed
+func TestFakeTailProfile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fake := NewFake("testing")
+	id := startFakeService(t, fake, "demosvc")
+	fake.InjectLog(id, "first")
+
+	logs, _ := fake.TailService(ctx, id, true)
+	stats, _ := fake.ProfileService(ctx, id, time.Hour)
+	fake.InjectLog(id, "second")
+	fake.InjectStats(id, Stats{Memory: 12, CPUShares: 34})
+
+	if msg := <-logs; msg != "first" {
+		t.Fatalf("Expected replayed log, got %s", msg)
+	}
+	if msg := <-logs; msg != "second" {
+		t.Fatalf("Expected streamed log, got %s", msg)
+	}
+	if st := <-stats; st.Memory != 12 || st.CPUShares != 34 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+
+	cancel()
+	for range logs {
+	}
+	for range stats {
+	}
+}
+
+// Canceling profiling while stats are being emitted closes the channel cleanly
+func TestFakeProfileCancel(t *testing.T) {
+	fake := NewFake("testing")
+	id := startFakeService(t, fake, "demosvc")
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		stats, _ := fake.ProfileService(ctx, id, time.Microsecond)
+		<-stats
+		cancel()
+		for range stats {
+		}
+	}
+}
+
+// Unchanged builds reuse their image if allowed, and images report whether they are in use
+func TestFakeImageCache(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake("testing")
+	build := func(config *service.Configuration) (string, []service.BuildEvent) {
+		log := make(chan service.BuildEvent, 20)
+		image, err := fake.BuildService(ctx, config, log)
+		if err != nil {
+			t.Fatalf("Failed to build fake service: %s", err)
+		}
+		var events []service.BuildEvent
+		for event := range log {
+			events = append(events, event)
+		}
+		return image, events
+	}
+
+	config := &service.Configuration{Name: "demosvc", Build: []string{"make"}, CachePolicy: service.CacheReuse}
+	first, _ := build(config)
+	if second, lines := build(config); second != first || len(lines) != 1 {
+		t.Fatalf("Expected cached image %s to be reused, built %s", first, second)
+	}
+	if _, err := fake.RunService(ctx, config, Deployment{}, first); err != nil {
+		t.Fatalf("Failed to run fake service: %s", err)
+	}
+
+	config.Build = []string{"make all"}
+	if changed, _ := build(config); changed == first {
+		t.Fatal("Expected a changed build to produce a new image")
+	}
+	artifacts, _ := fake.ListArtifacts(ctx)
+	if len(artifacts) != 2 {
+		t.Fatalf("Expected 2 images, found %v", artifacts)
+	}
+	for _, artifact := range artifacts {
+		if artifact.InUse != (artifact.Name == first) {
+			t.Fatalf("Image %s has the wrong usage", artifact.Name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var commitPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// resolveGitRef finds the commit that a ref of a remote repository currently
+// points to. Refs are resolved in the same order as git itself, i.e. tags take
+// precedence over branches. An empty ref is the repository's default branch.
+func resolveGitRef(ctx context.Context, url string, ref string) (string, error) {
+	if commitPattern.MatchString(ref) {
+		return ref, nil
+	}
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	output, err := exec.CommandContext(ctx, "git", "ls-remote", "--", url).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to list refs of %s", url)
+	}
+	commit, ok := findGitRef(output, ref)
+	if !ok {
+		return "", fmt.Errorf("Repository %s has no ref %s", url, ref)
+	}
+	return commit, nil
+}
+
+// findGitRef looks up a ref in the output of `git ls-remote`
+// Annotated tags are peeled to the commit they point to
+func findGitRef(lsRemote []byte, ref string) (string, bool) {
+	refs := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(lsRemote))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	candidates := []string{ref, "refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref}
+	for _, candidate := range candidates {
+		if commit, ok := refs[candidate+"^{}"]; ok {
+			return commit, true
+		} else if commit, ok := refs[candidate]; ok {
+			return commit, true
+		}
+	}
+	return "", false
+}
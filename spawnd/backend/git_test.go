@@ -0,0 +1,28 @@
+package backend
+
+import "testing"
+
+const testLsRemote = `1111111111111111111111111111111111111111	HEAD
+1111111111111111111111111111111111111111	refs/heads/master
+2222222222222222222222222222222222222222	refs/heads/v1.2.0
+3333333333333333333333333333333333333333	refs/tags/v1.2.0
+4444444444444444444444444444444444444444	refs/tags/v1.2.0^{}
+5555555555555555555555555555555555555555	refs/tags/v1.1.0
+`
+
+func TestFindGitRef(t *testing.T) {
+	for ref, expected := range map[string]string{
+		"HEAD":              "1111111111111111111111111111111111111111",
+		"master":            "1111111111111111111111111111111111111111",
+		"refs/heads/v1.2.0": "2222222222222222222222222222222222222222",
+		"v1.2.0":            "4444444444444444444444444444444444444444",
+		"v1.1.0":            "5555555555555555555555555555555555555555",
+	} {
+		if commit, ok := findGitRef([]byte(testLsRemote), ref); !ok || commit != expected {
+			t.Errorf("Expected %s to resolve to %s, found %s", ref, expected, commit)
+		}
+	}
+	if _, ok := findGitRef([]byte(testLsRemote), "v2.0.0"); ok {
+		t.Error("Expected unknown ref not to resolve")
+	}
+}
@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Labels attached to every service container, so that a container records
+// which daemon created it and what it is running even if the daemon loses track
+const (
+	labelAlias      = "io.spawnpoint.alias"
+	labelService    = "io.spawnpoint.service"
+	labelPath       = "io.spawnpoint.path"
+	labelConfig     = "io.spawnpoint.config"
+	labelConfigHash = "io.spawnpoint.configHash"
+	labelDeployedAt = "io.spawnpoint.deployedAt"
+	labelDeployedBy = "io.spawnpoint.deployedBy"
+	labelCPUShares  = "io.spawnpoint.cpuShares"
+	labelMemory     = "io.spawnpoint.memory"
+	// Set on the image, because the commit is resolved as part of the build
+	labelSourceCommit = "io.spawnpoint.sourceCommit"
+)
+
+// Deployment records who deployed a service, where, and when
+type Deployment struct {
+	Path string
+	Time time.Time
+	// VK of the deploying entity, empty if the transport doesn't identify senders
+	DeployedBy string
+}
+
+// Manifest is what a container records about the service it runs
+// Its configuration has no secrets, entity, or inline source archive
+type Manifest struct {
+	Deployment
+	Config     *service.Configuration
+	ConfigHash string
+	// Commit a git source was resolved to, empty for other sources
+	SourceCommit string
+}
+
+// ConfigHash identifies the contents of a service configuration, ignoring secret values
+func ConfigHash(config *service.Configuration) string {
+	// Marshalling a configuration can't fail, maps are written in sorted order
+	encoded, _ := yaml.Marshal(config.Redacted())
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:])
+}
+
+// newManifest records a configuration as it is run by a container
+func newManifest(config *service.Configuration, deployment Deployment) *Manifest {
+	recorded := config.Redacted()
+	recorded.BW2Entity = ""
+	// An inline archive is too large for a label, so it is identified by its checksum instead
+	if len(recorded.SourceArchive) > 0 {
+		if len(recorded.SourceChecksum) == 0 {
+			archive, _ := base64.StdEncoding.DecodeString(recorded.SourceArchive)
+			recorded.SourceChecksum = fmt.Sprintf("sha256:%x", sha256.Sum256(archive))
+		}
+		recorded.SourceArchive = ""
+	}
+	return &Manifest{
+		Deployment: deployment,
+		Config:     recorded,
+		ConfigHash: ConfigHash(config),
+	}
+}
+
+func manifestLabels(alias string, manifest *Manifest) map[string]string {
+	encoded, _ := yaml.Marshal(manifest.Config)
+	return map[string]string{
+		labelAlias:      alias,
+		labelService:    manifest.Config.Name,
+		labelPath:       manifest.Path,
+		labelConfig:     string(encoded),
+		labelConfigHash: manifest.ConfigHash,
+		labelDeployedAt: manifest.Time.UTC().Format(time.RFC3339),
+		labelDeployedBy: manifest.DeployedBy,
+		labelCPUShares:  strconv.FormatUint(manifest.Config.CPUShares, 10),
+		labelMemory:     strconv.FormatUint(manifest.Config.Memory, 10),
+	}
+}
+
+// parseManifestLabels reads a manifest back from container labels
+// The individual labels take precedence over the recorded configuration, as they are what
+// tools like `docker ps` filter on
+func parseManifestLabels(labels map[string]string) (*Manifest, error) {
+	var config service.Configuration
+	if err := yaml.Unmarshal([]byte(labels[labelConfig]), &config); err != nil {
+		return nil, errors.Wrap(err, "Malformed configuration label")
+	}
+	config.Name = labels[labelService]
+
+	var err error
+	if config.CPUShares, err = strconv.ParseUint(labels[labelCPUShares], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "Malformed CPU shares label")
+	}
+	if config.Memory, err = strconv.ParseUint(labels[labelMemory], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "Malformed memory label")
+	}
+	deployedAt, err := time.Parse(time.RFC3339, labels[labelDeployedAt])
+	if err != nil {
+		return nil, errors.Wrap(err, "Malformed deployment time label")
+	}
+
+	return &Manifest{
+		Deployment: Deployment{
+			Path:       labels[labelPath],
+			Time:       deployedAt,
+			DeployedBy: labels[labelDeployedBy],
+		},
+		Config:       &config,
+		ConfigHash:   labels[labelConfigHash],
+		SourceCommit: labels[labelSourceCommit],
+	}, nil
+}
@@ -0,0 +1,41 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+)
+
+// Manifests survive a round trip through container labels, without secrets or the entity
+func TestManifestLabels(t *testing.T) {
+	config := &service.Configuration{
+		Name:        "demosvc",
+		BW2Entity:   "c2VjcmV0",
+		CPUShares:   512,
+		Memory:      256,
+		Run:         []string{"./demosvc"},
+		Environment: map[string]string{"MODE": "test"},
+		Secrets:     []service.Secret{{Name: "TOKEN", Value: "hunter2"}},
+	}
+	deployment := Deployment{
+		Path:       "scratch.ns/spawnpoint/testing",
+		Time:       time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		DeployedBy: "vk",
+	}
+
+	labels := manifestLabels("testing", newManifest(config, deployment))
+	manifest, err := parseManifestLabels(labels)
+	if err != nil {
+		t.Fatalf("Failed to parse manifest labels: %s", err)
+	}
+	if manifest.Deployment != deployment {
+		t.Fatalf("Expected deployment %v, found %v", deployment, manifest.Deployment)
+	} else if manifest.ConfigHash != ConfigHash(config) {
+		t.Fatal("Configuration hash does not match")
+	} else if manifest.Config.CPUShares != 512 || manifest.Config.Memory != 256 || manifest.Config.Environment["MODE"] != "test" {
+		t.Fatalf("Unexpected configuration: %v", manifest.Config)
+	} else if len(manifest.Config.BW2Entity) > 0 || manifest.Config.Secrets[0].Value != "" {
+		t.Fatal("Manifest labels leak the entity or a secret")
+	}
+}
@@ -0,0 +1,188 @@
+package backend
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+)
+
+// Tarballs larger than this are rejected rather than held in memory
+const maxSourceArchiveSize = 512 * 1024 * 1024
+
+// Directory of the build context that a source archive is unpacked into
+const sourceContextDir = "source"
+
+// fetchSourceArchive retrieves the archive of a tarball or inline source and
+// verifies it against the service's source checksum, if it has one
+func fetchSourceArchive(ctx context.Context, config *service.Configuration) ([]byte, error) {
+	var archive []byte
+	switch kind, location := config.SourceType(); kind {
+	case service.SourceHTTP, service.SourceHTTPS:
+		var err error
+		if archive, err = downloadArchive(ctx, kind+"://"+location); err != nil {
+			return nil, err
+		}
+	case service.SourceArchive:
+		var err error
+		if archive, err = base64.StdEncoding.DecodeString(config.SourceArchive); err != nil {
+			return nil, errors.Wrap(err, "Failed to decode source archive")
+		}
+	default:
+		return nil, nil
+	}
+
+	if len(config.SourceChecksum) > 0 {
+		if err := verifyChecksum(archive, config.SourceChecksum); err != nil {
+			return nil, err
+		}
+	}
+	return archive, nil
+}
+
+// verifyChecksum checks contents against a checksum of the form sha256:<hex digest>
+func verifyChecksum(contents []byte, checksum string) error {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return fmt.Errorf("Unsupported checksum %s", checksum)
+	}
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil || len(expected) != sha256.Size {
+		return fmt.Errorf("Malformed checksum %s", checksum)
+	}
+	if actual := sha256.Sum256(contents); !bytes.Equal(actual[:], expected) {
+		return fmt.Errorf("Source checksum mismatch, expected %s but found sha256:%x", checksum, actual)
+	}
+	return nil
+}
+
+func downloadArchive(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Malformed source URL")
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to download %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to download %s: %s", url, resp.Status)
+	}
+
+	archive, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceArchiveSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to download %s", url)
+	} else if len(archive) > maxSourceArchiveSize {
+		return nil, fmt.Errorf("Source archive %s is larger than %d bytes", url, maxSourceArchiveSize)
+	}
+	return archive, nil
+}
+
+// unpackSourceArchive copies the contents of a tar archive, optionally gzipped,
+// into the source directory of a build context. Like `tar --strip-components=1`,
+// a single directory that holds everything else is left out, as is common for
+// release tarballs.
+func unpackSourceArchive(tarWriter *tar.Writer, archive []byte) error {
+	prefix, err := commonArchivePrefix(archive)
+	if err != nil {
+		return err
+	}
+	if err = tarWriter.WriteHeader(&tar.Header{
+		Name:     sourceContextDir + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	}); err != nil {
+		return errors.Wrap(err, "Failed to write source directory tar header")
+	}
+
+	tarReader, err := newArchiveReader(archive)
+	if err != nil {
+		return err
+	}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "Failed to read source archive")
+		}
+		name := strings.TrimPrefix(cleanArchivePath(header.Name), prefix)
+		if len(name) == 0 {
+			continue
+		}
+		header.Name = sourceContextDir + "/" + name
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return errors.Wrap(err, "Failed to write source file tar header")
+		}
+		if _, err = io.Copy(tarWriter, tarReader); err != nil {
+			return errors.Wrap(err, "Failed to write source file to tar")
+		}
+	}
+}
+
+// commonArchivePrefix finds the single top-level directory of an archive, if
+// there is one, including its trailing slash
+func commonArchivePrefix(archive []byte) (string, error) {
+	tarReader, err := newArchiveReader(archive)
+	if err != nil {
+		return "", err
+	}
+	var prefix string
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return prefix, nil
+		} else if err != nil {
+			return "", errors.Wrap(err, "Failed to read source archive")
+		}
+		name := cleanArchivePath(header.Name)
+		if len(name) == 0 {
+			continue
+		}
+		topLevel := strings.SplitN(name, "/", 2)[0] + "/"
+		if header.Typeflag != tar.TypeDir && !strings.HasPrefix(name, topLevel) {
+			// A top-level file
+			return "", nil
+		} else if len(prefix) == 0 {
+			prefix = topLevel
+		} else if prefix != topLevel {
+			return "", nil
+		}
+	}
+}
+
+// cleanArchivePath makes an archive entry's path relative and free of ".." components
+func cleanArchivePath(name string) string {
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if strings.HasSuffix(name, "/") && len(cleaned) > 0 {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func newArchiveReader(archive []byte) (*tar.Reader, error) {
+	reader := bufio.NewReader(bytes.NewReader(archive))
+	// Gzip streams start with a fixed magic number
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to decompress source archive")
+		}
+		return tar.NewReader(gzipReader), nil
+	}
+	return tar.NewReader(reader), nil
+}
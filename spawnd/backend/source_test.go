@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func makeTestArchive(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(name))}
+		if name[len(name)-1] == '/' {
+			header.Typeflag = tar.TypeDir
+			header.Size = 0
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write test archive: %s", err)
+		}
+		if header.Size > 0 {
+			tarWriter.Write([]byte(name))
+		}
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return buf.Bytes()
+}
+
+func unpackedNames(t *testing.T, archive []byte) []string {
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	if err := unpackSourceArchive(tarWriter, archive); err != nil {
+		t.Fatalf("Failed to unpack archive: %s", err)
+	}
+	tarWriter.Close()
+
+	var names []string
+	tarReader := tar.NewReader(&buf)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Fatalf("Failed to read unpacked archive: %s", err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func TestUnpackSourceArchive(t *testing.T) {
+	for _, test := range []struct {
+		entries  []string
+		expected []string
+	}{
+		{
+			entries:  []string{"demosvc-1.0/", "demosvc-1.0/main.go", "demosvc-1.0/cmd/", "demosvc-1.0/cmd/run.sh"},
+			expected: []string{"source/", "source/main.go", "source/cmd/", "source/cmd/run.sh"},
+		},
+		{
+			entries:  []string{"./main.go", "./cmd/run.sh"},
+			expected: []string{"source/", "source/main.go", "source/cmd/run.sh"},
+		},
+		{
+			entries:  []string{"demosvc/main.go", "README"},
+			expected: []string{"source/", "source/demosvc/main.go", "source/README"},
+		},
+		{
+			entries:  []string{"../../etc/passwd", "main.go"},
+			expected: []string{"source/", "source/etc/passwd", "source/main.go"},
+		},
+	} {
+		if names := unpackedNames(t, makeTestArchive(t, test.entries...)); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Expected %v to unpack as %v, found %v", test.entries, test.expected, names)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	contents := []byte("demosvc")
+	checksum := fmt.Sprintf("sha256:%x", sha256.Sum256(contents))
+	if err := verifyChecksum(contents, checksum); err != nil {
+		t.Errorf("Expected checksum to match: %s", err)
+	}
+	if err := verifyChecksum([]byte("othersvc"), checksum); err == nil {
+		t.Error("Expected checksum of different contents not to match")
+	}
+	if err := verifyChecksum(contents, "md5:0123"); err == nil {
+		t.Error("Expected unsupported checksum to be rejected")
+	}
+}
@@ -8,7 +8,10 @@ import (
 )
 
 type ServiceBackend interface {
-	StartService(ctx context.Context, config *service.Configuration, log chan<- string) (string, error)
+	// StartService is equivalent to BuildService followed by RunService
+	StartService(ctx context.Context, config *service.Configuration, deployment Deployment, events chan<- service.BuildEvent) (string, error)
+	BuildService(ctx context.Context, config *service.Configuration, events chan<- service.BuildEvent) (string, error)
+	RunService(ctx context.Context, config *service.Configuration, deployment Deployment, image string) (string, error)
 	RestartService(ctx context.Context, id string) error
 	StopService(ctx context.Context, id string) error
 	RemoveService(ctx context.Context, id string) error
@@ -16,15 +19,47 @@ type ServiceBackend interface {
 	TailService(ctx context.Context, id string, log bool) (<-chan string, <-chan error)
 	MonitorService(ctx context.Context, id string) (<-chan Event, <-chan error)
 	ProfileService(ctx context.Context, id string, period time.Duration) (<-chan Stats, <-chan error)
+	ExecService(ctx context.Context, id string, cmd []string) (int, error)
+	DiscoverServices(ctx context.Context) ([]ContainerInfo, error)
+	InspectService(ctx context.Context, id string) (*Manifest, error)
+	ListArtifacts(ctx context.Context) ([]Artifact, error)
+	RemoveArtifact(ctx context.Context, artifact Artifact) error
 }
 
 type Event int
 
+// Die is a termination with a non-zero exit code, Exit is a clean termination
 const (
-	Die = iota
+	Die  = iota
+	Exit = iota
 )
 
 type Stats struct {
 	Memory    float64
 	CPUShares float64
 }
+
+// ContainerInfo describes a service container as recorded on the container itself
+// Manifest is nil if the container's labels could not be read
+type ContainerInfo struct {
+	ID       string
+	Running  bool
+	Manifest *Manifest
+}
+
+// Kinds of Artifact
+const (
+	ArtifactImage  = "image"
+	ArtifactVolume = "volume"
+)
+
+// Artifact is an image or volume that was created for a service and may outlive it
+// Service is only known for images, and Size is negative if it is unknown
+type Artifact struct {
+	Kind    string
+	Name    string
+	Service string
+	Created time.Time
+	Size    int64
+	InUse   bool
+}
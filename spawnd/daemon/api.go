@@ -0,0 +1,272 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const unixSocketPrefix = "unix:"
+
+type serviceSummary struct {
+	Name      string
+	ID        string
+	CPUShares uint64
+	Memory    uint64
+}
+
+// validateAPIAddress only admits unix sockets and loopback TCP addresses,
+// because the management API performs no authentication of its own
+func validateAPIAddress(address string) error {
+	if len(address) == 0 || strings.HasPrefix(address, unixSocketPrefix) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrap(err, "Malformed TCP address")
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", host)
+	}
+	return nil
+}
+
+func listenAPI(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, unixSocketPrefix) {
+		socketPath := strings.TrimPrefix(address, unixSocketPrefix)
+		// Remove any socket left behind by an unclean shutdown
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Failed to remove stale socket")
+		}
+		return net.Listen("unix", socketPath)
+	}
+	return net.Listen("tcp", address)
+}
+
+func (daemon *SpawnpointDaemon) serveAPI(ctx context.Context) {
+	listener, err := listenAPI(daemon.APIAddress)
+	if err != nil {
+		daemon.logger.Errorf("Failed to start management API listener: %s", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/heartbeat", daemon.handleAPIHeartbeat)
+	mux.HandleFunc("/services", daemon.handleAPIServices)
+	mux.HandleFunc("/services/", func(w http.ResponseWriter, r *http.Request) {
+		daemon.handleAPIService(ctx, w, r)
+	})
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			daemon.logger.Errorf("Failed to shut down management API: %s", err)
+		}
+	}()
+
+	daemon.logger.Debugf("Serving management API on %s", daemon.APIAddress)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		daemon.logger.Errorf("Management API server failed: %s", err)
+	}
+	daemon.logger.Debug("Terminating management API")
+}
+
+// GET /heartbeat
+func (daemon *SpawnpointDaemon) handleAPIHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, newOperationError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	writeAPIResult(w, http.StatusOK, daemon.currentHeartbeat())
+}
+
+// GET /services lists running services, POST /services deploys a new one
+func (daemon *SpawnpointDaemon) handleAPIServices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		daemon.registryLock.RLock()
+		summaries := make([]serviceSummary, 0, len(daemon.serviceRegistry))
+		for _, svc := range daemon.serviceRegistry {
+			summaries = append(summaries, serviceSummary{
+				Name:      svc.Name,
+				ID:        svc.ID,
+				CPUShares: svc.CPUShares,
+				Memory:    svc.Memory,
+			})
+		}
+		daemon.registryLock.RUnlock()
+		writeAPIResult(w, http.StatusOK, summaries)
+
+	case http.MethodPost:
+		svcConfig, err := readAPIConfig(r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		} else if len(svcConfig.Name) == 0 {
+			writeAPIError(w, newOperationError(http.StatusBadRequest, "Service configuration does not specify a name"))
+			return
+		}
+		daemon.logger.Debugf("(%s) Received new service configuration from management API", svcConfig.Name)
+
+		if err = daemon.deployService(svcConfig, ""); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResult(w, http.StatusAccepted, operationError{
+			Code:    http.StatusAccepted,
+			Message: "Service deployment initiated",
+		})
+
+	default:
+		writeAPIError(w, newOperationError(http.StatusMethodNotAllowed, "Method not allowed"))
+	}
+}
+
+// GET /services/<name>/heartbeat, GET /services/<name>/logs, POST /services/<name>/stop,
+// POST /services/<name>/restart, and POST /services/<name>/update
+func (daemon *SpawnpointDaemon) handleAPIService(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	tokens := strings.Split(strings.TrimPrefix(r.URL.Path, "/services/"), "/")
+	if len(tokens) != 2 {
+		writeAPIError(w, newOperationError(http.StatusNotFound, "Not found"))
+		return
+	}
+	svcName, operation := tokens[0], tokens[1]
+
+	switch {
+	case operation == "heartbeat" && r.Method == http.MethodGet:
+		daemon.registryLock.RLock()
+		svc, ok := daemon.serviceRegistry[svcName]
+		daemon.registryLock.RUnlock()
+		if !ok {
+			writeAPIError(w, newOperationError(http.StatusNotFound, "Service not found"))
+			return
+		}
+		hb := svc.lastHeartbeat()
+		if hb == nil {
+			writeAPIError(w, newOperationError(http.StatusNotFound, "No heartbeat has been produced for service"))
+			return
+		}
+		writeAPIResult(w, http.StatusOK, hb)
+
+	case operation == "logs" && r.Method == http.MethodGet:
+		daemon.streamAPILogs(ctx, w, r, svcName)
+
+	case operation == "stop" && r.Method == http.MethodPost:
+		daemon.logger.Debugf("(%s) Received stop command from management API", svcName)
+		if err := daemon.issueServiceEvent(svcName, service.Stop); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResult(w, http.StatusAccepted, operationError{
+			Code:    http.StatusAccepted,
+			Message: "Service stop initiated",
+		})
+
+	case operation == "restart" && r.Method == http.MethodPost:
+		daemon.logger.Debugf("(%s) Received restart command from management API", svcName)
+		if err := daemon.issueServiceEvent(svcName, service.Restart); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResult(w, http.StatusAccepted, operationError{
+			Code:    http.StatusAccepted,
+			Message: "Service restart initiated",
+		})
+
+	case operation == "update" && r.Method == http.MethodPost:
+		svcConfig, err := readAPIConfig(r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		// The path determines which service is updated
+		svcConfig.Name = svcName
+		daemon.logger.Debugf("(%s) Received service update from management API", svcName)
+
+		if err = daemon.updateService(svcConfig, ""); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResult(w, http.StatusAccepted, operationError{
+			Code:    http.StatusAccepted,
+			Message: "Service update initiated",
+		})
+
+	default:
+		writeAPIError(w, newOperationError(http.StatusNotFound, "Not found"))
+	}
+}
+
+// streamAPILogs writes one JSON-encoded log message per line until the client disconnects
+// Logs can be streamed before a service is deployed, so that no deployment output is missed
+func (daemon *SpawnpointDaemon) streamAPILogs(ctx context.Context, w http.ResponseWriter, r *http.Request, svcName string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, newOperationError(http.StatusInternalServerError, "Streaming not supported"))
+		return
+	}
+	logChan, unsubscribe := daemon.subscribeLogs(svcName)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case msg := <-logChan:
+			if err := encoder.Encode(msg); err != nil {
+				daemon.logger.Debugf("(%s) Management API log stream closed: %s", svcName, err)
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readAPIConfig parses a service configuration from a request body
+// YAML is a superset of JSON, so either is accepted
+func readAPIConfig(r *http.Request) (*service.Configuration, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, newOperationError(http.StatusBadRequest, "Failed to read request body")
+	}
+	var svcConfig service.Configuration
+	if err = yaml.Unmarshal(body, &svcConfig); err != nil {
+		return nil, newOperationError(http.StatusBadRequest, "Failed to parse service configuration")
+	}
+	return &svcConfig, nil
+}
+
+func writeAPIResult(w http.ResponseWriter, code int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	opErr, ok := err.(*operationError)
+	if !ok {
+		opErr = &operationError{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	writeAPIResult(w, opErr.Code, opErr)
+}
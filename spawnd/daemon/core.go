@@ -3,6 +3,7 @@ package daemon
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -10,7 +11,7 @@ import (
 	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/util"
-	bw2 "github.com/immesys/bw2bind"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/transport"
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
 )
@@ -18,22 +19,41 @@ import (
 const heartbeatInterval = 10 * time.Second
 const persistenceInterval = 30 * time.Second
 const monitorInterval = 30 * time.Second
+const defaultUpdateGracePeriod = 30 * time.Second
+
+// Checksums of tarball and archive sources
+var checksumPattern = regexp.MustCompile("^sha256:[0-9a-f]{64}$")
+
+// What to do with containers created by this daemon that its snapshot doesn't account for
+const (
+	OrphanAdopt  = "adopt"
+	OrphanRemove = "remove"
+)
 
 type Config struct {
-	BW2Entity            string `yaml:"bw2Entity"`
-	BW2Agent             string `yaml:"bw2Agent"`
-	Path                 string `yaml:"path"`
-	CPUShares            uint64 `yaml:"cpuShares"`
-	Memory               uint64 `yaml:"memory"`
-	Backend              string `yaml:"backend"`
-	EnableHostNetworking bool   `yaml:"enableHostNetworking"`
-	EnableDeviceMapping  bool   `yaml:"enableDeviceMapping"`
+	BW2Entity            string            `yaml:"bw2Entity"`
+	BW2Agent             string            `yaml:"bw2Agent"`
+	Path                 string            `yaml:"path"`
+	CPUShares            uint64            `yaml:"cpuShares"`
+	Memory               uint64            `yaml:"memory"`
+	Backend              string            `yaml:"backend"`
+	Transport            string            `yaml:"transport"`
+	EnableHostNetworking bool              `yaml:"enableHostNetworking"`
+	EnableDeviceMapping  bool              `yaml:"enableDeviceMapping"`
+	APIAddress           string            `yaml:"apiAddress"`
+	MetricsAddress       string            `yaml:"metricsAddress"`
+	AllowedPorts         string            `yaml:"allowedPorts"`
+	UpdateGracePeriod    time.Duration     `yaml:"updateGracePeriod"`
+	SnapshotRetention    int               `yaml:"snapshotRetention"`
+	OrphanPolicy         string            `yaml:"orphanPolicy"`
+	GCInterval           time.Duration     `yaml:"gcInterval"`
+	GCRetention          time.Duration     `yaml:"gcRetention"`
+	Labels               map[string]string `yaml:"labels"`
 }
 
 type SpawnpointDaemon struct {
 	Config
-	bw2Client          *bw2.BW2Client
-	bw2Service         *bw2.Service
+	transport          transport.Transport
 	backend            backend.ServiceBackend
 	logger             *logging.Logger
 	alias              string
@@ -42,12 +62,42 @@ type SpawnpointDaemon struct {
 	resourceLock       sync.RWMutex
 	serviceRegistry    map[string]*serviceManifest
 	registryLock       sync.RWMutex
+	logSubscribers     map[string][]chan service.LogMessage
+	logLock            sync.Mutex
+	metrics            *daemonMetrics
+	journal            *serviceJournal
+	allowedPorts       portRange
+	portReservations   map[string]string
+	portLock           sync.Mutex
+}
+
+// operationError is a failure reported back to whoever requested an operation
+// Its code follows HTTP status code conventions
+type operationError struct {
+	Code    int
+	Message string
 }
 
 type serviceManifest struct {
 	*service.Configuration
-	ID     string
-	Events chan service.Event
+	ID            string
+	Events        chan service.Event
+	deployment    backend.Deployment
+	updates       chan pendingUpdate
+	heartbeat     *ServiceHeartbeat
+	state         string
+	health        string
+	updating      bool
+	sourceCommit  string
+	heartbeatLock sync.RWMutex // Guards heartbeat, state, health, updating, and sourceCommit
+}
+
+func newOperationError(code int, msg string) error {
+	return &operationError{Code: code, Message: msg}
+}
+
+func (err *operationError) Error() string {
+	return fmt.Sprintf("[ERROR %d] %s", err.Code, err.Message)
 }
 
 func New(config *Config, logger *logging.Logger) (*SpawnpointDaemon, error) {
@@ -55,6 +105,11 @@ func New(config *Config, logger *logging.Logger) (*SpawnpointDaemon, error) {
 		return nil, errors.Wrap(err, "Invalid daemon configuration")
 	}
 
+	allowedPorts, err := parsePortRange(config.AllowedPorts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid allowedPorts")
+	}
+
 	pathElements := strings.Split(config.Path, "/")
 	daemon := SpawnpointDaemon{
 		Config:             *config,
@@ -63,10 +118,30 @@ func New(config *Config, logger *logging.Logger) (*SpawnpointDaemon, error) {
 		availableCPUShares: config.CPUShares,
 		availableMemory:    config.Memory,
 		serviceRegistry:    make(map[string]*serviceManifest),
+		logSubscribers:     make(map[string][]chan service.LogMessage),
+		allowedPorts:       allowedPorts,
+		portReservations:   make(map[string]string),
+		journal:            &serviceJournal{path: journalPath(snapshotPath())},
+	}
+	if daemon.UpdateGracePeriod == 0 {
+		daemon.UpdateGracePeriod = defaultUpdateGracePeriod
+	}
+	if daemon.SnapshotRetention == 0 {
+		daemon.SnapshotRetention = defaultSnapshotRetention
 	}
+	if len(daemon.OrphanPolicy) == 0 {
+		daemon.OrphanPolicy = OrphanAdopt
+	}
+	if daemon.GCInterval == 0 {
+		daemon.GCInterval = defaultGCInterval
+	}
+	if daemon.GCRetention == 0 {
+		daemon.GCRetention = defaultGCRetention
+	}
+	daemon.metrics = newDaemonMetrics(&daemon)
 
-	if err := daemon.initBosswave(config); err != nil {
-		return nil, errors.Wrap(err, "Could not initialize bosswave")
+	if err := daemon.initTransport(config); err != nil {
+		return nil, errors.Wrap(err, "Could not initialize transport")
 	}
 
 	switch strings.ToLower(config.Backend) {
@@ -76,6 +151,8 @@ func New(config *Config, logger *logging.Logger) (*SpawnpointDaemon, error) {
 			return nil, errors.Wrap(err, "Failed to instantiate Docker backend")
 		}
 		daemon.backend = dkr
+	case "fake":
+		daemon.backend = backend.NewFake(daemon.alias)
 	default:
 		return nil, fmt.Errorf("Unknown container backend: %s", config.Backend)
 	}
@@ -83,96 +160,293 @@ func New(config *Config, logger *logging.Logger) (*SpawnpointDaemon, error) {
 	return &daemon, nil
 }
 
+// Backend exposes the daemon's container backend, e.g. so tests can script a fake
+func (daemon *SpawnpointDaemon) Backend() backend.ServiceBackend {
+	return daemon.backend
+}
+
 func validateDaemonConfig(config *Config) error {
 	if len(config.Path) == 0 {
 		return errors.New("path is empty string")
-	} else if len(config.BW2Entity) == 0 {
+	} else if len(config.BW2Entity) == 0 && usesBosswave(config) {
 		return errors.New("bw2Entity is empty string")
 	} else if config.CPUShares == 0 {
 		return errors.New("Must allocate more than 0 CPU shares to spawnd")
 	} else if config.Memory == 0 {
 		return errors.New("Must allocate more than 0 MB memory to spawnd")
+	} else if err := validateAPIAddress(config.APIAddress); err != nil {
+		return errors.Wrap(err, "Invalid apiAddress")
+	} else if _, err := parsePortRange(config.AllowedPorts); err != nil {
+		return errors.Wrap(err, "Invalid allowedPorts")
+	} else if config.SnapshotRetention < 0 {
+		return errors.New("snapshotRetention cannot be negative")
+	} else if policy := config.OrphanPolicy; len(policy) > 0 && policy != OrphanAdopt && policy != OrphanRemove {
+		return fmt.Errorf("Unknown orphanPolicy: %s", policy)
+	} else if config.GCRetention < 0 {
+		return errors.New("gcRetention cannot be negative")
 	}
 
 	return nil
 }
 
-func (daemon *SpawnpointDaemon) initBosswave(config *Config) error {
-	bw2.SilenceLog()
+func usesBosswave(config *Config) bool {
+	name := strings.ToLower(config.Transport)
+	return name == "bosswave" || name == ""
+}
 
-	client, err := bw2.Connect(config.BW2Agent)
-	if err != nil {
-		return errors.Wrap(err, "Failed to connect to Bosswave")
-	}
-	if _, err = client.SetEntityFile(config.BW2Entity); err != nil {
-		return errors.Wrap(err, "Failed to set Bosswave entity")
+func (daemon *SpawnpointDaemon) initTransport(config *Config) error {
+	switch strings.ToLower(config.Transport) {
+	case "bosswave", "":
+		bw, err := transport.NewBosswave(config.BW2Agent, config.BW2Entity)
+		if err != nil {
+			return err
+		}
+		daemon.transport = bw
+	case "loopback":
+		daemon.transport = transport.DefaultLoopback
+	default:
+		return fmt.Errorf("Unknown transport: %s", config.Transport)
 	}
 
-	service := client.RegisterServiceNoHb(config.Path, "s.spawnpoint")
-	service.SetErrorHandler(func(err error) {
-		daemon.logger.Errorf("Failed to register service metadata: %s", err)
-	})
-	bw2Iface := service.RegisterInterface("daemon", "i.spawnpoint")
-	if err := bw2Iface.SubscribeSlot("config", daemon.handleConfig); err != nil {
+	daemon.registerInterface(daemon.daemonInterface())
+	if _, err := daemon.transport.SubscribeSlot(daemon.daemonInterface(), "config", daemon.handleConfig); err != nil {
 		return errors.Wrap(err, "Failed to subscribe to config slot")
 	}
-	daemon.bw2Client = client
-	daemon.bw2Service = service
-
 	return nil
 }
 
-func (daemon *SpawnpointDaemon) handleConfig(msg *bw2.SimpleMessage) {
+// registerInterface registers one of the daemon's interfaces with transports that
+// keep metadata about them
+func (daemon *SpawnpointDaemon) registerInterface(iface transport.Interface) {
+	if registrar, ok := daemon.transport.(transport.Registrar); ok {
+		registrar.RegisterInterface(iface, func(err error) {
+			daemon.logger.Errorf("Failed to register service metadata: %s", err)
+		})
+	}
+}
+
+func (daemon *SpawnpointDaemon) daemonInterface() transport.Interface {
+	return transport.NewInterface(daemon.Path, "s.spawnpoint", "daemon", "i.spawnpoint")
+}
+
+func (daemon *SpawnpointDaemon) serviceInterface(svcName string) transport.Interface {
+	return transport.NewInterface(daemon.Path, "s.spawnpoint", svcName, "i.spawnable")
+}
+
+func (daemon *SpawnpointDaemon) handleConfig(msg *transport.Message) {
 	daemon.logger.Debug("Received new service configuration")
 
-	if len(msg.POs) == 0 {
+	if len(msg.Objects) == 0 {
 		daemon.logger.Debug("Received configuration has no payload objects, ignoring")
 		return
 	}
-	configPo, ok := msg.POs[0].(bw2.YAMLPayloadObject)
-	if !ok {
-		daemon.logger.Debug("Received service configuration does not have msgpack payload, ignoring")
+	configPo := msg.Objects[0]
+	if configPo.Type() != transport.ConfigPayload {
+		daemon.logger.Debug("Received service configuration does not have configuration payload, ignoring")
 		return
 	}
 	var svcConfig service.Configuration
-	if err := bw2.YAMLPayloadObject.ValueInto(configPo, &svcConfig); err != nil {
-		daemon.logger.Debugf("Failed to parse service configuration msgpack: %s", err)
+	if err := configPo.ValueInto(&svcConfig); err != nil {
+		daemon.logger.Debugf("Failed to parse service configuration: %s", err)
 		return
 	}
 
+	if err := daemon.deployService(&svcConfig, msg.From); err != nil {
+		daemon.publishStatus(svcConfig.Name, statusFromError(service.OperationDeploy, err))
+	}
+}
+
+// deployService applies the host's admission checks to a new service configuration
+// and, if it is accepted, hands the service off to its state machine
+// deployedBy is the VK of the deploying entity, if known
+func (daemon *SpawnpointDaemon) deployService(svcConfig *service.Configuration, deployedBy string) error {
 	daemon.registryLock.RLock()
-	_, ok = daemon.serviceRegistry[svcConfig.Name]
+	_, ok := daemon.serviceRegistry[svcConfig.Name]
 	daemon.registryLock.RUnlock()
 	if ok {
 		daemon.logger.Debugf("(%s) Service is already running, ignoring deploy command", svcConfig.Name)
-		if err := daemon.publishLogMessage(svcConfig.Name, "[ERROR 409] Service is already running on this host"); err != nil {
-			daemon.logger.Errorf("(%s) Failed to publish log message", svcConfig.Name)
-		}
-		return
+		return newOperationError(409, "Service is already running on this host")
+	}
+
+	if err := daemon.admitService(svcConfig); err != nil {
+		return err
+	}
+	if err := daemon.reservePorts(svcConfig.Name, svcConfig.Ports); err != nil {
+		daemon.logger.Debugf("(%s) Port conflict: %s", svcConfig.Name, err)
+		return newOperationError(409, err.Error())
 	}
 
+	svc := serviceManifest{Configuration: svcConfig, deployment: daemon.newDeployment(deployedBy)}
+	daemon.addService(&svc, true)
+	return nil
+}
+
+func (daemon *SpawnpointDaemon) newDeployment(deployedBy string) backend.Deployment {
+	return backend.Deployment{Path: daemon.Path, Time: time.Now(), DeployedBy: deployedBy}
+}
+
+// admitService applies the checks shared by new deployments and updates
+func (daemon *SpawnpointDaemon) admitService(svcConfig *service.Configuration) error {
 	if svcConfig.UseHostNet && !daemon.EnableHostNetworking {
 		daemon.logger.Debugf("(%s) Configuration requests use of host network, which is disabled", svcConfig.Name)
-		msg := "[ERROR 403] Use of host networking stack not allowed on this host"
-		if err := daemon.publishLogMessage(svcConfig.Name, msg); err != nil {
-			daemon.logger.Errorf("(%s) Failed to publish log message", svcConfig.Name)
-		}
-		return
+		return newOperationError(403, "Use of host networking stack not allowed on this host")
 	} else if len(svcConfig.Devices) > 0 && !daemon.EnableDeviceMapping {
 		daemon.logger.Debugf("(%s) Configuration requests device mapping(s), which are disabled", svcConfig.Name)
-		msg := "[ERROR 403] Mapping devices into container not allowed on this host"
-		if err := daemon.publishLogMessage(svcConfig.Name, msg); err != nil {
-			daemon.logger.Errorf("(%s) Failed to publish log message", svcConfig.Name)
+		return newOperationError(403, "Mapping devices into container not allowed on this host")
+	}
+
+	if err := validateRestartPolicy(svcConfig.RestartPolicy); err != nil {
+		daemon.logger.Debugf("(%s) Configuration has invalid restart policy: %s", svcConfig.Name, err)
+		return newOperationError(400, fmt.Sprintf("Invalid restart policy: %s", err))
+	} else if err := validateHealthCheck(svcConfig.HealthCheck); err != nil {
+		daemon.logger.Debugf("(%s) Configuration has invalid health check: %s", svcConfig.Name, err)
+		return newOperationError(400, fmt.Sprintf("Invalid health check: %s", err))
+	} else if err := validateEnvironment(svcConfig); err != nil {
+		daemon.logger.Debugf("(%s) Configuration has invalid environment: %s", svcConfig.Name, err)
+		return newOperationError(400, fmt.Sprintf("Invalid environment: %s", err))
+	} else if err := validatePorts(svcConfig); err != nil {
+		daemon.logger.Debugf("(%s) Configuration has invalid ports: %s", svcConfig.Name, err)
+		return newOperationError(400, fmt.Sprintf("Invalid ports: %s", err))
+	} else if err := validateSource(svcConfig); err != nil {
+		daemon.logger.Debugf("(%s) Configuration has invalid source: %s", svcConfig.Name, err)
+		return newOperationError(400, fmt.Sprintf("Invalid source: %s", err))
+	} else if err := validateDockerfile(svcConfig); err != nil {
+		daemon.logger.Debugf("(%s) Configuration has invalid dockerfile: %s", svcConfig.Name, err)
+		return newOperationError(400, fmt.Sprintf("Invalid dockerfile: %s", err))
+	} else if policy := svcConfig.CachePolicy; len(policy) > 0 && policy != service.CacheRebuild && policy != service.CacheReuse {
+		daemon.logger.Debugf("(%s) Configuration has unknown cache policy %s", svcConfig.Name, policy)
+		return newOperationError(400, fmt.Sprintf("Unknown cache policy: %s", policy))
+	} else if err := validateDependencies(svcConfig); err != nil {
+		daemon.logger.Debugf("(%s) Configuration has invalid dependencies: %s", svcConfig.Name, err)
+		return newOperationError(400, fmt.Sprintf("Invalid dependencies: %s", err))
+	} else if cycle := daemon.findDependencyCycle(svcConfig); cycle != nil {
+		daemon.logger.Debugf("(%s) Configuration has a dependency cycle", svcConfig.Name)
+		return newOperationError(400, fmt.Sprintf("Dependency cycle: %s", strings.Join(cycle, " -> ")))
+	}
+
+	for _, port := range svcConfig.Ports {
+		if !daemon.allowedPorts.contains(port.Host) {
+			daemon.logger.Debugf("(%s) Configuration requests port %d, which is not allowed", svcConfig.Name, port.Host)
+			return newOperationError(403, fmt.Sprintf("Host port %d is outside of allowed range (%s)", port.Host, daemon.allowedPorts))
 		}
-		return
 	}
+	if err := service.CheckConstraints(svcConfig.Constraints, daemon.Labels); err != nil {
+		daemon.logger.Debugf("(%s) Host does not satisfy service constraints: %s", svcConfig.Name, err)
+		return newOperationError(412, fmt.Sprintf("Service constraints not satisfied: %s", err))
+	}
+	return nil
+}
 
-	svc := serviceManifest{Configuration: &svcConfig}
-	daemon.addService(&svc, true)
+func validateSource(svcConfig *service.Configuration) error {
+	_, ref := svcConfig.SplitSource()
+	kind, location := svcConfig.SourceType()
+	if strings.Contains(svcConfig.Source, "#") && len(svcConfig.SourceRef) > 0 && ref != svcConfig.SourceRef {
+		return fmt.Errorf("Source is pinned to %s, but sourceRef is %s", ref, svcConfig.SourceRef)
+	} else if len(ref) > 0 && kind != service.SourceGit {
+		return errors.New("Only git sources can be pinned to a ref")
+	} else if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("Malformed ref: %s", ref)
+	}
+
+	switch kind {
+	case "", service.SourceGit:
+	case service.SourceHTTP, service.SourceHTTPS:
+		if strings.Contains(location, "://") {
+			return fmt.Errorf("Tarball source is written without a second scheme, e.g. %s+example.com/svc.tar.gz", kind)
+		} else if len(svcConfig.SourceChecksum) == 0 {
+			return errors.New("Tarball source requires a sourceChecksum")
+		}
+	case service.SourceArchive:
+		if len(svcConfig.SourceArchive) == 0 {
+			return errors.New("Archive source was not uploaded with the configuration")
+		}
+	case service.SourceImage:
+		if len(location) == 0 {
+			return errors.New("Image source does not name an image")
+		} else if len(svcConfig.BaseImage) > 0 || len(svcConfig.Build) > 0 ||
+			len(svcConfig.IncludedFiles) > 0 || len(svcConfig.IncludedDirectories) > 0 {
+			return errors.New("Image source is run without a build, so it can't have an image, build commands, or included files")
+		}
+	default:
+		return fmt.Errorf("Unknown source type %s", kind)
+	}
+
+	if len(svcConfig.SourceChecksum) > 0 {
+		if kind != service.SourceHTTP && kind != service.SourceHTTPS && kind != service.SourceArchive {
+			return errors.New("Only tarball and archive sources have a checksum")
+		} else if !checksumPattern.MatchString(svcConfig.SourceChecksum) {
+			return fmt.Errorf("Malformed checksum %s, expected sha256:<hex digest>", svcConfig.SourceChecksum)
+		}
+	}
+	if len(svcConfig.SourceArchive) > 0 && kind != service.SourceArchive {
+		return errors.New("Only archive sources can upload an archive")
+	}
+	return nil
+}
+
+// validateDockerfile checks a custom dockerfile, which takes the place of the base image
+// and build commands, and can't clone a git source or rebuild a prebuilt image
+func validateDockerfile(svcConfig *service.Configuration) error {
+	if len(svcConfig.Dockerfile) == 0 {
+		return nil
+	} else if len(svcConfig.BaseImage) > 0 || len(svcConfig.Build) > 0 {
+		return errors.New("Dockerfile replaces image and build commands")
+	} else if kind, _ := svcConfig.SourceType(); kind == service.SourceGit || kind == service.SourceImage {
+		return fmt.Errorf("Dockerfile can't be combined with a %s source", kind)
+	}
+	return backend.ValidateDockerfile(svcConfig)
+}
+
+func validateRestartPolicy(policy *service.RestartPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	switch policy.Condition {
+	case service.RestartNever, service.RestartOnFailure, service.RestartAlways:
+	default:
+		return fmt.Errorf("Unknown restart condition %s", policy.Condition)
+	}
+	if policy.InitialBackoff < 0 || policy.MaxBackoff < 0 || policy.ResetWindow < 0 {
+		return errors.New("initialBackoff, maxBackoff, and resetWindow may not be negative")
+	}
+	if policy.MaxBackoff > 0 && policy.MaxBackoff < policy.InitialBackoff {
+		return errors.New("maxBackoff is shorter than initialBackoff")
+	}
+	return nil
+}
+
+// validateEnvironment checks environment variable and secret names, which share a namespace
+// Secret values are deliberately left out of any error messages
+func validateEnvironment(svcConfig *service.Configuration) error {
+	names := make(map[string]struct{})
+	checkName := func(name string) error {
+		if len(name) == 0 || strings.ContainsAny(name, "= ") {
+			return fmt.Errorf("Invalid variable name \"%s\"", name)
+		} else if name == "BW2_DEFAULT_ENTITY" || name == "BW2_AGENT" {
+			return fmt.Errorf("Variable %s is reserved", name)
+		} else if _, ok := names[name]; ok {
+			return fmt.Errorf("Variable %s is defined more than once", name)
+		}
+		names[name] = struct{}{}
+		return nil
+	}
+
+	for name := range svcConfig.Environment {
+		if err := checkName(name); err != nil {
+			return err
+		}
+	}
+	for _, secret := range svcConfig.Secrets {
+		if err := checkName(secret.Name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (daemon *SpawnpointDaemon) addService(svc *serviceManifest, boot bool) {
 	svc.Events = make(chan service.Event, 1)
+	svc.updates = make(chan pendingUpdate, 1)
 	done := make(chan struct{})
 	go daemon.manageService(svc, done)
 	if boot {
@@ -181,34 +455,45 @@ func (daemon *SpawnpointDaemon) addService(svc *serviceManifest, boot bool) {
 		svc.Events <- service.Adopt
 	}
 
-	bw2Iface := daemon.bw2Service.RegisterInterface(svc.Name, "i.spawnable")
-	restartUnsubHandle, err := bw2Iface.SubscribeSlotH("restart", daemon.manipulateService(svc.Name, "restart", done))
+	iface := daemon.serviceInterface(svc.Name)
+	daemon.registerInterface(iface)
+	restartUnsubHandle, err := daemon.transport.SubscribeSlot(iface, "restart", daemon.manipulateService(svc.Name, "restart", done))
 	if err != nil {
 		daemon.logger.Errorf("(%s) Failed to subscribe to restart slot: %s", svc.Name, err)
 		return
 	}
-	stopUnsubHandle, err := bw2Iface.SubscribeSlotH("stop", daemon.manipulateService(svc.Name, "stop", done))
+	stopUnsubHandle, err := daemon.transport.SubscribeSlot(iface, "stop", daemon.manipulateService(svc.Name, "stop", done))
 	if err != nil {
 		daemon.logger.Errorf("(%s) Failed to subscribe to stop slot: %s", svc.Name, err)
 		return
 	}
+	updateUnsubHandle, err := daemon.transport.SubscribeSlot(iface, "update", daemon.handleUpdate(svc.Name, done))
+	if err != nil {
+		daemon.logger.Errorf("(%s) Failed to subscribe to update slot: %s", svc.Name, err)
+		return
+	}
 	go func() {
 		<-done
-		if err := daemon.bw2Client.Unsubscribe(restartUnsubHandle); err != nil {
+		if err := daemon.transport.Unsubscribe(restartUnsubHandle); err != nil {
 			daemon.logger.Errorf("(%s) Failed to unsubscribe from restart slot", svc.Name)
 		} else {
 			daemon.logger.Debugf("(%s) Unsubscribed from restart slot", svc.Name)
 		}
-		if err := daemon.bw2Client.Unsubscribe(stopUnsubHandle); err != nil {
+		if err := daemon.transport.Unsubscribe(stopUnsubHandle); err != nil {
 			daemon.logger.Errorf("(%s) Failed to unsubscribe from stop slot", svc.Name)
 		} else {
 			daemon.logger.Debugf("(%s) Unsubscribed from stop slot", svc.Name)
 		}
+		if err := daemon.transport.Unsubscribe(updateUnsubHandle); err != nil {
+			daemon.logger.Errorf("(%s) Failed to unsubscribe from update slot", svc.Name)
+		} else {
+			daemon.logger.Debugf("(%s) Unsubscribed from update slot", svc.Name)
+		}
 	}()
 }
 
-func (daemon *SpawnpointDaemon) manipulateService(name string, operation string, done <-chan struct{}) func(*bw2.SimpleMessage) {
-	return func(msg *bw2.SimpleMessage) {
+func (daemon *SpawnpointDaemon) manipulateService(name string, operation string, done <-chan struct{}) func(*transport.Message) {
+	return func(msg *transport.Message) {
 		daemon.logger.Debugf("(%s) Received service manipulation command", name)
 		// We want to ignore "messages" fired by an unsubscribe
 		select {
@@ -218,28 +503,36 @@ func (daemon *SpawnpointDaemon) manipulateService(name string, operation string,
 		default:
 		}
 
-		daemon.registryLock.RLock()
-		svc, ok := daemon.serviceRegistry[name]
-		daemon.registryLock.RUnlock()
-		if !ok {
-			daemon.logger.Debugf("(%s) Service not found, ignoring command", name)
-			daemon.publishLogMessage(name, "[ERROR 404] Service not found")
-			return
-		}
-
+		var event service.Event
 		switch operation {
-		case "restart":
-			daemon.logger.Debugf("%s) Issuing restart event", name)
-			svc.Events <- service.Restart
-		case "stop":
+		case service.OperationRestart:
+			daemon.logger.Debugf("(%s) Issuing restart event", name)
+			event = service.Restart
+		case service.OperationStop:
 			daemon.logger.Debugf("(%s) Issuing stop event", name)
-			svc.Events <- service.Stop
+			event = service.Stop
 		default:
 			daemon.logger.Warningf("(%s) Unknown operation type %s", name, operation)
+			return
+		}
+		if err := daemon.issueServiceEvent(name, event); err != nil {
+			daemon.publishStatus(name, statusFromError(operation, err))
 		}
 	}
 }
 
+func (daemon *SpawnpointDaemon) issueServiceEvent(name string, event service.Event) error {
+	daemon.registryLock.RLock()
+	svc, ok := daemon.serviceRegistry[name]
+	daemon.registryLock.RUnlock()
+	if !ok {
+		daemon.logger.Debugf("(%s) Service not found, ignoring command", name)
+		return newOperationError(404, "Service not found")
+	}
+	svc.Events <- event
+	return nil
+}
+
 func (daemon *SpawnpointDaemon) StartLoop(ctx context.Context) {
 	daemon.logger.Debugf("Spawnpoint Daemon Version %s -- starting main loop", util.VersionNum)
 	if err := daemon.recoverServices(ctx); err != nil {
@@ -247,6 +540,27 @@ func (daemon *SpawnpointDaemon) StartLoop(ctx context.Context) {
 	}
 
 	var wg sync.WaitGroup
+	if len(daemon.APIAddress) > 0 {
+		wg.Add(1)
+		go func() {
+			daemon.serveAPI(ctx)
+			wg.Done()
+		}()
+	}
+	if len(daemon.MetricsAddress) > 0 {
+		wg.Add(1)
+		go func() {
+			daemon.serveMetrics(ctx)
+			wg.Done()
+		}()
+	}
+	if daemon.GCInterval > 0 {
+		wg.Add(1)
+		go func() {
+			daemon.collectGarbagePeriodically(ctx, daemon.GCInterval)
+			wg.Done()
+		}()
+	}
 	wg.Add(3)
 	go func() {
 		daemon.publishHearbeats(ctx, heartbeatInterval)
@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
+	"github.com/pkg/errors"
+)
+
+// How often a waiting service checks whether its dependencies have started
+const dependencyCheckInterval = 1 * time.Second
+
+// validateDependencies checks the names of the services a service depends on
+func validateDependencies(svcConfig *service.Configuration) error {
+	seen := make(map[string]struct{})
+	for _, dep := range svcConfig.DependsOn {
+		if len(dep) == 0 {
+			return errors.New("Dependency has no name")
+		} else if dep == svcConfig.Name {
+			return errors.New("Service depends on itself")
+		} else if _, ok := seen[dep]; ok {
+			return fmt.Errorf("Dependency %s is listed more than once", dep)
+		}
+		seen[dep] = struct{}{}
+	}
+	return nil
+}
+
+// findDependencyCycle follows a configuration's dependencies through the services
+// on this host, returning the chain of names that leads back to the service, if any
+func (daemon *SpawnpointDaemon) findDependencyCycle(svcConfig *service.Configuration) []string {
+	daemon.registryLock.RLock()
+	defer daemon.registryLock.RUnlock()
+
+	visited := make(map[string]bool)
+	var visit func(name string, path []string) []string
+	visit = func(name string, path []string) []string {
+		if len(path) > 0 && name == svcConfig.Name {
+			return append(path, name)
+		} else if visited[name] {
+			return nil
+		}
+		visited[name] = true
+
+		deps := svcConfig.DependsOn
+		if name != svcConfig.Name {
+			svc, ok := daemon.serviceRegistry[name]
+			if !ok {
+				return nil
+			}
+			deps = svc.DependsOn
+		}
+		for _, dep := range deps {
+			if cycle := visit(dep, append(path, name)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return visit(svcConfig.Name, nil)
+}
+
+// unmetDependencies lists the dependencies of a service that are not running on this host
+func (daemon *SpawnpointDaemon) unmetDependencies(svc *serviceManifest) []string {
+	daemon.registryLock.RLock()
+	defer daemon.registryLock.RUnlock()
+	var unmet []string
+	for _, dep := range svc.DependsOn {
+		if depSvc, ok := daemon.serviceRegistry[dep]; !ok || depSvc.currentState() != ServiceRunning {
+			unmet = append(unmet, dep)
+		}
+	}
+	return unmet
+}
+
+// awaitDependencies holds back a service's boot until all of its dependencies are
+// running. In the meantime the service is registered as waiting, so that it shows up
+// in heartbeats and can be stopped. It has no container and reserves no CPU or memory,
+// but its host ports stay reserved. Once its dependencies are running, it stays
+// registered until its container has started or failed to start.
+// Returns false if the service was stopped before its dependencies started.
+func (daemon *SpawnpointDaemon) awaitDependencies(svc *serviceManifest) bool {
+	unmet := daemon.unmetDependencies(svc)
+	if len(unmet) == 0 {
+		return true
+	}
+
+	daemon.logger.Debugf("(%s) Waiting for dependencies to start: %s", svc.Name, strings.Join(unmet, ", "))
+	svc.setState(ServiceWaiting)
+	daemon.registryLock.Lock()
+	daemon.serviceRegistry[svc.Name] = svc
+	daemon.registryLock.Unlock()
+	daemon.publishServiceHeartbeat(svc, backend.Stats{})
+	msg := fmt.Sprintf("Waiting for dependencies to start: %s", strings.Join(unmet, ", "))
+	daemon.publishServiceStatus(svc, statusProgress(service.OperationDeploy, msg))
+
+	check := time.NewTicker(dependencyCheckInterval)
+	defer check.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-svc.Events:
+			switch event {
+			case service.Stop:
+				daemon.logger.Debugf("(%s) Service stopped while waiting for dependencies", svc.Name)
+				daemon.deregisterWaiting(svc)
+				daemon.publishServiceStatus(svc, statusSucceeded(service.OperationStop, "Stopped service before it started"))
+				return false
+			case service.Restart:
+				daemon.logger.Debugf("(%s) Service is waiting for dependencies, ignoring restart", svc.Name)
+				daemon.publishServiceStatus(svc, statusFailed(service.OperationRestart, 409,
+					"Service is waiting for its dependencies to start"))
+			}
+
+		case <-heartbeat.C:
+			daemon.publishServiceHeartbeat(svc, backend.Stats{})
+
+		case <-check.C:
+			if unmet = daemon.unmetDependencies(svc); len(unmet) == 0 {
+				daemon.logger.Debugf("(%s) All dependencies are running", svc.Name)
+				return true
+			}
+		}
+	}
+}
+
+// deregisterWaiting removes a service that is registered as waiting for its
+// dependencies, which it still is if its container then failed to start
+func (daemon *SpawnpointDaemon) deregisterWaiting(svc *serviceManifest) {
+	if svc.currentState() != ServiceWaiting {
+		return
+	}
+	daemon.registryLock.Lock()
+	delete(daemon.serviceRegistry, svc.Name)
+	daemon.registryLock.Unlock()
+}
+
+// stopDependents stops the services on this host that depend on a service that
+// has just stopped, if they asked to be stopped along with their dependencies
+func (daemon *SpawnpointDaemon) stopDependents(svc *serviceManifest) {
+	if len(svc.ID) == 0 {
+		// The service never started, so none of its dependents did either
+		return
+	}
+
+	var dependents []string
+	daemon.registryLock.RLock()
+	for name, other := range daemon.serviceRegistry {
+		if !other.StopWithDependencies {
+			continue
+		}
+		for _, dep := range other.DependsOn {
+			if dep == svc.Name {
+				dependents = append(dependents, name)
+				break
+			}
+		}
+	}
+	daemon.registryLock.RUnlock()
+
+	for _, name := range dependents {
+		daemon.logger.Debugf("(%s) Stopping because dependency %s stopped", name, svc.Name)
+		daemon.publishStatus(name, statusProgress(service.OperationStop, fmt.Sprintf("Stopping because dependency %s stopped", svc.Name)))
+		// The dependent's state machine may be busy, which mustn't hold up this one's cleanup
+		go func(name string) {
+			if err := daemon.issueServiceEvent(name, service.Stop); err != nil {
+				daemon.logger.Debugf("(%s) Failed to stop dependent service: %s", name, err)
+			}
+		}(name)
+	}
+}
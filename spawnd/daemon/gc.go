@@ -0,0 +1,112 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
+	"github.com/pkg/errors"
+)
+
+const defaultGCInterval = 6 * time.Hour
+const defaultGCRetention = 24 * time.Hour
+
+// GarbageReport lists the images and volumes removed by a garbage collection,
+// or that would have been removed in a dry run
+type GarbageReport struct {
+	DryRun    bool
+	Removed   []backend.Artifact
+	Reclaimed int64 // Bytes, not counting artifacts of unknown size
+}
+
+// collectGarbagePeriodically collects garbage on every interval, starting immediately
+func (daemon *SpawnpointDaemon) collectGarbagePeriodically(ctx context.Context, interval time.Duration) {
+	tick := time.Tick(interval)
+	for {
+		daemon.registryLock.RLock()
+		volumes := make(map[string]struct{})
+		for _, svc := range daemon.serviceRegistry {
+			for _, volume := range svc.Volumes {
+				volumes[volume] = struct{}{}
+			}
+		}
+		daemon.registryLock.RUnlock()
+
+		if _, err := daemon.collectGarbage(ctx, volumes, false); err != nil {
+			daemon.logger.Errorf("Failed to collect garbage: %s", err)
+		}
+
+		select {
+		case <-tick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CollectGarbage performs a single garbage collection, e.g. while the daemon
+// isn't running. Which volumes services use is taken from the daemon's
+// persisted record of its services.
+func (daemon *SpawnpointDaemon) CollectGarbage(ctx context.Context, dryRun bool) (*GarbageReport, error) {
+	snapshot, err := daemon.readSnapshot(snapshotPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read service snapshot")
+	}
+	if _, err = replayJournal(daemon.journal.path, snapshot); err != nil {
+		daemon.logger.Warningf("Ignoring remainder of service journal: %s", err)
+	}
+
+	volumes := make(map[string]struct{})
+	for _, entry := range snapshot {
+		for _, volume := range entry.Configuration.Volumes {
+			volumes[volume] = struct{}{}
+		}
+	}
+	return daemon.collectGarbage(ctx, volumes, dryRun)
+}
+
+// collectGarbage removes images and volumes that are older than the retention
+// period and no longer of use. An artifact is of use if a container uses it, if
+// it's a volume that a service refers to, or if it's the newest image of its
+// service, which is kept so that it can be reused.
+func (daemon *SpawnpointDaemon) collectGarbage(ctx context.Context, volumes map[string]struct{}, dryRun bool) (*GarbageReport, error) {
+	artifacts, err := daemon.backend.ListArtifacts(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list images and volumes")
+	}
+
+	newestImages := make(map[string]backend.Artifact)
+	for _, artifact := range artifacts {
+		if artifact.Kind != backend.ArtifactImage {
+			continue
+		}
+		if newest, ok := newestImages[artifact.Service]; !ok || artifact.Created.After(newest.Created) {
+			newestImages[artifact.Service] = artifact
+		}
+	}
+
+	report := GarbageReport{DryRun: dryRun}
+	cutoff := time.Now().Add(-daemon.GCRetention)
+	for _, artifact := range artifacts {
+		if artifact.InUse || artifact.Created.After(cutoff) {
+			continue
+		} else if artifact.Kind == backend.ArtifactImage && newestImages[artifact.Service].Name == artifact.Name {
+			continue
+		} else if _, ok := volumes[artifact.Name]; ok && artifact.Kind == backend.ArtifactVolume {
+			continue
+		}
+
+		if !dryRun {
+			if err := daemon.backend.RemoveArtifact(ctx, artifact); err != nil {
+				daemon.logger.Errorf("Failed to remove %s %s: %s", artifact.Kind, artifact.Name, err)
+				continue
+			}
+			daemon.logger.Debugf("Removed unused %s %s", artifact.Kind, artifact.Name)
+		}
+		report.Removed = append(report.Removed, artifact)
+		if artifact.Size > 0 {
+			report.Reclaimed += artifact.Size
+		}
+	}
+	return &report, nil
+}
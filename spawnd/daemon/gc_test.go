@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
+	logging "github.com/op/go-logging"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	fake := backend.NewFake("testing")
+	daemon := &SpawnpointDaemon{
+		Config:  Config{GCRetention: time.Hour},
+		logger:  logging.MustGetLogger("spawnd-test"),
+		backend: fake,
+	}
+	build := func(config *service.Configuration) string {
+		image, err := fake.BuildService(ctx, config, make(chan service.BuildEvent))
+		if err != nil {
+			t.Fatalf("Failed to build fake service: %s", err)
+		}
+		return image
+	}
+
+	// A stopped service leaves behind an outdated image, its latest image, and a volume
+	config := &service.Configuration{Name: "demosvc", Build: []string{"make"}, Volumes: []string{"data", "cache"}}
+	outdated := build(config)
+	config.Build = []string{"make all"}
+	id, err := fake.RunService(ctx, config, backend.Deployment{}, build(config))
+	if err != nil {
+		t.Fatalf("Failed to run fake service: %s", err)
+	}
+	fake.RemoveService(ctx, id)
+	// Another service only just created its image
+	build(&service.Configuration{Name: "othersvc"})
+
+	artifacts, _ := fake.ListArtifacts(ctx)
+	for _, artifact := range artifacts {
+		if artifact.Name == outdated {
+			fake.InjectArtifactAge(artifact.Name, 3*time.Hour)
+		} else if artifact.Service != "othersvc" {
+			fake.InjectArtifactAge(artifact.Name, 2*time.Hour)
+		}
+	}
+
+	// The data volume is still referenced by a service
+	volumes := map[string]struct{}{"data": {}}
+	report, err := daemon.collectGarbage(ctx, volumes, true)
+	if err != nil {
+		t.Fatalf("Failed to collect garbage: %s", err)
+	} else if len(report.Removed) != 2 {
+		t.Fatalf("Expected 2 artifacts to be collected, found %v", report.Removed)
+	}
+	for _, artifact := range report.Removed {
+		if artifact.Name != outdated && artifact.Name != "cache" {
+			t.Fatalf("Unexpectedly collected %s %s", artifact.Kind, artifact.Name)
+		}
+	}
+	if artifacts, _ = fake.ListArtifacts(ctx); len(artifacts) != 5 {
+		t.Fatalf("Dry run removed artifacts, %d remain", len(artifacts))
+	}
+
+	if _, err = daemon.collectGarbage(ctx, volumes, false); err != nil {
+		t.Fatalf("Failed to collect garbage: %s", err)
+	} else if artifacts, _ = fake.ListArtifacts(ctx); len(artifacts) != 3 {
+		t.Fatalf("Expected 3 artifacts to remain, found %v", artifacts)
+	}
+}
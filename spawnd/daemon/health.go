@@ -0,0 +1,145 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/transport"
+	"github.com/pkg/errors"
+)
+
+// Service health reported in heartbeats, empty if the service has no health check
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+func validateHealthCheck(check *service.HealthCheck) error {
+	if check == nil {
+		return nil
+	}
+	if len(check.Command) == 0 && len(check.URI) == 0 {
+		return errors.New("Must specify either command or uri")
+	} else if len(check.Command) > 0 && len(check.URI) > 0 {
+		return errors.New("Cannot specify both command and uri")
+	} else if check.Interval < 0 {
+		return errors.New("interval is negative")
+	} else if check.Timeout < 0 {
+		return errors.New("timeout is negative")
+	}
+	return nil
+}
+
+func (daemon *SpawnpointDaemon) monitorHealth(ctx context.Context, svc *serviceManifest, wg *sync.WaitGroup) {
+	defer wg.Done()
+	check := svc.EffectiveHealthCheck()
+	svc.setHealth(HealthStarting)
+
+	// Start the clock for URI checks from the moment monitoring begins
+	lastMessage := time.Now()
+	var lastMessageLock sync.Mutex
+	if len(check.URI) > 0 {
+		handle, err := daemon.transport.SubscribeURI(check.URI, func(msg *transport.Message) {
+			lastMessageLock.Lock()
+			lastMessage = time.Now()
+			lastMessageLock.Unlock()
+		})
+		if err != nil {
+			daemon.logger.Errorf("(%s) Failed to subscribe to health check URI: %s", svc.Name, err)
+			return
+		}
+		defer func() {
+			if err := daemon.transport.Unsubscribe(handle); err != nil {
+				daemon.logger.Errorf("(%s) Failed to unsubscribe from health check URI", svc.Name)
+			}
+		}()
+	}
+
+	probe := func() error {
+		if len(check.URI) > 0 {
+			lastMessageLock.Lock()
+			silence := time.Since(lastMessage)
+			lastMessageLock.Unlock()
+			if silence > check.Timeout {
+				return fmt.Errorf("No message on %s for %s", check.URI, silence)
+			}
+			return nil
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, check.Timeout)
+		defer cancel()
+		exitCode, err := daemon.backend.ExecService(probeCtx, svc.ID, check.Command)
+		if err != nil {
+			return err
+		} else if exitCode != 0 {
+			return fmt.Errorf("Command exited with status %d", exitCode)
+		}
+		return nil
+	}
+
+	tick := time.NewTicker(check.Interval)
+	defer tick.Stop()
+	var failures uint
+	for {
+		select {
+		case <-ctx.Done():
+			daemon.logger.Debugf("(%s) Terminating health monitoring", svc.Name)
+			return
+		case <-tick.C:
+		}
+
+		// There is nothing to probe while the container awaits a restart
+		if svc.currentState() != ServiceRunning {
+			continue
+		}
+		err := probe()
+		if err == nil {
+			failures = 0
+			if svc.currentHealth() != HealthHealthy {
+				daemon.logger.Debugf("(%s) Service is healthy", svc.Name)
+				svc.setHealth(HealthHealthy)
+				daemon.refreshServiceHeartbeat(svc)
+			}
+			continue
+		}
+
+		failures++
+		daemon.logger.Debugf("(%s) Health check failed (%d/%d): %s", svc.Name, failures, check.Retries, err)
+		if failures < check.Retries {
+			continue
+		}
+		if svc.currentHealth() != HealthUnhealthy {
+			svc.setHealth(HealthUnhealthy)
+			daemon.refreshServiceHeartbeat(svc)
+			msg := fmt.Sprintf("Service is unhealthy after %d failed health checks: %s", failures, err)
+			daemon.publishServiceStatus(svc, statusWarning(service.OperationMonitor, msg))
+		}
+
+		if check.RestartUnhealthy {
+			daemon.logger.Debugf("(%s) Restarting unhealthy service", svc.Name)
+			failures = 0
+			svc.setHealth(HealthStarting)
+			select {
+			case svc.Events <- service.Restart:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (svc *serviceManifest) setHealth(health string) {
+	svc.heartbeatLock.Lock()
+	svc.health = health
+	svc.heartbeatLock.Unlock()
+}
+
+func (svc *serviceManifest) currentHealth() string {
+	svc.heartbeatLock.RLock()
+	defer svc.heartbeatLock.RUnlock()
+	return svc.health
+}
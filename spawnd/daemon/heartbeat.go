@@ -5,8 +5,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/util"
-	bw2 "github.com/immesys/bw2bind"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/transport"
 	"github.com/pkg/errors"
 )
 
@@ -18,6 +19,7 @@ type Heartbeat struct {
 	AvailableMemory uint64
 	AvailableCPU    uint64
 	Services        []string
+	Labels          map[string]string
 }
 
 type ServiceHeartbeat struct {
@@ -26,8 +28,19 @@ type ServiceHeartbeat struct {
 	CPUShares     uint64
 	UsedMemory    float64
 	UsedCPUShares float64
+	State         string
+	Health        string
+	SourceCommit  string
 }
 
+// Service states reported in heartbeats
+const (
+	ServiceRunning      = "running"
+	ServiceRestarting   = "restarting"
+	ServiceCrashLooping = "crash-looping"
+	ServiceWaiting      = "waiting"
+)
+
 func (daemon *SpawnpointDaemon) publishHearbeats(ctx context.Context, delay time.Duration) {
 	tick := time.Tick(delay)
 	daemon.publishHeartbeatAux()
@@ -44,18 +57,25 @@ func (daemon *SpawnpointDaemon) publishHearbeats(ctx context.Context, delay time
 }
 
 func (daemon *SpawnpointDaemon) publishHeartbeatAux() {
-	bw2Iface := daemon.bw2Service.RegisterInterface("daemon", "i.spawnpoint")
+	hb := daemon.currentHeartbeat()
+	daemon.logger.Debug("Publishing daemon heartbeat")
+	daemon.logger.Debugf("CPU: %v/%v, Memory: %v/%v", hb.AvailableCPU, hb.TotalCPU,
+		hb.AvailableMemory, hb.TotalMemory)
+
+	hbPo := transport.Payload{Type: transport.HeartbeatPayload, Value: hb}
+	if err := daemon.transport.PublishSignal(daemon.daemonInterface(), "heartbeat", hbPo); err != nil {
+		daemon.logger.Errorf("Failed to publish daemon heartbeat: %s", err)
+	}
+}
 
+func (daemon *SpawnpointDaemon) currentHeartbeat() Heartbeat {
 	daemon.resourceLock.RLock()
 	availableCPU := daemon.availableCPUShares
 	availableMemory := daemon.availableMemory
 	daemon.resourceLock.RUnlock()
-	daemon.logger.Debug("Publishing daemon heartbeat")
-	daemon.logger.Debugf("CPU: %v/%v, Memory: %v/%v", availableCPU, daemon.CPUShares,
-		availableMemory, daemon.Memory)
 
-	services := make([]string, len(daemon.serviceRegistry))
 	daemon.registryLock.RLock()
+	services := make([]string, len(daemon.serviceRegistry))
 	i := 0
 	for name := range daemon.serviceRegistry {
 		services[i] = name
@@ -63,7 +83,7 @@ func (daemon *SpawnpointDaemon) publishHeartbeatAux() {
 	}
 	daemon.registryLock.RUnlock()
 
-	hb := Heartbeat{
+	return Heartbeat{
 		Version:         util.VersionNum,
 		Time:            time.Now().UnixNano(),
 		TotalCPU:        daemon.CPUShares,
@@ -71,40 +91,15 @@ func (daemon *SpawnpointDaemon) publishHeartbeatAux() {
 		AvailableCPU:    availableCPU,
 		AvailableMemory: availableMemory,
 		Services:        services,
-	}
-	hbPo, err := bw2.CreateMsgPackPayloadObject(bw2.PONumSpawnpointHeartbeat, hb)
-	if err != nil {
-		daemon.logger.Errorf("Failed to marshal heartbeat: %s", err)
-	} else if err := bw2Iface.PublishSignal("heartbeat", hbPo); err != nil {
-		daemon.logger.Errorf("Failed to publish daemon heartbeat: %s", err)
+		Labels:          daemon.Labels,
 	}
 }
 
 func (daemon *SpawnpointDaemon) publishServiceHeartbeats(ctx context.Context, svc *serviceManifest, period time.Duration, wg *sync.WaitGroup) {
 	defer wg.Done()
 	statChan, errChan := daemon.backend.ProfileService(ctx, svc.ID, period)
-	bw2Iface := daemon.bw2Service.RegisterInterface(svc.Name, "i.spawnable")
 	for stats := range statChan {
-		daemon.logger.Debugf("(%s) Publishing service heartbeat", svc.Name)
-		daemon.logger.Debugf("(%s) CPU Shares: ~%.2f/%d, Memory: %.2f/%d MiB", svc.Name,
-			stats.CPUShares, svc.CPUShares, stats.Memory, svc.Memory)
-		svcHb := ServiceHeartbeat{
-			Time:          time.Now().UnixNano(),
-			Memory:        svc.Memory,
-			CPUShares:     svc.CPUShares,
-			UsedMemory:    stats.Memory,
-			UsedCPUShares: stats.CPUShares,
-		}
-
-		po, err := bw2.CreateMsgPackPayloadObject(bw2.PONumSpawnpointSvcHb, svcHb)
-		if err != nil {
-			daemon.logger.Errorf("(%s) Failed to marshal service heartbeat: %s", svc.Name, err)
-			continue
-		}
-
-		if err := bw2Iface.PublishSignal("heartbeat", po); err != nil {
-			daemon.logger.Errorf("(%s) Failed to publish service heartbeat: %s", svc.Name, err)
-		}
+		daemon.publishServiceHeartbeat(svc, stats)
 	}
 	daemon.logger.Debugf("(%s) Service heartbeat publication terminated", svc.Name)
 
@@ -115,11 +110,90 @@ func (daemon *SpawnpointDaemon) publishServiceHeartbeats(ctx context.Context, sv
 	}
 }
 
+func (daemon *SpawnpointDaemon) publishServiceHeartbeat(svc *serviceManifest, stats backend.Stats) {
+	daemon.logger.Debugf("(%s) Publishing service heartbeat", svc.Name)
+	daemon.logger.Debugf("(%s) CPU Shares: ~%.2f/%d, Memory: %.2f/%d MiB", svc.Name,
+		stats.CPUShares, svc.CPUShares, stats.Memory, svc.Memory)
+	svcHb := ServiceHeartbeat{
+		Time:          time.Now().UnixNano(),
+		Memory:        svc.Memory,
+		CPUShares:     svc.CPUShares,
+		UsedMemory:    stats.Memory,
+		UsedCPUShares: stats.CPUShares,
+		State:         svc.currentState(),
+		Health:        svc.currentHealth(),
+		SourceCommit:  svc.currentSourceCommit(),
+	}
+
+	svc.setHeartbeat(&svcHb)
+	daemon.metrics.serviceCPUUsed.WithLabelValues(svc.Name).Set(stats.CPUShares)
+	daemon.metrics.serviceMemUsed.WithLabelValues(svc.Name).Set(stats.Memory)
+
+	po := transport.Payload{Type: transport.ServiceHeartbeatPayload, Value: svcHb}
+	if err := daemon.transport.PublishSignal(daemon.serviceInterface(svc.Name), "heartbeat", po); err != nil {
+		daemon.logger.Errorf("(%s) Failed to publish service heartbeat: %s", svc.Name, err)
+	}
+}
+
+// refreshServiceHeartbeat publishes a heartbeat right away, e.g. after a change in
+// health, reusing the most recently measured resource consumption
+func (daemon *SpawnpointDaemon) refreshServiceHeartbeat(svc *serviceManifest) {
+	var stats backend.Stats
+	if hb := svc.lastHeartbeat(); hb != nil {
+		stats.CPUShares = hb.UsedCPUShares
+		stats.Memory = hb.UsedMemory
+	}
+	daemon.publishServiceHeartbeat(svc, stats)
+}
+
+func (svc *serviceManifest) setHeartbeat(hb *ServiceHeartbeat) {
+	svc.heartbeatLock.Lock()
+	svc.heartbeat = hb
+	svc.heartbeatLock.Unlock()
+}
+
+// lastHeartbeat returns the most recently published heartbeat, or nil if there is none yet
+func (svc *serviceManifest) lastHeartbeat() *ServiceHeartbeat {
+	svc.heartbeatLock.RLock()
+	defer svc.heartbeatLock.RUnlock()
+	return svc.heartbeat
+}
+
+func (svc *serviceManifest) setState(state string) {
+	svc.heartbeatLock.Lock()
+	svc.state = state
+	svc.heartbeatLock.Unlock()
+}
+
+func (svc *serviceManifest) currentState() string {
+	svc.heartbeatLock.RLock()
+	defer svc.heartbeatLock.RUnlock()
+	return svc.state
+}
+
+// recordSourceCommit looks up which commit of its source a service's container was built from
+func (daemon *SpawnpointDaemon) recordSourceCommit(ctx context.Context, svc *serviceManifest) {
+	var commit string
+	if manifest, err := daemon.backend.InspectService(ctx, svc.ID); err != nil {
+		daemon.logger.Warningf("(%s) Failed to inspect service container: %s", svc.Name, err)
+	} else {
+		commit = manifest.SourceCommit
+	}
+	svc.heartbeatLock.Lock()
+	svc.sourceCommit = commit
+	svc.heartbeatLock.Unlock()
+}
+
+func (svc *serviceManifest) currentSourceCommit() string {
+	svc.heartbeatLock.RLock()
+	defer svc.heartbeatLock.RUnlock()
+	return svc.sourceCommit
+}
+
 func (daemon *SpawnpointDaemon) Decommission() error {
-	bw2Iface := daemon.bw2Service.RegisterInterface("daemon", "i.spawnpoint")
 	daemon.logger.Debugf("Decomissioning spawnpoint %s", daemon.Path)
 	// A message without any POs is effectively a metadata de-persist
-	if err := bw2Iface.PublishSignal("heartbeat"); err != nil {
+	if err := daemon.transport.PublishSignal(daemon.daemonInterface(), "heartbeat"); err != nil {
 		daemon.logger.Errorf("Failed to publish de-persist message: %s", err)
 		return errors.Wrap(err, "Failed to publish de-persist message")
 	}
@@ -0,0 +1,157 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Each journal record is framed by its length and a CRC-32 checksum, so that a
+// record torn by a crash can be told apart from a complete one
+const journalFrameSize = 8
+
+// serviceJournal is an append-only log of changes to the service registry made
+// since the last snapshot. Replaying it on top of that snapshot reproduces the
+// registry as it was when the daemon last changed it.
+type serviceJournal struct {
+	path    string
+	file    *os.File
+	records int
+	lock    sync.Mutex
+}
+
+// journalRecord sets the persisted state of a service, or removes the service if Entry is nil
+type journalRecord struct {
+	Name  string
+	Entry *snapshotEntry
+}
+
+func journalPath(snapshotPath string) string {
+	return snapshotPath + ".journal"
+}
+
+// append durably records a change before returning
+// Callers change the registry first, so that a concurrent compaction can't lose the change
+func (journal *serviceJournal) append(record journalRecord) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(record); err != nil {
+		return errors.Wrap(err, "Failed to encode journal record")
+	}
+	frame := make([]byte, journalFrameSize, journalFrameSize+payload.Len())
+	binary.BigEndian.PutUint32(frame, uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, payload.Bytes()...)
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if err := journal.open(); err != nil {
+		return err
+	}
+	if _, err := journal.file.Write(frame); err != nil {
+		return errors.Wrap(err, "Failed to write journal record")
+	}
+	if err := journal.file.Sync(); err != nil {
+		return errors.Wrap(err, "Failed to sync journal")
+	}
+	journal.records++
+	return nil
+}
+
+// compact writes a new snapshot and then empties the journal, while no records can be appended
+// It does nothing if nothing has been journaled since the last compaction, unless forced
+func (journal *serviceJournal) compact(force bool, write func() error) error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if journal.records == 0 && !force {
+		return nil
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	if err := journal.open(); err != nil {
+		return err
+	}
+	if err := journal.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "Failed to truncate journal")
+	}
+	if err := journal.file.Sync(); err != nil {
+		return errors.Wrap(err, "Failed to sync journal")
+	}
+	journal.records = 0
+	return nil
+}
+
+func (journal *serviceJournal) open() error {
+	if journal.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(journal.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open journal")
+	}
+	journal.file = file
+	return nil
+}
+
+// replayJournal applies journaled changes to a snapshot, returning how many were applied
+// Replay stops at the first incomplete or damaged record, which is reported as an error
+func replayJournal(path string, snapshot map[string]*snapshotEntry) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "Failed to read journal")
+	}
+
+	applied := 0
+	for offset := 0; offset < len(contents); applied++ {
+		if len(contents)-offset < journalFrameSize {
+			return applied, fmt.Errorf("Journal record %d is truncated", applied+1)
+		}
+		size := int(binary.BigEndian.Uint32(contents[offset:]))
+		checksum := binary.BigEndian.Uint32(contents[offset+4:])
+		offset += journalFrameSize
+		if len(contents)-offset < size {
+			return applied, fmt.Errorf("Journal record %d is truncated", applied+1)
+		}
+		payload := contents[offset : offset+size]
+		offset += size
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return applied, fmt.Errorf("Journal record %d is damaged", applied+1)
+		}
+
+		var record journalRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+			return applied, errors.Wrapf(err, "Failed to decode journal record %d", applied+1)
+		}
+		if record.Entry == nil {
+			delete(snapshot, record.Name)
+		} else {
+			snapshot[record.Name] = record.Entry
+		}
+	}
+	return applied, nil
+}
+
+func (daemon *SpawnpointDaemon) journalService(svc *serviceManifest) {
+	record := journalRecord{
+		Name:  svc.Name,
+		Entry: &snapshotEntry{Configuration: svc.Configuration.Redacted(), ID: svc.ID, Deployment: svc.deployment},
+	}
+	if err := daemon.journal.append(record); err != nil {
+		daemon.logger.Errorf("(%s) Failed to journal service: %s", svc.Name, err)
+	}
+}
+
+func (daemon *SpawnpointDaemon) journalRemoval(svcName string) {
+	if err := daemon.journal.append(journalRecord{Name: svcName}); err != nil {
+		daemon.logger.Errorf("(%s) Failed to journal service removal: %s", svcName, err)
+	}
+}
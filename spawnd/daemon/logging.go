@@ -6,7 +6,7 @@ import (
 	"time"
 
 	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
-	bw2 "github.com/immesys/bw2bind"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/transport"
 	"github.com/pkg/errors"
 )
 
@@ -20,7 +20,7 @@ func (daemon *SpawnpointDaemon) tailLogs(ctx context.Context, svc *serviceManife
 	default:
 	}
 
-	bw2Iface := daemon.bw2Service.RegisterInterface(svc.Name, "i.spawnable")
+	iface := daemon.serviceInterface(svc.Name)
 	alive := true
 	aliveMut := sync.Mutex{}
 	pending := time.AfterFunc(1*time.Minute, func() {
@@ -35,7 +35,7 @@ func (daemon *SpawnpointDaemon) tailLogs(ctx context.Context, svc *serviceManife
 		aliveMut.Unlock()
 	})
 
-	keepAliveHandle, err := bw2Iface.SubscribeSlotH("keepLogAlive", func(msg *bw2.SimpleMessage) {
+	keepAliveHandle, err := daemon.transport.SubscribeSlot(iface, "keepLogAlive", func(msg *transport.Message) {
 		daemon.logger.Debugf("(%s) Received log keep-alive message", svc.Name)
 		select {
 		case <-ctx.Done():
@@ -56,7 +56,7 @@ func (daemon *SpawnpointDaemon) tailLogs(ctx context.Context, svc *serviceManife
 	defer func() {
 		daemon.logger.Debugf("(%s) Stopping log tailing", svc.Name)
 		pending.Stop()
-		if err := daemon.bw2Client.Unsubscribe(keepAliveHandle); err != nil {
+		if err := daemon.transport.Unsubscribe(keepAliveHandle); err != nil {
 			daemon.logger.Errorf("(%s) Failed to unsubscribe from log keep-alive slot", svc.Name)
 		} else {
 			daemon.logger.Debugf("(%s) Unsubscribed from log keep-alive slot", svc.Name)
@@ -64,18 +64,17 @@ func (daemon *SpawnpointDaemon) tailLogs(ctx context.Context, svc *serviceManife
 	}()
 
 	for msg := range logChan {
+		logMessage := service.LogMessage{
+			Contents:  msg,
+			Timestamp: time.Now().UnixNano(),
+		}
+		daemon.broadcastLog(svc.Name, logMessage)
+
 		aliveMut.Lock()
 		if alive {
 			aliveMut.Unlock()
-			po, err := bw2.CreateMsgPackPayloadObject(bw2.PONumSpawnpointLog, service.LogMessage{
-				Contents:  msg,
-				Timestamp: time.Now().UnixNano(),
-			})
-			if err != nil {
-				daemon.logger.Errorf("(%s) Failed to serialize log message: %s", svc.Name, err)
-			}
-
-			if err = bw2Iface.PublishSignal("log", po); err != nil {
+			po := transport.Payload{Type: transport.LogPayload, Value: logMessage}
+			if err := daemon.transport.PublishSignal(iface, "log", po); err != nil {
 				daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
 			}
 		} else {
@@ -92,18 +91,101 @@ func (daemon *SpawnpointDaemon) tailLogs(ctx context.Context, svc *serviceManife
 }
 
 func (daemon *SpawnpointDaemon) publishLogMessage(svcName string, msg string) error {
-	iFace := daemon.bw2Service.RegisterInterface(svcName, "i.spawnable")
 	logMessage := service.LogMessage{
 		Timestamp: time.Now().UnixNano(),
 		Contents:  msg,
 	}
-	logMessagePo, err := bw2.CreateMsgPackPayloadObject(bw2.PONumSpawnpointLog, logMessage)
-	if err != nil {
-		return errors.Wrap(err, "Failed to create msgpack object")
+	daemon.broadcastLog(svcName, logMessage)
+	logMessagePo := transport.Payload{Type: transport.LogPayload, Value: logMessage}
+	if err := daemon.transport.PublishSignal(daemon.serviceInterface(svcName), "log", logMessagePo); err != nil {
+		return errors.Wrap(err, "Log publication failed")
 	}
+	return nil
+}
 
-	if err = iFace.PublishSignal("log", logMessagePo); err != nil {
-		return errors.Wrap(err, "Bosswave publication failed")
+// publishStatus reports on an operation on a service, both on its status signal
+// and as a line of its log
+func (daemon *SpawnpointDaemon) publishStatus(svcName string, status service.ServiceStatus) {
+	status.Timestamp = time.Now().UnixNano()
+	if err := daemon.publishLogMessage(svcName, status.String()); err != nil {
+		daemon.logger.Errorf("(%s) Failed to publish log message: %s", svcName, err)
+	}
+	statusPo := transport.Payload{Type: transport.StatusPayload, Value: status}
+	if err := daemon.transport.PublishSignal(daemon.serviceInterface(svcName), "status", statusPo); err != nil {
+		daemon.logger.Errorf("(%s) Failed to publish service status: %s", svcName, err)
+	}
+}
+
+// publishServiceStatus reports on an operation on a service's current container
+func (daemon *SpawnpointDaemon) publishServiceStatus(svc *serviceManifest, status service.ServiceStatus) {
+	status.ServiceID = svc.ID
+	daemon.publishStatus(svc.Name, status)
+}
+
+func statusProgress(operation string, msg string) service.ServiceStatus {
+	return service.ServiceStatus{Operation: operation, Phase: service.PhaseProgress, Code: 202, Message: msg}
+}
+
+func statusWarning(operation string, msg string) service.ServiceStatus {
+	return service.ServiceStatus{Operation: operation, Phase: service.PhaseWarning, Code: 200, Message: msg}
+}
+
+func statusSucceeded(operation string, msg string) service.ServiceStatus {
+	return service.ServiceStatus{Operation: operation, Phase: service.PhaseSucceeded, Code: 200, Message: msg}
+}
+
+func statusFailed(operation string, code int, msg string) service.ServiceStatus {
+	return service.ServiceStatus{Operation: operation, Phase: service.PhaseFailed, Code: code, Message: msg}
+}
+
+// statusFromError reports a failed operation, keeping the code of an operation error
+func statusFromError(operation string, err error) service.ServiceStatus {
+	if opErr, ok := err.(*operationError); ok {
+		return statusFailed(operation, opErr.Code, opErr.Message)
+	}
+	return statusFailed(operation, 500, err.Error())
+}
+
+func (daemon *SpawnpointDaemon) publishBuildEvent(svcName string, event service.BuildEvent) error {
+	eventPo := transport.Payload{Type: transport.BuildEventPayload, Value: event}
+	if err := daemon.transport.PublishSignal(daemon.serviceInterface(svcName), "build", eventPo); err != nil {
+		return errors.Wrap(err, "Build event publication failed")
 	}
 	return nil
 }
+
+// subscribeLogs returns a channel carrying all subsequent log messages for a service,
+// along with a function to cancel the subscription
+func (daemon *SpawnpointDaemon) subscribeLogs(svcName string) (<-chan service.LogMessage, func()) {
+	logChan := make(chan service.LogMessage, 20)
+	daemon.logLock.Lock()
+	daemon.logSubscribers[svcName] = append(daemon.logSubscribers[svcName], logChan)
+	daemon.logLock.Unlock()
+
+	return logChan, func() {
+		daemon.logLock.Lock()
+		defer daemon.logLock.Unlock()
+		subscribers := daemon.logSubscribers[svcName]
+		for i, subscriber := range subscribers {
+			if subscriber == logChan {
+				daemon.logSubscribers[svcName] = append(subscribers[:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(daemon.logSubscribers[svcName]) == 0 {
+			delete(daemon.logSubscribers, svcName)
+		}
+	}
+}
+
+func (daemon *SpawnpointDaemon) broadcastLog(svcName string, msg service.LogMessage) {
+	daemon.logLock.Lock()
+	defer daemon.logLock.Unlock()
+	for _, subscriber := range daemon.logSubscribers[svcName] {
+		// Slow subscribers miss messages rather than stall the daemon
+		select {
+		case subscriber <- msg:
+		default:
+		}
+	}
+}
@@ -5,41 +5,127 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
+	"github.com/pkg/errors"
 )
 
+// containerWatch tracks the goroutines that follow a single service container
+type containerWatch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
 func (daemon *SpawnpointDaemon) manageService(svc *serviceManifest, done chan<- struct{}) {
-	var wg sync.WaitGroup
+	var watch *containerWatch
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	restartInProgress := false
+	// Set while an update is building, and then while its container is within the grace period
+	var updateBuilds <-chan updateBuild
+	var updateGrace <-chan time.Time
+	var previous *rollbackPoint
 
 	// Cleanup functions
 	defer close(done)
+	defer daemon.metrics.serviceRemoved(svc.Name)
+	defer daemon.releasePorts(svc.Name)
+	defer daemon.stopDependents(svc)
 	defer func() {
-		wg.Wait()
+		if watch != nil {
+			watch.stop()
+		}
+		if previous != nil {
+			daemon.releaseUpdate(previous.config, svc.Configuration)
+			daemon.logger.Debugf("(%s) Attempting to remove previous version of service", svc.Name)
+			if err := daemon.backend.RemoveService(context.Background(), previous.id); err != nil {
+				daemon.logger.Errorf("(%s) Failed to remove previous version of service: %s", svc.Name, err)
+			}
+		}
 		if len(svc.ID) > 0 {
 			daemon.logger.Debugf("(%s) Attempting to remove service", svc.Name)
 			if err := daemon.backend.RemoveService(context.Background(), svc.ID); err != nil {
 				daemon.logger.Errorf("(%s) Failed to remove service: %s", svc.Name, err)
-				if err = daemon.publishLogMessage(svc.Name, "[ERROR 500] Failed to remove service"); err != nil {
-					daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-				}
+				daemon.publishServiceStatus(svc, statusFailed(service.OperationRemove, 500, "Failed to remove service"))
 				return
 			}
 			daemon.logger.Debugf("(%s) Service removed successfully", svc.Name)
-			if err := daemon.publishLogMessage(svc.Name, "[SUCCESS] Removed service container"); err != nil {
-				daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-			}
+			daemon.publishServiceStatus(svc, statusSucceeded(service.OperationRemove, "Removed service container"))
 		}
 	}()
 	defer cancelFunc()
 
-	for event := range svc.Events {
+	policy := svc.EffectiveRestartPolicy()
+	backoff := policy.InitialBackoff
+	var restartAttempts uint
+	var lastStart time.Time
+	// Receives once the backoff before an automatic restart has elapsed
+	var pendingRestart <-chan time.Time
+
+	for {
+		var event service.Event
+		select {
+		case event = <-svc.Events:
+		case <-pendingRestart:
+			pendingRestart = nil
+			daemon.logger.Debugf("(%s) Restart backoff has elapsed, attempting service restart", svc.Name)
+			if err := daemon.restartContainer(ctx, svc, watch); err != nil {
+				return
+			}
+			svc.setState(ServiceRunning)
+			lastStart = time.Now()
+			continue
+
+		case update := <-svc.updates:
+			daemon.logger.Debugf("(%s) State machine received service update", svc.Name)
+			updateBuilds = daemon.buildUpdate(ctx, svc, update)
+			continue
+
+		case build := <-updateBuilds:
+			updateBuilds = nil
+			if build.err != nil {
+				daemon.logger.Errorf("(%s) Failed to build updated service: %s", svc.Name, build.err)
+				msg := fmt.Sprintf("Failed to build updated service, keeping current version: %s", build.err)
+				daemon.abandonUpdate(svc, statusFailed(service.OperationUpdate, failedBuildCode(build.err), msg))
+				continue
+			}
+			// Stop watching first, so that stopping the current container isn't taken for a crash
+			watch.stop()
+			var err error
+			if previous, err = daemon.applyUpdate(ctx, svc, build); err != nil {
+				return
+			}
+			watch = daemon.watchContainer(ctx, svc, previous != nil)
+			if previous != nil {
+				// The new container starts out with a clean record under its own policy
+				policy = svc.EffectiveRestartPolicy()
+				restartAttempts = 0
+				backoff = policy.InitialBackoff
+				pendingRestart = nil
+				restartInProgress = false
+				lastStart = time.Now()
+				svc.setState(ServiceRunning)
+				updateGrace = time.After(daemon.UpdateGracePeriod)
+			}
+			continue
+
+		case <-updateGrace:
+			updateGrace = nil
+			daemon.commitUpdate(ctx, svc, previous)
+			previous = nil
+			continue
+		}
+
 		switch event {
 		case service.Boot:
 			daemon.logger.Debugf("(%s) State machine received service boot event", svc.Name)
+			if !daemon.awaitDependencies(svc) {
+				return
+			}
+			// A service that waited stays registered while its container is started
+			defer daemon.deregisterWaiting(svc)
 
 			daemon.resourceLock.Lock()
 			if svc.CPUShares <= daemon.availableCPUShares && svc.Memory <= daemon.availableMemory {
@@ -56,59 +142,52 @@ func (daemon *SpawnpointDaemon) manageService(svc *serviceManifest, done chan<-
 				}()
 			} else {
 				daemon.logger.Debugf("(%s) Has insufficient CPU and memory for new service, rejecting", svc.Name)
-				msg := fmt.Sprintf("[ERROR 503] Insufficient resources for service. CPU: Have %v, Want %v. Mem: Have %v, Want %v",
+				msg := fmt.Sprintf("Insufficient resources for service. CPU: Have %v, Want %v. Mem: Have %v, Want %v",
 					daemon.availableCPUShares, svc.CPUShares, daemon.availableMemory, svc.Memory)
-				if err := daemon.publishLogMessage(svc.Name, msg); err != nil {
-					daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-				}
+				daemon.publishServiceStatus(svc, statusFailed(service.OperationDeploy, 503, msg))
 				daemon.resourceLock.Unlock()
 				return
 			}
 
 			daemon.logger.Debugf("(%s) Attempting to start new service", svc.Name)
-			if err := daemon.publishLogMessage(svc.Name, "[INFO] Launching service..."); err != nil {
-				daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-			}
+			daemon.publishServiceStatus(svc, statusProgress(service.OperationDeploy, "Launching service..."))
 
-			msgs := make(chan string, 20)
-			go func() {
-				for msg := range msgs {
-					if err := daemon.publishLogMessage(svc.Name, strings.TrimSpace(msg)); err != nil {
-						daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-					}
-				}
-			}()
-
-			svcID, err := daemon.backend.StartService(ctx, svc.Configuration, msgs)
+			msgs := daemon.publishBuildLog(svc.Name)
+			buildStart := time.Now()
+			svcID, err := daemon.backend.StartService(ctx, svc.Configuration, svc.deployment, msgs)
 			if err != nil {
 				daemon.logger.Errorf("(%s) Failed to start service: %s", svc.Name, err)
-				if err = daemon.publishLogMessage(svc.Name, fmt.Sprintf("[ERROR 500] Failed to start service: %s", err)); err != nil {
-					daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-				}
+				msg := fmt.Sprintf("Failed to start service: %s", err)
+				daemon.publishServiceStatus(svc, statusFailed(service.OperationDeploy, failedBuildCode(err), msg))
 				return
 			}
 			daemon.logger.Debugf("(%s) Service started successfully", svc.Name)
-			if err = daemon.publishLogMessage(svc.Name, "[SUCCESS] Service container has started"); err != nil {
-				daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-			}
-
+			daemon.metrics.serviceBuildTimes.WithLabelValues(svc.Name).Observe(time.Since(buildStart).Seconds())
 			svc.ID = svcID
+			daemon.recordSourceCommit(ctx, svc)
+			svc.setState(ServiceRunning)
+			lastStart = time.Now()
+			daemon.metrics.serviceStarted(svc)
 			daemon.registryLock.Lock()
 			daemon.serviceRegistry[svc.Name] = svc
 			daemon.registryLock.Unlock()
+			daemon.journalService(svc)
+			// Only report success once the service can be stopped or restarted
+			daemon.publishServiceStatus(svc, statusSucceeded(service.OperationDeploy, "Service container has started"))
 			defer func() {
 				daemon.registryLock.Lock()
 				delete(daemon.serviceRegistry, svc.Name)
 				daemon.registryLock.Unlock()
+				daemon.journalRemoval(svc.Name)
 			}()
 
-			wg.Add(3)
-			go daemon.tailLogs(ctx, svc, true, &wg)
-			go daemon.monitorEvents(ctx, svc, &wg)
-			go daemon.publishServiceHeartbeats(ctx, svc, heartbeatInterval, &wg)
+			watch = daemon.watchContainer(ctx, svc, true)
 
 		case service.Adopt:
 			daemon.logger.Debugf("(%s) State machine received service adopt event", svc.Name)
+			if err := daemon.reservePorts(svc.Name, svc.Ports); err != nil {
+				daemon.logger.Warningf("(%s) Adopted service has conflicting ports: %s", svc.Name, err)
+			}
 			// Accept all previously running services without doing a quota check
 			daemon.resourceLock.Lock()
 			daemon.availableCPUShares -= svc.CPUShares
@@ -122,55 +201,51 @@ func (daemon *SpawnpointDaemon) manageService(svc *serviceManifest, done chan<-
 				daemon.resourceLock.Unlock()
 			}()
 
+			daemon.recordSourceCommit(ctx, svc)
+			svc.setState(ServiceRunning)
+			lastStart = time.Now()
+			daemon.metrics.serviceStarted(svc)
 			daemon.registryLock.Lock()
 			daemon.serviceRegistry[svc.Name] = svc
 			daemon.registryLock.Unlock()
+			daemon.journalService(svc)
 			defer func() {
 				daemon.registryLock.Lock()
 				delete(daemon.serviceRegistry, svc.Name)
 				daemon.registryLock.Unlock()
+				daemon.journalRemoval(svc.Name)
 			}()
 
-			wg.Add(3)
-			go daemon.tailLogs(ctx, svc, true, &wg)
-			go daemon.monitorEvents(ctx, svc, &wg)
-			go daemon.publishServiceHeartbeats(ctx, svc, heartbeatInterval, &wg)
+			watch = daemon.watchContainer(ctx, svc, true)
 
 		case service.Restart:
 			daemon.logger.Debugf("(%s) State machine received service restart event", svc.Name)
-			if err := daemon.backend.RestartService(ctx, svc.ID); err != nil {
-				daemon.logger.Errorf("(%s) Failed to restart service: %s", svc.Name, err)
-				if err = daemon.publishLogMessage(svc.Name, "[ERROR 500] Failed to restart service"); err != nil {
-					daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-				}
+			// The container isn't running while awaiting an automatic restart or after giving up
+			containerRunning := pendingRestart == nil && svc.currentState() != ServiceCrashLooping
+			pendingRestart = nil
+			if err := daemon.restartContainer(ctx, svc, watch); err != nil {
 				return
 			}
-			if err := daemon.publishLogMessage(svc.Name, "[SUCCESS] Restarted service container"); err != nil {
-				daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-			}
-
-			// Need to re-initialize container logging
-			wg.Add(1)
-			go daemon.tailLogs(ctx, svc, false, &wg)
+			// An explicit restart starts over with a clean record
+			restartAttempts = 0
+			backoff = policy.InitialBackoff
+			lastStart = time.Now()
+			svc.setState(ServiceRunning)
 			// Set flag so that inevitable service die event is ignored
-			restartInProgress = true
+			restartInProgress = containerRunning
 
 		case service.Stop:
 			daemon.logger.Debugf("(%s) State machine received service stop event", svc.Name)
 			if err := daemon.backend.StopService(ctx, svc.ID); err != nil {
 				daemon.logger.Errorf("(%s) Failed to stop service: %s", svc.Name, err)
-				if err = daemon.publishLogMessage(svc.Name, "[ERROR 500] Failed to stop service"); err != nil {
-					daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-				}
+				daemon.publishServiceStatus(svc, statusFailed(service.OperationStop, 500, "Failed to stop service"))
 				return
 			}
 			daemon.logger.Debugf("(%s) Service stop completed", svc.Name)
-			if err := daemon.publishLogMessage(svc.Name, "[SUCCESS] Stopped service container"); err != nil {
-				daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-			}
+			daemon.publishServiceStatus(svc, statusSucceeded(service.OperationStop, "Stopped service container"))
 			return
 
-		case service.Die:
+		case service.Die, service.Exit:
 			daemon.logger.Debugf("(%s) State machine received die event", svc.Name)
 			if restartInProgress {
 				// Service termination was part of a normal restart
@@ -178,38 +253,149 @@ func (daemon *SpawnpointDaemon) manageService(svc *serviceManifest, done chan<-
 				restartInProgress = false
 				continue
 			}
+			daemon.metrics.serviceDies.WithLabelValues(svc.Name).Inc()
 
-			if svc.AutoRestart {
-				daemon.logger.Debugf("(%s) Auto-restart enabled, attempting service restart", svc.Name)
-				if err := daemon.backend.RestartService(ctx, svc.ID); err != nil {
-					daemon.logger.Errorf("(%s) Failed to restart service: %s", svc.Name, err)
-					if err = daemon.publishLogMessage(svc.Name, "[ERROR 500] Failed to restart service"); err != nil {
-						daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-					}
+			if previous != nil {
+				// The updated container did not survive its grace period
+				updateGrace = nil
+				watch.stop()
+				err := daemon.rollbackUpdate(ctx, svc, previous)
+				previous = nil
+				if err != nil {
 					return
 				}
-				daemon.logger.Debugf("(%s) Service restart successful", svc.Name)
-				if err := daemon.publishLogMessage(svc.Name, "[SUCCESS] Restarted service container"); err != nil {
-					daemon.logger.Errorf("(%s) Failed to publish log message: %s", svc.Name, err)
-				}
-				// Need to re-initialize container logging
-				wg.Add(1)
-				go daemon.tailLogs(ctx, svc, false, &wg)
-			} else {
+				watch = daemon.watchContainer(ctx, svc, false)
+				policy = svc.EffectiveRestartPolicy()
+				restartAttempts = 0
+				backoff = policy.InitialBackoff
+				lastStart = time.Now()
+				svc.setState(ServiceRunning)
+				continue
+			}
+
+			if policy.Condition == service.RestartNever ||
+				(policy.Condition == service.RestartOnFailure && event == service.Exit) {
+				daemon.logger.Debugf("(%s) Restart policy does not call for a restart", svc.Name)
 				return
 			}
+
+			// A service that stayed up for long enough is given a fresh start
+			if time.Since(lastStart) >= policy.ResetWindow {
+				restartAttempts = 0
+				backoff = policy.InitialBackoff
+			}
+			if policy.MaxRetries > 0 && restartAttempts >= policy.MaxRetries {
+				daemon.logger.Warningf("(%s) Service exhausted %d restart attempts, marking as crash-looping",
+					svc.Name, restartAttempts)
+				svc.setState(ServiceCrashLooping)
+				daemon.publishServiceHeartbeat(svc, backend.Stats{})
+				msg := fmt.Sprintf("Service is crash-looping after %d restart attempts. Restart or stop it explicitly",
+					restartAttempts)
+				daemon.publishServiceStatus(svc, statusFailed(service.OperationMonitor, 500, msg))
+				continue
+			}
+
+			restartAttempts++
+			daemon.logger.Debugf("(%s) Restart policy calls for restart in %s", svc.Name, backoff)
+			msg := fmt.Sprintf("Service container terminated, restarting in %s", backoff)
+			daemon.publishServiceStatus(svc, statusProgress(service.OperationMonitor, msg))
+			svc.setState(ServiceRestarting)
+			pendingRestart = time.After(backoff)
+			backoff *= 2
+			if backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
 		}
 	}
 }
 
+// watchContainer starts following a service's current container: tailing its
+// logs, monitoring its events, publishing heartbeats, and checking its health
+func (daemon *SpawnpointDaemon) watchContainer(ctx context.Context, svc *serviceManifest, fromBeginning bool) *containerWatch {
+	watch := &containerWatch{}
+	watch.ctx, watch.cancel = context.WithCancel(ctx)
+	watch.wg.Add(3)
+	go daemon.tailLogs(watch.ctx, svc, fromBeginning, &watch.wg)
+	go daemon.monitorEvents(watch.ctx, svc, &watch.wg)
+	go daemon.publishServiceHeartbeats(watch.ctx, svc, heartbeatInterval, &watch.wg)
+	if svc.HealthCheck != nil {
+		watch.wg.Add(1)
+		go daemon.monitorHealth(watch.ctx, svc, &watch.wg)
+	}
+	return watch
+}
+
+// stop waits for all of a container's watchers to terminate
+func (watch *containerWatch) stop() {
+	watch.cancel()
+	watch.wg.Wait()
+}
+
+// publishBuildLog returns a channel whose events are published until it is closed, both
+// as they are and as lines of the service's log
+func (daemon *SpawnpointDaemon) publishBuildLog(svcName string) chan<- service.BuildEvent {
+	events := make(chan service.BuildEvent, 20)
+	go func() {
+		for event := range events {
+			event.Timestamp = time.Now().UnixNano()
+			if err := daemon.publishLogMessage(svcName, strings.TrimSpace(event.String())); err != nil {
+				daemon.logger.Errorf("(%s) Failed to publish log message: %s", svcName, err)
+			}
+			if err := daemon.publishBuildEvent(svcName, event); err != nil {
+				daemon.logger.Errorf("(%s) Failed to publish build event: %s", svcName, err)
+			}
+		}
+	}()
+	return events
+}
+
+// failedBuildCode distinguishes a failed build step, which takes a change to the
+// service's configuration to fix, from the backend failing to carry out a build
+func failedBuildCode(err error) int {
+	if _, ok := errors.Cause(err).(*backend.BuildError); ok {
+		return 422
+	}
+	return 500
+}
+
+// restartContainer restarts a service's container and resumes tailing its logs
+func (daemon *SpawnpointDaemon) restartContainer(ctx context.Context, svc *serviceManifest, watch *containerWatch) error {
+	if err := daemon.backend.RestartService(ctx, svc.ID); err != nil {
+		daemon.logger.Errorf("(%s) Failed to restart service: %s", svc.Name, err)
+		daemon.publishServiceStatus(svc, statusFailed(service.OperationRestart, 500, "Failed to restart service"))
+		return err
+	}
+	daemon.logger.Debugf("(%s) Service restart successful", svc.Name)
+	daemon.metrics.serviceRestarts.WithLabelValues(svc.Name).Inc()
+	daemon.publishServiceStatus(svc, statusSucceeded(service.OperationRestart, "Restarted service container"))
+
+	// Need to re-initialize container logging
+	watch.wg.Add(1)
+	go daemon.tailLogs(watch.ctx, svc, false, &watch.wg)
+	return nil
+}
+
 func (daemon *SpawnpointDaemon) monitorEvents(ctx context.Context, svc *serviceManifest, wg *sync.WaitGroup) {
 	defer wg.Done()
 	eventChan, errChan := daemon.backend.MonitorService(ctx, svc.ID)
 	for event := range eventChan {
 		switch event {
-		case backend.Die:
+		case backend.Die, backend.Exit:
+			// Watching stopped because the container is being deliberately replaced
+			if ctx.Err() != nil {
+				continue
+			}
 			daemon.logger.Debugf("(%s) Container has died", svc.Name)
-			svc.Events <- service.Die
+			svcEvent := service.Event(service.Die)
+			if event == backend.Exit {
+				svcEvent = service.Exit
+			}
+			// The state machine may already have terminated, e.g. if this
+			// event was produced by stopping the container
+			select {
+			case svc.Events <- svcEvent:
+			case <-ctx.Done():
+			}
 
 		default:
 			daemon.logger.Warningf("(%s) Unknown event received for container", svc.Name)
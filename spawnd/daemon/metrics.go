@@ -0,0 +1,197 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "spawnd"
+
+// daemonMetrics holds the Prometheus collectors for a single daemon
+// Every series carries a "spawnpoint" label with the daemon's alias
+type daemonMetrics struct {
+	registry          *prometheus.Registry
+	hostCPUCoresUsed  prometheus.Gauge
+	hostMemAvailable  prometheus.Gauge
+	serviceCPUUsed    *prometheus.GaugeVec
+	serviceMemUsed    *prometheus.GaugeVec
+	serviceCPUShares  *prometheus.GaugeVec
+	serviceMemory     *prometheus.GaugeVec
+	serviceRestarts   *prometheus.CounterVec
+	serviceDies       *prometheus.CounterVec
+	serviceBuildTimes *prometheus.HistogramVec
+}
+
+func newDaemonMetrics(daemon *SpawnpointDaemon) *daemonMetrics {
+	constLabels := prometheus.Labels{"spawnpoint": daemon.alias}
+	svcLabels := []string{"service"}
+	metrics := daemonMetrics{
+		registry: prometheus.NewRegistry(),
+		hostCPUCoresUsed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "host_cpu_cores_used",
+			Help:        "Number of host CPU cores in use, as last measured by the daemon",
+			ConstLabels: constLabels,
+		}),
+		hostMemAvailable: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "host_memory_available_mebibytes",
+			Help:        "Host memory available, as last measured by the daemon",
+			ConstLabels: constLabels,
+		}),
+		serviceCPUUsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "service_cpu_shares_used",
+			Help:        "CPU shares consumed by a service",
+			ConstLabels: constLabels,
+		}, svcLabels),
+		serviceMemUsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "service_memory_used_mebibytes",
+			Help:        "Memory consumed by a service",
+			ConstLabels: constLabels,
+		}, svcLabels),
+		serviceCPUShares: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "service_cpu_shares_allocated",
+			Help:        "CPU shares reserved for a service",
+			ConstLabels: constLabels,
+		}, svcLabels),
+		serviceMemory: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "service_memory_allocated_mebibytes",
+			Help:        "Memory reserved for a service",
+			ConstLabels: constLabels,
+		}, svcLabels),
+		serviceRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "service_restarts_total",
+			Help:        "Number of times a service container has been restarted",
+			ConstLabels: constLabels,
+		}, svcLabels),
+		serviceDies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "service_dies_total",
+			Help:        "Number of times a service container has terminated",
+			ConstLabels: constLabels,
+		}, svcLabels),
+		serviceBuildTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "service_build_duration_seconds",
+			Help:        "Time taken to build and start a service container",
+			ConstLabels: constLabels,
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 10),
+		}, svcLabels),
+	}
+
+	// Daemon-wide reservations are read on demand rather than tracked separately
+	metrics.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "cpu_shares_total",
+			Help:        "Size of the daemon's CPU share pool",
+			ConstLabels: constLabels,
+		}, func() float64 { return float64(daemon.CPUShares) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "cpu_shares_available",
+			Help:        "CPU shares not reserved by any service",
+			ConstLabels: constLabels,
+		}, func() float64 {
+			cpuShares, _ := daemon.availableResources()
+			return float64(cpuShares)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "cpu_shares_allocated",
+			Help:        "CPU shares reserved by running services",
+			ConstLabels: constLabels,
+		}, func() float64 {
+			cpuShares, _ := daemon.availableResources()
+			return float64(daemon.CPUShares) - float64(cpuShares)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "memory_total_mebibytes",
+			Help:        "Size of the daemon's memory pool",
+			ConstLabels: constLabels,
+		}, func() float64 { return float64(daemon.Memory) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "memory_available_mebibytes",
+			Help:        "Memory not reserved by any service",
+			ConstLabels: constLabels,
+		}, func() float64 {
+			_, memory := daemon.availableResources()
+			return float64(memory)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "memory_allocated_mebibytes",
+			Help:        "Memory reserved by running services",
+			ConstLabels: constLabels,
+		}, func() float64 {
+			_, memory := daemon.availableResources()
+			return float64(daemon.Memory) - float64(memory)
+		}),
+		metrics.hostCPUCoresUsed,
+		metrics.hostMemAvailable,
+		metrics.serviceCPUUsed,
+		metrics.serviceMemUsed,
+		metrics.serviceCPUShares,
+		metrics.serviceMemory,
+		metrics.serviceRestarts,
+		metrics.serviceDies,
+		metrics.serviceBuildTimes,
+	)
+	return &metrics
+}
+
+func (daemon *SpawnpointDaemon) availableResources() (uint64, uint64) {
+	daemon.resourceLock.RLock()
+	defer daemon.resourceLock.RUnlock()
+	return daemon.availableCPUShares, daemon.availableMemory
+}
+
+func (metrics *daemonMetrics) serviceStarted(svc *serviceManifest) {
+	metrics.serviceCPUShares.WithLabelValues(svc.Name).Set(float64(svc.CPUShares))
+	metrics.serviceMemory.WithLabelValues(svc.Name).Set(float64(svc.Memory))
+}
+
+// serviceRemoved drops a service's gauges, but its counters are retained
+// so that they remain monotonic if the service is deployed again
+func (metrics *daemonMetrics) serviceRemoved(svcName string) {
+	metrics.serviceCPUUsed.DeleteLabelValues(svcName)
+	metrics.serviceMemUsed.DeleteLabelValues(svcName)
+	metrics.serviceCPUShares.DeleteLabelValues(svcName)
+	metrics.serviceMemory.DeleteLabelValues(svcName)
+}
+
+func (daemon *SpawnpointDaemon) serveMetrics(ctx context.Context) {
+	listener, err := net.Listen("tcp", daemon.MetricsAddress)
+	if err != nil {
+		daemon.logger.Errorf("Failed to start metrics listener: %s", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(daemon.metrics.registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			daemon.logger.Errorf("Failed to shut down metrics server: %s", err)
+		}
+	}()
+
+	daemon.logger.Debugf("Serving metrics on %s", daemon.MetricsAddress)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		daemon.logger.Errorf("Metrics server failed: %s", err)
+	}
+	daemon.logger.Debug("Terminating metrics server")
+}
@@ -29,6 +29,7 @@ func (daemon *SpawnpointDaemon) monitorHostResources(ctx context.Context, delay
 				continue
 			}
 			consumedCPUs := (percentages[0] / 100.0) * float64(totalCPUs)
+			daemon.metrics.hostCPUCoresUsed.Set(consumedCPUs)
 
 			memStatus, err := mem.VirtualMemoryWithContext(ctx)
 			if err != nil {
@@ -52,6 +53,7 @@ func (daemon *SpawnpointDaemon) monitorHostResources(ctx context.Context, delay
 			}
 
 			availableMem := float64(memStatus.Available) / (1024 * 1024) // Convert bytes to MiB
+			daemon.metrics.hostMemAvailable.Set(availableMem)
 			if availableMem < float64(advertisedMem) {
 				daemon.logger.Warningf("Host memory appears overloaded: %.2f MiB available while advertising %d MiB",
 					availableMem, advertisedMem)
@@ -1,42 +1,70 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
 	"github.com/pkg/errors"
 )
 
 const persistFileEnvVar = "SPAWNPOINT_PERSIST_FILE"
 const defaultPersistFileName = ".manifests"
+const defaultSnapshotRetention = 3
 
+// Snapshot files start with a header: a magic string, the format version, and a
+// SHA-256 checksum of the payload that follows. Files written before the header
+// was introduced are treated as version 0.
+const snapshotMagic = "SPWNSNAP"
+const snapshotVersion = 1
+const snapshotHeaderSize = len(snapshotMagic) + 4 + sha256.Size
+
+// snapshotEntry is the persisted form of a running service
+type snapshotEntry struct {
+	Configuration *service.Configuration
+	ID            string
+	Deployment    backend.Deployment
+}
+
+// persistSnapshots periodically compacts the journal into a new snapshot
 func (daemon *SpawnpointDaemon) persistSnapshots(ctx context.Context, delay time.Duration) {
 	tick := time.Tick(delay)
-
-	for {
+	writeRegistry := func() error {
 		daemon.logger.Debug("Snapshotting running service state to file")
-		persistFileName := os.Getenv(persistFileEnvVar)
-		if len(persistFileName) == 0 {
-			persistFileName = defaultPersistFileName
-		}
-		persistFile, err := os.Create(persistFileName)
-		if err != nil {
-			daemon.logger.Errorf("Failed to open service snapshot file: %s", err)
-			return
-		}
-
-		encoder := gob.NewEncoder(persistFile)
+		// Secrets are left out, containers retain them across restarts anyway
 		daemon.registryLock.RLock()
-		if err := encoder.Encode(daemon.serviceRegistry); err != nil {
-			daemon.logger.Errorf("Failed to encode running services: %s", err)
+		snapshot := make(map[string]*snapshotEntry, len(daemon.serviceRegistry))
+		for name, svc := range daemon.serviceRegistry {
+			if len(svc.ID) == 0 {
+				// Still waiting for its dependencies, there is no container to recover
+				continue
+			}
+			snapshot[name] = &snapshotEntry{
+				Configuration: svc.Configuration.Redacted(),
+				ID:            svc.ID,
+				Deployment:    svc.deployment,
+			}
 		}
 		daemon.registryLock.RUnlock()
+		return daemon.saveSnapshot(snapshot)
+	}
 
-		if err := persistFile.Close(); err != nil {
-			daemon.logger.Errorf("Failed to close service snapshot file: %s", err)
+	// The first snapshot is taken unconditionally, to capture the outcome of recovery
+	force := true
+	for {
+		if err := daemon.journal.compact(force, writeRegistry); err != nil {
+			daemon.logger.Errorf("Failed to compact service journal: %s", err)
 		}
+		force = false
 
 		// First check if we're done
 		select {
@@ -53,25 +81,168 @@ func (daemon *SpawnpointDaemon) persistSnapshots(ctx context.Context, delay time
 	}
 }
 
-func (daemon *SpawnpointDaemon) recoverServices(ctx context.Context) error {
-	daemon.logger.Debug("Attempting to recover previous services from snapshot")
+func (daemon *SpawnpointDaemon) saveSnapshot(snapshot map[string]*snapshotEntry) error {
+	contents, err := encodeSnapshot(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode running services")
+	}
+	return writeSnapshot(snapshotPath(), contents, daemon.SnapshotRetention)
+}
 
+func snapshotPath() string {
 	persistFileName := os.Getenv(persistFileEnvVar)
 	if len(persistFileName) == 0 {
 		persistFileName = defaultPersistFileName
 	}
-	persistFile, err := os.Open(persistFileName)
+	return persistFileName
+}
+
+// snapshotGeneration names a retained snapshot, where generation 0 is the newest
+func snapshotGeneration(path string, generation int) string {
+	if generation == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, generation)
+}
+
+func encodeSnapshot(snapshot map[string]*snapshotEntry) ([]byte, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(snapshot); err != nil {
+		return nil, errors.Wrap(err, "Failed to encode snapshot payload")
+	}
+	checksum := sha256.Sum256(payload.Bytes())
+
+	var contents bytes.Buffer
+	contents.WriteString(snapshotMagic)
+	binary.Write(&contents, binary.BigEndian, uint32(snapshotVersion))
+	contents.Write(checksum[:])
+	contents.Write(payload.Bytes())
+	return contents.Bytes(), nil
+}
+
+func decodeSnapshot(contents []byte) (map[string]*snapshotEntry, error) {
+	if !bytes.HasPrefix(contents, []byte(snapshotMagic)) {
+		return migrateSnapshot(0, contents)
+	} else if len(contents) < snapshotHeaderSize {
+		return nil, errors.New("Snapshot header is truncated")
+	}
+
+	version := binary.BigEndian.Uint32(contents[len(snapshotMagic):])
+	checksum := contents[len(snapshotMagic)+4 : snapshotHeaderSize]
+	payload := contents[snapshotHeaderSize:]
+	if actual := sha256.Sum256(payload); !bytes.Equal(checksum, actual[:]) {
+		return nil, errors.New("Snapshot checksum does not match its contents")
+	}
+	return migrateSnapshot(version, payload)
+}
+
+// migrateSnapshot decodes the payload of any known snapshot version into the current form
+func migrateSnapshot(version uint32, payload []byte) (map[string]*snapshotEntry, error) {
+	switch version {
+	case 0, 1:
+		// Version 0 has no header, but its payload is encoded in the same way as version 1
+		var snapshot map[string]*snapshotEntry
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&snapshot); err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode version %d snapshot", version)
+		}
+		return snapshot, nil
+	default:
+		return nil, fmt.Errorf("Unknown snapshot version %d", version)
+	}
+}
+
+// writeSnapshot atomically replaces the newest snapshot, keeping up to
+// retention generations in total. The new snapshot is fully written to a
+// temporary file before anything is renamed, so a crash can't leave a
+// truncated snapshot in place.
+func writeSnapshot(path string, contents []byte, retention int) error {
+	dir := filepath.Dir(path)
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
 	if err != nil {
-		return errors.Wrap(err, "Could not open service snapshot file")
+		return errors.Wrap(err, "Failed to create temporary snapshot file")
+	}
+	_, err = tmpFile.Write(contents)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "Failed to write temporary snapshot file")
+	}
+
+	for generation := retention - 1; generation > 0; generation-- {
+		older := snapshotGeneration(path, generation-1)
+		if err = os.Rename(older, snapshotGeneration(path, generation)); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmpFile.Name())
+			return errors.Wrap(err, "Failed to retain previous snapshot")
+		}
 	}
-	defer persistFile.Close()
+	if err = os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "Failed to replace snapshot file")
+	}
+
+	// Persist the renames themselves, on a best-effort basis
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
+
+// readSnapshot returns the newest retained snapshot that is intact
+// If no snapshot has been written yet, the result is empty
+func (daemon *SpawnpointDaemon) readSnapshot(path string) (map[string]*snapshotEntry, error) {
+	found := false
+	for generation := 0; generation < daemon.SnapshotRetention; generation++ {
+		fileName := snapshotGeneration(path, generation)
+		contents, err := ioutil.ReadFile(fileName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		found = true
+		if err != nil {
+			daemon.logger.Warningf("Failed to read service snapshot %s: %s", fileName, err)
+			continue
+		}
+		snapshot, err := decodeSnapshot(contents)
+		if err != nil {
+			daemon.logger.Warningf("Ignoring unusable service snapshot %s: %s", fileName, err)
+			continue
+		}
+		if generation > 0 {
+			daemon.logger.Warningf("Recovering from older service snapshot %s", fileName)
+		}
+		return snapshot, nil
+	}
+	if found {
+		return nil, errors.New("No usable service snapshot found")
+	}
+	return make(map[string]*snapshotEntry), nil
+}
 
-	decoder := gob.NewDecoder(persistFile)
-	var registry map[string]*serviceManifest
-	if err = decoder.Decode(&registry); err != nil {
-		return errors.Wrap(err, "Failed to decode service snapshot")
+func (daemon *SpawnpointDaemon) recoverServices(ctx context.Context) error {
+	daemon.logger.Debug("Attempting to recover previous services from snapshot")
+
+	snapshot, err := daemon.readSnapshot(snapshotPath())
+	if err != nil {
+		// Containers can still be reconciled from their labels
+		daemon.logger.Warningf("Recovering without a service snapshot: %s", err)
+		snapshot = make(map[string]*snapshotEntry)
+	}
+	// A torn record can only be the last one, written as the daemon went down
+	replayed, err := replayJournal(daemon.journal.path, snapshot)
+	if err != nil {
+		daemon.logger.Warningf("Ignoring remainder of service journal: %s", err)
+		// Records appended after the torn one would never be replayed
+		if err = daemon.journal.compact(true, func() error { return daemon.saveSnapshot(snapshot) }); err != nil {
+			return errors.Wrap(err, "Failed to discard damaged journal")
+		}
 	}
-	daemon.logger.Debugf("Discovered %v services in snapshot", len(registry))
+	daemon.logger.Debugf("Discovered %v services in snapshot after replaying %v journal records", len(snapshot), replayed)
 
 	runningServices, err := daemon.backend.ListServices(ctx)
 	if err != nil {
@@ -79,27 +250,90 @@ func (daemon *SpawnpointDaemon) recoverServices(ctx context.Context) error {
 	}
 	servicesAsSet := sliceToSet(runningServices)
 
-	for _, svc := range registry {
-		_, ok := servicesAsSet[svc.ID]
-		if ok {
-			// Service kept running while spawnpoint was down
-			daemon.logger.Debugf("(%s) Attempting to reassume ownership", svc.Name)
-			daemon.addService(svc, false)
-		} else {
-			// Service went down while spawnpoint was also down
-			if svc.Configuration.AutoRestart {
-				daemon.logger.Debugf("(%s) Auto-restart enabled, attempting to resurrect", svc.Name)
-				if err := daemon.backend.RestartService(ctx, svc.ID); err != nil {
-					daemon.logger.Errorf("(%s) Failed to restart service: %s", svc.Name, err)
-				} else {
-					daemon.addService(svc, false)
-				}
-			} else {
-				daemon.logger.Debugf("(%s) Auto-restart disabled, removing container", svc.Name)
-				if err := daemon.backend.RemoveService(ctx, svc.ID); err != nil {
-					daemon.logger.Errorf("(%s) Failed to remove old container: %s", svc.Name, err)
-				}
+	recovered := make(map[string]struct{}, len(snapshot))
+	known := make(map[string]struct{}, len(snapshot))
+	for _, entry := range snapshot {
+		svc := &serviceManifest{Configuration: entry.Configuration, ID: entry.ID, deployment: entry.Deployment}
+		_, running := servicesAsSet[svc.ID]
+		if daemon.recoverService(ctx, svc, running) {
+			recovered[svc.Name] = struct{}{}
+		}
+		known[svc.ID] = struct{}{}
+	}
+
+	return daemon.reconcileOrphans(ctx, known, recovered)
+}
+
+// recoverService resumes management of a service container left behind by a
+// previous run of the daemon, returning false if the container was discarded
+func (daemon *SpawnpointDaemon) recoverService(ctx context.Context, svc *serviceManifest, running bool) bool {
+	if running {
+		// Service kept running while spawnpoint was down
+		daemon.logger.Debugf("(%s) Attempting to reassume ownership", svc.Name)
+		daemon.addService(svc, false)
+		return true
+	}
+
+	// Service went down while spawnpoint was also down
+	// The exit status is unknown, so this is treated as a failure
+	if svc.EffectiveRestartPolicy().Condition != service.RestartNever {
+		daemon.logger.Debugf("(%s) Restart policy allows restart, attempting to resurrect", svc.Name)
+		if err := daemon.backend.RestartService(ctx, svc.ID); err != nil {
+			daemon.logger.Errorf("(%s) Failed to restart service: %s", svc.Name, err)
+			return false
+		}
+		daemon.addService(svc, false)
+		return true
+	}
+	daemon.logger.Debugf("(%s) Restart policy forbids restart, removing container", svc.Name)
+	if err := daemon.backend.RemoveService(ctx, svc.ID); err != nil {
+		daemon.logger.Errorf("(%s) Failed to remove old container: %s", svc.Name, err)
+	}
+	return false
+}
+
+// reconcileOrphans deals with containers this daemon created that are missing
+// from its snapshot, e.g. because the daemon went down before persisting them.
+// Depending on the orphan policy, they are either adopted based on what their
+// labels record or removed. Orphans whose service name is already in use, such
+// as the previous version kept by an interrupted update, are always removed.
+func (daemon *SpawnpointDaemon) reconcileOrphans(ctx context.Context, known map[string]struct{}, recovered map[string]struct{}) error {
+	containers, err := daemon.backend.DiscoverServices(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to discover service containers")
+	}
+
+	for _, container := range containers {
+		if _, ok := known[container.ID]; ok {
+			continue
+		}
+		if container.Manifest == nil {
+			daemon.logger.Warningf("Ignoring orphaned container %.12s with unreadable labels", container.ID)
+			continue
+		}
+		svcName := container.Manifest.Config.Name
+		_, taken := recovered[svcName]
+		if daemon.OrphanPolicy == OrphanAdopt && !taken {
+			daemon.logger.Warningf("(%s) Adopting orphaned container %.12s", svcName, container.ID)
+			svc := &serviceManifest{
+				Configuration: container.Manifest.Config,
+				ID:            container.ID,
+				deployment:    container.Manifest.Deployment,
 			}
+			if daemon.recoverService(ctx, svc, container.Running) {
+				recovered[svcName] = struct{}{}
+			}
+			continue
+		}
+
+		daemon.logger.Warningf("(%s) Removing orphaned container %.12s", svcName, container.ID)
+		if container.Running {
+			if err := daemon.backend.StopService(ctx, container.ID); err != nil {
+				daemon.logger.Errorf("(%s) Failed to stop orphaned container: %s", svcName, err)
+			}
+		}
+		if err := daemon.backend.RemoveService(ctx, container.ID); err != nil {
+			daemon.logger.Errorf("(%s) Failed to remove orphaned container: %s", svcName, err)
 		}
 	}
 	return nil
@@ -0,0 +1,165 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
+	logging "github.com/op/go-logging"
+)
+
+func newSnapshotTestDaemon(t *testing.T) (*SpawnpointDaemon, string) {
+	testDir, err := ioutil.TempDir("", "spawnd-snapshot")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %s", err)
+	}
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	daemon := &SpawnpointDaemon{
+		Config: Config{SnapshotRetention: 3},
+		logger: logging.MustGetLogger("spawnd-test"),
+	}
+	return daemon, filepath.Join(testDir, ".manifests")
+}
+
+func writeTestSnapshot(t *testing.T, path string, id string) {
+	contents, err := encodeSnapshot(map[string]*snapshotEntry{
+		"demosvc": {Configuration: &service.Configuration{Name: "demosvc"}, ID: id},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode snapshot: %s", err)
+	}
+	if err = writeSnapshot(path, contents, 3); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	daemon, path := newSnapshotTestDaemon(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for _, id := range []string{"first", "second", "third", "fourth"} {
+		writeTestSnapshot(t, path, id)
+	}
+	if _, err := os.Stat(snapshotGeneration(path, 3)); !os.IsNotExist(err) {
+		t.Fatal("More snapshots were retained than configured")
+	}
+
+	// Simulate a newest snapshot that was truncated or otherwise damaged
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+	if err = ioutil.WriteFile(path, contents[:len(contents)-1], 0600); err != nil {
+		t.Fatalf("Failed to corrupt snapshot: %s", err)
+	}
+
+	snapshot, err := daemon.readSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	} else if snapshot["demosvc"].ID != "third" {
+		t.Fatalf("Expected to fall back to the third snapshot, found %s", snapshot["demosvc"].ID)
+	}
+}
+
+func TestSnapshotLegacyFormat(t *testing.T) {
+	daemon, path := newSnapshotTestDaemon(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// Snapshots used to be a bare gob-encoded registry
+	var legacy bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(map[string]*serviceManifest{
+		"demosvc": {Configuration: &service.Configuration{Name: "demosvc"}, ID: "legacy"},
+	}); err != nil {
+		t.Fatalf("Failed to encode legacy snapshot: %s", err)
+	}
+	if err := ioutil.WriteFile(path, legacy.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write legacy snapshot: %s", err)
+	}
+
+	snapshot, err := daemon.readSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to read legacy snapshot: %s", err)
+	} else if snapshot["demosvc"].ID != "legacy" {
+		t.Fatalf("Expected legacy service ID, found %s", snapshot["demosvc"].ID)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	daemon, path := newSnapshotTestDaemon(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	journal := &serviceJournal{path: journalPath(path)}
+
+	// Changes made before a compaction end up in the snapshot
+	if err := journal.append(journalRecord{Name: "demosvc", Entry: &snapshotEntry{ID: "compacted"}}); err != nil {
+		t.Fatalf("Failed to append journal record: %s", err)
+	}
+	if err := journal.compact(false, func() error {
+		writeTestSnapshot(t, path, "compacted")
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to compact journal: %s", err)
+	}
+
+	for _, record := range []journalRecord{
+		{Name: "demosvc"},
+		{Name: "othersvc", Entry: &snapshotEntry{ID: "journaled"}},
+		{Name: "demosvc", Entry: &snapshotEntry{ID: "journaled"}},
+	} {
+		if err := journal.append(record); err != nil {
+			t.Fatalf("Failed to append journal record: %s", err)
+		}
+	}
+	// Simulate a crash part of the way through writing a record
+	if _, err := journal.file.Write([]byte{0, 0, 1}); err != nil {
+		t.Fatalf("Failed to write partial record: %s", err)
+	}
+	journal.file.Close()
+
+	snapshot, err := daemon.readSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+	replayed, err := replayJournal(journal.path, snapshot)
+	if err == nil {
+		t.Fatal("Expected partial journal record to be reported")
+	} else if replayed != 3 {
+		t.Fatalf("Expected 3 journal records to be replayed, found %d", replayed)
+	}
+	if len(snapshot) != 2 || snapshot["demosvc"].ID != "journaled" || snapshot["othersvc"].ID != "journaled" {
+		t.Fatalf("Replayed journal produced unexpected services: %v", snapshot)
+	}
+}
+
+func TestReconcileOrphans(t *testing.T) {
+	ctx := context.Background()
+	daemon, path := newSnapshotTestDaemon(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	fake := backend.NewFake("testing")
+	daemon.backend = fake
+	daemon.OrphanPolicy = OrphanRemove
+
+	knownID, err := fake.StartService(ctx, &service.Configuration{Name: "demosvc"}, backend.Deployment{}, make(chan service.BuildEvent))
+	if err != nil {
+		t.Fatalf("Failed to start known container: %s", err)
+	}
+	if _, err = fake.StartService(ctx, &service.Configuration{Name: "othersvc"}, backend.Deployment{}, make(chan service.BuildEvent)); err != nil {
+		t.Fatalf("Failed to start orphaned container: %s", err)
+	}
+
+	known := map[string]struct{}{knownID: {}}
+	if err = daemon.reconcileOrphans(ctx, known, map[string]struct{}{"demosvc": {}}); err != nil {
+		t.Fatalf("Failed to reconcile orphans: %s", err)
+	}
+	containers, err := fake.DiscoverServices(ctx)
+	if err != nil {
+		t.Fatalf("Failed to discover containers: %s", err)
+	} else if len(containers) != 1 || containers[0].ID != knownID {
+		t.Fatalf("Expected only the known container to remain, found %v", containers)
+	}
+}
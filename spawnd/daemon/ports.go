@@ -0,0 +1,118 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/pkg/errors"
+)
+
+// portRange is an inclusive range of host ports that services may publish
+// The zero value admits no ports at all
+type portRange struct {
+	min uint16
+	max uint16
+}
+
+// parsePortRange accepts either a single port or a range such as "8000-8999"
+func parsePortRange(spec string) (portRange, error) {
+	if len(spec) == 0 {
+		return portRange{}, nil
+	}
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) == 1 {
+		bounds = append(bounds, bounds[0])
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	if err != nil {
+		return portRange{}, errors.Wrap(err, "Invalid lower bound")
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+	if err != nil {
+		return portRange{}, errors.Wrap(err, "Invalid upper bound")
+	}
+	if min == 0 || min > max {
+		return portRange{}, fmt.Errorf("Invalid port range %s", spec)
+	}
+	return portRange{min: uint16(min), max: uint16(max)}, nil
+}
+
+func (ports portRange) contains(port uint16) bool {
+	return ports.min != 0 && port >= ports.min && port <= ports.max
+}
+
+func (ports portRange) String() string {
+	if ports.min == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d-%d", ports.min, ports.max)
+}
+
+// portKey identifies a host port, e.g. "8080/tcp"
+func portKey(port service.Port) string {
+	return fmt.Sprintf("%d/%s", port.Host, port.EffectiveProtocol())
+}
+
+func validatePorts(svcConfig *service.Configuration) error {
+	if len(svcConfig.Ports) > 0 && svcConfig.UseHostNet {
+		return errors.New("Ports cannot be published when using host networking")
+	}
+	seen := make(map[string]struct{})
+	for _, port := range svcConfig.Ports {
+		if port.Host == 0 || port.Container == 0 {
+			return errors.New("Host and container ports must both be specified")
+		}
+		protocol := port.EffectiveProtocol()
+		if protocol != "tcp" && protocol != "udp" {
+			return fmt.Errorf("Unknown protocol %s", port.Protocol)
+		}
+		if _, ok := seen[portKey(port)]; ok {
+			return fmt.Errorf("Host port %s is published more than once", portKey(port))
+		}
+		seen[portKey(port)] = struct{}{}
+	}
+	return nil
+}
+
+// reservePorts claims host ports for a service, failing without claiming
+// anything if any of them already belong to another service
+func (daemon *SpawnpointDaemon) reservePorts(svcName string, ports []service.Port) error {
+	daemon.portLock.Lock()
+	defer daemon.portLock.Unlock()
+	for _, port := range ports {
+		if owner, ok := daemon.portReservations[portKey(port)]; ok && owner != svcName {
+			return fmt.Errorf("Host port %s is already in use by service %s", portKey(port), owner)
+		}
+	}
+	for _, port := range ports {
+		daemon.portReservations[portKey(port)] = svcName
+	}
+	return nil
+}
+
+func (daemon *SpawnpointDaemon) releasePorts(svcName string) {
+	daemon.portLock.Lock()
+	defer daemon.portLock.Unlock()
+	for key, owner := range daemon.portReservations {
+		if owner == svcName {
+			delete(daemon.portReservations, key)
+		}
+	}
+}
+
+// resetPorts replaces all of a service's reservations with the given ports,
+// which must be a subset of those it already holds
+func (daemon *SpawnpointDaemon) resetPorts(svcName string, ports []service.Port) {
+	daemon.portLock.Lock()
+	defer daemon.portLock.Unlock()
+	for key, owner := range daemon.portReservations {
+		if owner == svcName {
+			delete(daemon.portReservations, key)
+		}
+	}
+	for _, port := range ports {
+		daemon.portReservations[portKey(port)] = svcName
+	}
+}
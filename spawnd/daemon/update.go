@@ -0,0 +1,272 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/transport"
+	"github.com/pkg/errors"
+)
+
+// pendingUpdate is an accepted update waiting to be built
+type pendingUpdate struct {
+	config     *service.Configuration
+	deployment backend.Deployment
+}
+
+// updateBuild is the outcome of building the image for an updated configuration
+type updateBuild struct {
+	pendingUpdate
+	image string
+	err   error
+}
+
+// rollbackPoint records the version of a service that an update replaced
+// Its container is stopped, but kept until the update's grace period expires, and
+// so is its resource reservation
+type rollbackPoint struct {
+	config     *service.Configuration
+	deployment backend.Deployment
+	id         string
+}
+
+func (daemon *SpawnpointDaemon) handleUpdate(name string, done <-chan struct{}) func(*transport.Message) {
+	return func(msg *transport.Message) {
+		daemon.logger.Debugf("(%s) Received service update", name)
+		select {
+		case <-done:
+			daemon.logger.Debugf("(%s) Service no longer running, message probably generated by an unsubscribe", name)
+			return
+		default:
+		}
+
+		if len(msg.Objects) == 0 || msg.Objects[0].Type() != transport.ConfigPayload {
+			daemon.logger.Debugf("(%s) Received update does not have configuration payload, ignoring", name)
+			return
+		}
+		var svcConfig service.Configuration
+		if err := msg.Objects[0].ValueInto(&svcConfig); err != nil {
+			daemon.logger.Debugf("(%s) Failed to parse updated configuration: %s", name, err)
+			return
+		}
+		// The slot a configuration arrives on determines which service it updates
+		svcConfig.Name = name
+
+		if err := daemon.updateService(&svcConfig, msg.From); err != nil {
+			daemon.publishStatus(name, statusFromError(service.OperationUpdate, err))
+		}
+	}
+}
+
+// updateService applies the host's admission checks to a new configuration
+// for a running service and, if it is accepted, hands it off to the service's
+// state machine to replace the current version in place
+func (daemon *SpawnpointDaemon) updateService(svcConfig *service.Configuration, deployedBy string) error {
+	daemon.registryLock.RLock()
+	svc, ok := daemon.serviceRegistry[svcConfig.Name]
+	var current *service.Configuration
+	if ok {
+		current = svc.Configuration
+	}
+	daemon.registryLock.RUnlock()
+	if !ok {
+		daemon.logger.Debugf("(%s) Service not found, ignoring update", svcConfig.Name)
+		return newOperationError(404, "Service not found")
+	} else if svc.currentState() == ServiceWaiting {
+		daemon.logger.Debugf("(%s) Service is waiting for dependencies, ignoring update", svcConfig.Name)
+		return newOperationError(409, "Service is waiting for its dependencies to start")
+	}
+
+	if err := daemon.admitService(svcConfig); err != nil {
+		return err
+	}
+	// Resources are checked again once the new image is ready, as they may have changed by then
+	cpuShares, memory := daemon.availableResources()
+	if svcConfig.CPUShares > cpuShares+current.CPUShares || svcConfig.Memory > memory+current.Memory {
+		daemon.logger.Debugf("(%s) Has insufficient CPU and memory for update, rejecting", svcConfig.Name)
+		return newOperationError(503, fmt.Sprintf("Insufficient resources for update. CPU: Have %v, Want %v. Mem: Have %v, Want %v",
+			cpuShares+current.CPUShares, svcConfig.CPUShares, memory+current.Memory, svcConfig.Memory))
+	}
+
+	if !svc.beginUpdate() {
+		daemon.logger.Debugf("(%s) Service is already being updated, ignoring update", svcConfig.Name)
+		return newOperationError(409, "An update of this service is already in progress")
+	}
+	// Ports of both versions stay reserved until the update completes or is rolled back
+	if err := daemon.reservePorts(svcConfig.Name, svcConfig.Ports); err != nil {
+		daemon.logger.Debugf("(%s) Port conflict: %s", svcConfig.Name, err)
+		svc.endUpdate()
+		return newOperationError(409, err.Error())
+	}
+
+	svc.updates <- pendingUpdate{config: svcConfig, deployment: daemon.newDeployment(deployedBy)}
+	return nil
+}
+
+// buildUpdate builds the image for an updated configuration in the background,
+// leaving the service's current container running in the meantime
+func (daemon *SpawnpointDaemon) buildUpdate(ctx context.Context, svc *serviceManifest, update pendingUpdate) <-chan updateBuild {
+	daemon.logger.Debugf("(%s) Attempting to build updated service", svc.Name)
+	daemon.publishServiceStatus(svc, statusProgress(service.OperationUpdate, "Building updated service..."))
+
+	results := make(chan updateBuild, 1)
+	msgs := daemon.publishBuildLog(svc.Name)
+	go func() {
+		buildStart := time.Now()
+		image, err := daemon.backend.BuildService(ctx, update.config, msgs)
+		if err == nil {
+			daemon.metrics.serviceBuildTimes.WithLabelValues(svc.Name).Observe(time.Since(buildStart).Seconds())
+		}
+		results <- updateBuild{pendingUpdate: update, image: image, err: err}
+	}()
+	return results
+}
+
+// applyUpdate swaps a service's container for one built from an updated
+// configuration. If the swap can't be made, the update is abandoned and the
+// current container is kept. An error is only returned if, having been stopped,
+// the current container could not be brought back.
+func (daemon *SpawnpointDaemon) applyUpdate(ctx context.Context, svc *serviceManifest, build updateBuild) (*rollbackPoint, error) {
+	previous := &rollbackPoint{config: svc.Configuration, deployment: svc.deployment, id: svc.ID}
+	if err := daemon.reserveUpdate(previous.config, build.config); err != nil {
+		daemon.logger.Debugf("(%s) Has insufficient CPU and memory for update, abandoning", svc.Name)
+		daemon.abandonUpdate(svc, statusFailed(service.OperationUpdate, 503, fmt.Sprintf("%s, keeping current version", err)))
+		return nil, nil
+	}
+
+	if err := daemon.backend.StopService(ctx, previous.id); err != nil {
+		daemon.logger.Errorf("(%s) Failed to stop service for update: %s", svc.Name, err)
+		daemon.releaseUpdate(build.config, previous.config)
+		daemon.abandonUpdate(svc, statusFailed(service.OperationUpdate, 500, "Failed to stop service for update, keeping current version"))
+		return nil, nil
+	}
+	newID, err := daemon.backend.RunService(ctx, build.config, build.deployment, build.image)
+	if err != nil {
+		daemon.logger.Errorf("(%s) Failed to start updated service: %s", svc.Name, err)
+		daemon.releaseUpdate(build.config, previous.config)
+		msg := fmt.Sprintf("Failed to start updated service, reverting to previous version: %s", err)
+		daemon.abandonUpdate(svc, statusFailed(service.OperationUpdate, 500, msg))
+		return nil, daemon.restorePrevious(ctx, svc)
+	}
+
+	daemon.registryLock.Lock()
+	svc.Configuration = build.config
+	svc.deployment = build.deployment
+	svc.ID = newID
+	daemon.registryLock.Unlock()
+	daemon.journalService(svc)
+	daemon.recordSourceCommit(ctx, svc)
+	daemon.metrics.serviceStarted(svc)
+	daemon.logger.Debugf("(%s) Updated service started successfully", svc.Name)
+	msg := fmt.Sprintf("Updated service container has started, previous version is retained for %s", daemon.UpdateGracePeriod)
+	daemon.publishServiceStatus(svc, statusSucceeded(service.OperationUpdate, msg))
+	return previous, nil
+}
+
+// abandonUpdate gives up on an update before its container has replaced the current one
+func (daemon *SpawnpointDaemon) abandonUpdate(svc *serviceManifest, status service.ServiceStatus) {
+	daemon.publishServiceStatus(svc, status)
+	daemon.resetPorts(svc.Name, svc.Ports)
+	svc.endUpdate()
+}
+
+// rollbackUpdate discards an updated container and restores the version it replaced
+func (daemon *SpawnpointDaemon) rollbackUpdate(ctx context.Context, svc *serviceManifest, previous *rollbackPoint) error {
+	daemon.logger.Debugf("(%s) Rolling back update", svc.Name)
+	if err := daemon.backend.RemoveService(ctx, svc.ID); err != nil {
+		daemon.logger.Errorf("(%s) Failed to remove updated service: %s", svc.Name, err)
+	}
+	daemon.releaseUpdate(svc.Configuration, previous.config)
+	daemon.registryLock.Lock()
+	svc.Configuration = previous.config
+	svc.deployment = previous.deployment
+	svc.ID = previous.id
+	daemon.registryLock.Unlock()
+	daemon.journalService(svc)
+	daemon.recordSourceCommit(ctx, svc)
+	daemon.metrics.serviceStarted(svc)
+	daemon.resetPorts(svc.Name, previous.config.Ports)
+	svc.endUpdate()
+
+	msg := fmt.Sprintf("Updated service terminated within %s, rolling back to previous version", daemon.UpdateGracePeriod)
+	daemon.publishServiceStatus(svc, statusFailed(service.OperationUpdate, 500, msg))
+	return daemon.restorePrevious(ctx, svc)
+}
+
+// commitUpdate discards the version of a service that an update replaced
+func (daemon *SpawnpointDaemon) commitUpdate(ctx context.Context, svc *serviceManifest, previous *rollbackPoint) {
+	daemon.logger.Debugf("(%s) Update grace period has elapsed, removing previous version", svc.Name)
+	if err := daemon.backend.RemoveService(ctx, previous.id); err != nil {
+		daemon.logger.Errorf("(%s) Failed to remove previous version of service: %s", svc.Name, err)
+	}
+	daemon.releaseUpdate(previous.config, svc.Configuration)
+	daemon.resetPorts(svc.Name, svc.Ports)
+	svc.endUpdate()
+	daemon.publishServiceStatus(svc, statusSucceeded(service.OperationUpdate, "Service update completed"))
+}
+
+// reserveUpdate reserves whatever an updated configuration needs beyond the
+// current version's reservation, which is kept in full until the update is
+// committed or rolled back. It fails without changing anything if the host
+// cannot accommodate the difference.
+func (daemon *SpawnpointDaemon) reserveUpdate(current, updated *service.Configuration) error {
+	daemon.resourceLock.Lock()
+	defer daemon.resourceLock.Unlock()
+	cpuShares := excess(updated.CPUShares, current.CPUShares)
+	memory := excess(updated.Memory, current.Memory)
+	if cpuShares > daemon.availableCPUShares || memory > daemon.availableMemory {
+		return fmt.Errorf("Insufficient resources for update. CPU: Have %v, Want %v. Mem: Have %v, Want %v",
+			daemon.availableCPUShares+current.CPUShares, updated.CPUShares, daemon.availableMemory+current.Memory, updated.Memory)
+	}
+	daemon.availableCPUShares -= cpuShares
+	daemon.availableMemory -= memory
+	return nil
+}
+
+// releaseUpdate gives back the part of an update's reservation that only the
+// version being discarded needed, leaving the reservation of the version being kept
+func (daemon *SpawnpointDaemon) releaseUpdate(discarded, kept *service.Configuration) {
+	daemon.resourceLock.Lock()
+	daemon.availableCPUShares += excess(discarded.CPUShares, kept.CPUShares)
+	daemon.availableMemory += excess(discarded.Memory, kept.Memory)
+	daemon.resourceLock.Unlock()
+}
+
+// excess is the amount by which a exceeds b, or 0 if it doesn't
+func excess(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return 0
+}
+
+// restorePrevious restarts the stopped container of the version an update replaced
+// Its logs and events are watched again by the caller
+func (daemon *SpawnpointDaemon) restorePrevious(ctx context.Context, svc *serviceManifest) error {
+	if err := daemon.backend.RestartService(ctx, svc.ID); err != nil {
+		daemon.logger.Errorf("(%s) Failed to restart previous version of service: %s", svc.Name, err)
+		daemon.publishServiceStatus(svc, statusFailed(service.OperationUpdate, 500, "Failed to restart previous version of service"))
+		return errors.Wrap(err, "Failed to restart previous version of service")
+	}
+	daemon.logger.Debugf("(%s) Previous version of service restarted", svc.Name)
+	return nil
+}
+
+func (svc *serviceManifest) beginUpdate() bool {
+	svc.heartbeatLock.Lock()
+	defer svc.heartbeatLock.Unlock()
+	if svc.updating {
+		return false
+	}
+	svc.updating = true
+	return true
+}
+
+func (svc *serviceManifest) endUpdate() {
+	svc.heartbeatLock.Lock()
+	svc.updating = false
+	svc.heartbeatLock.Unlock()
+}
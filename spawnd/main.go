@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -33,6 +34,22 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:   "gc",
+			Usage:  "Remove images and volumes that services no longer use",
+			Action: actionGC,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "Specify a configuration file for the daemon",
+					Value: "config.yml",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only report what would be removed",
+				},
+			},
+		},
 		{
 			Name:   "decommission",
 			Usage:  "Decomission a spawnpoint daemon",
@@ -98,3 +115,48 @@ func actionDecommission(c *cli.Context) error {
 	}
 	return spawnpointDaemon.Decommission()
 }
+
+func actionGC(c *cli.Context) error {
+	log := util.InitLogger("spawnd")
+	var config daemon.Config
+	configFile := c.String("config")
+	configContents, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		log.Fatalf("Failed to read configuration file %s: %s", configFile, err)
+	}
+	if err = yaml.Unmarshal(configContents, &config); err != nil {
+		log.Fatalf("Failed to parse configuration YAML: %s", err)
+	}
+
+	spawnpointDaemon, err := daemon.New(&config, log)
+	if err != nil {
+		log.Fatalf("Failed to initialize spawnd: %s", err)
+	}
+	report, err := spawnpointDaemon.CollectGarbage(context.Background(), c.Bool("dry-run"))
+	if err != nil {
+		log.Fatalf("Failed to collect garbage: %s", err)
+	}
+
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	for _, artifact := range report.Removed {
+		fmt.Printf("%s %s %s\n", verb, artifact.Kind, artifact.Name)
+	}
+	fmt.Printf("%s %d images and volumes, reclaiming %s\n", verb, len(report.Removed), formatBytes(report.Reclaimed))
+	return nil
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -1,40 +1,98 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/SoftwareDefinedBuildings/spawnpoint/service"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnclient"
+	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/backend"
 	"github.com/SoftwareDefinedBuildings/spawnpoint/spawnd/daemon"
 	logging "github.com/op/go-logging"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const spawnpointURI = "scratch.ns/spawnpoint/testing"
-const bw2Entity = "testing/test.ent"
 const totalCPUShares = 1024
 const totalMemory = 1024
 
 var spawnClient *spawnclient.Client
+var fakeBackend *backend.Fake
+var apiClient *http.Client
+var metricsAddress string
+
+// Paths of files created for the test run
+var bw2Entity string
+var paramsFile string
 
 func TestMain(m *testing.M) {
 	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
 	var err error
 
+	// Services only need an entity file to exist, its contents are never used by the fake backend
+	testDir, err := ioutil.TempDir("", "spawnd-test")
+	if err != nil {
+		fmt.Printf("Failed to create test directory: %s\n", err)
+		os.Exit(1)
+	}
+	bw2Entity = filepath.Join(testDir, "test.ent")
+	paramsFile = filepath.Join(testDir, "params.yml")
+	for _, fileName := range []string{bw2Entity, paramsFile} {
+		if err = ioutil.WriteFile(fileName, []byte("testing"), 0600); err != nil {
+			fmt.Printf("Failed to create test file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	os.Setenv("SPAWNPOINT_PERSIST_FILE", filepath.Join(testDir, ".manifests"))
+	apiSocket := filepath.Join(testDir, "spawnd.sock")
+	apiClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", apiSocket)
+			},
+		},
+	}
+
+	// Reserve a free port for the metrics listener
+	metricsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("Failed to reserve metrics port: %s\n", err)
+		os.Exit(1)
+	}
+	metricsAddress = metricsListener.Addr().String()
+	metricsListener.Close()
+
 	config := daemon.Config{
-		BW2Entity:            bw2Entity,
-		BW2Agent:             "172.17.0.1:28589",
 		Path:                 spawnpointURI,
 		CPUShares:            totalCPUShares,
 		Memory:               totalMemory,
+		Backend:              "fake",
+		Transport:            "loopback",
 		EnableHostNetworking: false,
 		EnableDeviceMapping:  false,
+		APIAddress:           "unix:" + apiSocket,
+		MetricsAddress:       metricsAddress,
+		AllowedPorts:         "8000-8099",
+		UpdateGracePeriod:    500 * time.Millisecond,
+		Labels:               map[string]string{"arch": "amd64"},
 	}
 	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
 	log := logging.MustGetLogger("spawnd-test")
@@ -43,12 +101,8 @@ func TestMain(m *testing.M) {
 		fmt.Printf("Failed to initialize spawnpoint daemon: %s\n", err)
 		os.Exit(1)
 	}
-
-	spawnClient, err = spawnclient.New("172.17.0.1:28589", "testing/test.ent")
-	if err != nil {
-		fmt.Printf("Failed to initialize spawnpoint client: %s\n", err)
-		os.Exit(1)
-	}
+	fakeBackend = spawnpointDaemon.Backend().(*backend.Fake)
+	spawnClient = spawnclient.NewLoopback()
 
 	wg.Add(1)
 	go func() {
@@ -59,6 +113,7 @@ func TestMain(m *testing.M) {
 	retCode := m.Run()
 	cancel()
 	wg.Wait()
+	os.RemoveAll(testDir)
 	os.Exit(retCode)
 }
 
@@ -74,7 +129,7 @@ func TestSimpleDeploy(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
@@ -87,13 +142,13 @@ func TestSimpleDeploy(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
 		t.Fatalf("Failed to deploy service: %s", err)
 	}
 	awaitSuccess(t, logChan, errChan, 1)
 
 	t.Log("Stopping service...")
-	if err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
+	if _, err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
 		t.Fatalf("Failed to stop service: %s", err)
 	}
 	awaitSuccess(t, logChan, errChan, 2)
@@ -111,7 +166,7 @@ func TestSimpleRestart(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
@@ -124,19 +179,19 @@ func TestSimpleRestart(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
 		t.Fatalf("Failed to deploy service: %s", err)
 	}
 	awaitSuccess(t, logChan, errChan, 1)
 
 	t.Log("Restarting service...")
-	if err := spawnClient.Restart(spawnpointURI, "demosvc"); err != nil {
+	if _, err := spawnClient.Restart(spawnpointURI, "demosvc"); err != nil {
 		t.Fatalf("Failed to restart service: %s", err)
 	}
 	awaitSuccess(t, logChan, errChan, 1)
 
 	t.Log("Stopping service...")
-	if err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
+	if _, err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
 		t.Fatalf("Failed to stop service: %s", err)
 	}
 	awaitSuccess(t, logChan, errChan, 2)
@@ -154,7 +209,7 @@ func TestDuplicateDeploy(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
@@ -167,24 +222,63 @@ func TestDuplicateDeploy(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
 		t.Fatalf("Failed to deploy service: %s", err)
 	}
 	awaitSuccess(t, logChan, errChan, 1)
 
 	t.Log("Deploying duplicate service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
-		t.Fatalf("Failed to deploy service: %s", err)
-	}
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 409)
 	awaitFailure(t, logChan, errChan, 409)
 
 	t.Log("Stopping service...")
-	if err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
+	if _, err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
 		t.Fatalf("Failed to stop service: %s", err)
 	}
 	awaitSuccess(t, logChan, errChan, 2)
 }
 
+// Follow a deployment through typed statuses rather than the service log
+func TestDeployStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:      "statussvc",
+		BW2Entity: bw2Entity,
+		CPUShares: 128,
+		Memory:    128,
+		Run:       []string{"./statussvc"},
+	}
+
+	statusChan, errChan := spawnClient.WatchStatus(ctx, "statussvc", spawnpointURI)
+	status, err := spawnClient.Deploy(&config, spawnpointURI)
+	if err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	} else if status.Operation != service.OperationDeploy || status.Phase != service.PhaseProgress || status.Code != 202 {
+		t.Fatalf("Unexpected deploy acknowledgement: %v", status)
+	}
+	for status.Phase != service.PhaseSucceeded {
+		select {
+		case *status = <-statusChan:
+		case err := <-errChan:
+			t.Fatalf("Failed to watch service status: %s", err)
+		}
+	}
+	if status.Operation != service.OperationDeploy || len(status.ServiceID) == 0 || status.Timestamp == 0 {
+		t.Fatalf("Unexpected deploy status: %v", status)
+	}
+
+	_, err = spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 409)
+
+	if status, err = spawnClient.Stop(spawnpointURI, "statussvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	} else if status.Operation != service.OperationStop || status.Phase != service.PhaseSucceeded {
+		t.Fatalf("Unexpected stop status: %v", status)
+	}
+}
+
 // Attempt to deploy service with too many CPU shares requested
 func TestDeployExcessiveCPU(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -197,7 +291,7 @@ func TestDeployExcessiveCPU(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
@@ -210,9 +304,8 @@ func TestDeployExcessiveCPU(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
-		t.Fatalf("Failed to deploy service: %s", err)
-	}
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 503)
 	awaitFailure(t, logChan, errChan, 503)
 }
 
@@ -228,7 +321,7 @@ func TestDeployExcessiveMemory(t *testing.T) {
 		Memory:        totalMemory + 1,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
@@ -241,9 +334,8 @@ func TestDeployExcessiveMemory(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
-		t.Fatalf("Failed to deploy service: %s", err)
-	}
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 503)
 	awaitFailure(t, logChan, errChan, 503)
 }
 
@@ -259,7 +351,7 @@ func TestDeployExcessiveCPUMemory(t *testing.T) {
 		Memory:        totalMemory + 1,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
@@ -272,9 +364,8 @@ func TestDeployExcessiveCPUMemory(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
-		t.Fatalf("Failed to deploy service: %s", err)
-	}
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 503)
 	awaitFailure(t, logChan, errChan, 503)
 }
 
@@ -290,7 +381,7 @@ func TestDeployOversubscribed(t *testing.T) {
 		Memory:        totalMemory,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
@@ -303,7 +394,7 @@ func TestDeployOversubscribed(t *testing.T) {
 	}
 
 	t.Log("Deploying first service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
 		t.Fatalf("Failed to deploy service: %s", err)
 	}
 	awaitSuccess(t, logChan1, errChan1, 1)
@@ -318,12 +409,11 @@ func TestDeployOversubscribed(t *testing.T) {
 
 	t.Log("Deploying second service...")
 	config.Name = "demosvc2"
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
-		t.Fatalf("Failed to deploy service: %s", err)
-	}
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 503)
 	awaitFailure(t, logChan2, errChan2, 503)
 
-	if err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
+	if _, err := spawnClient.Stop(spawnpointURI, "demosvc"); err != nil {
 		t.Fatalf("Failed to stop service: %s", err)
 	}
 	awaitSuccess(t, logChan1, errChan1, 2)
@@ -339,12 +429,12 @@ func TestDeployInvalidCPU(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err == nil {
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err == nil {
 		t.Fatalf("Expected error with invalid CPU shares: %v", config.CPUShares)
 	}
 }
@@ -359,12 +449,12 @@ func TestDeployInvalidMemory(t *testing.T) {
 		Memory:        0,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err == nil {
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err == nil {
 		t.Fatalf("Expected error with invalid memory allocation: %v", config.Memory)
 	}
 }
@@ -379,12 +469,12 @@ func TestDeployInvalidCPUMemory(t *testing.T) {
 		Memory:        0,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err == nil {
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err == nil {
 		t.Fatalf("Expected error with invalid CPU shares %v and memory allocation %v",
 			config.CPUShares, config.Memory)
 	}
@@ -402,7 +492,7 @@ func TestDeployHostNetworking(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 		UseHostNet:    true,
 	}
@@ -415,9 +505,8 @@ func TestDeployHostNetworking(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
-		t.Fatalf("Failed to deploy service: %s", err)
-	}
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 403)
 	awaitFailure(t, logChan, errChan, 403)
 }
 
@@ -433,7 +522,7 @@ func TestDeployDevices(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 		Devices:       []string{"/dev/tty0"},
 	}
@@ -446,10 +535,190 @@ func TestDeployDevices(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 403)
+	awaitFailure(t, logChan, errChan, 403)
+}
+
+// Services may only run on hosts whose labels satisfy their constraints
+func TestConstraints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:        "constrainedsvc",
+		BW2Entity:   bw2Entity,
+		CPUShares:   128,
+		Memory:      128,
+		Run:         []string{"./constrainedsvc"},
+		Constraints: map[string]string{"arch": "arm64"},
+	}
+
+	if spawnpoints, err := spawnClient.ScanMatching(spawnpointURI, config.Constraints); err != nil {
+		t.Fatalf("Failed to scan for spawnpoints: %s", err)
+	} else if len(spawnpoints) > 0 {
+		t.Fatalf("Expected no spawnpoints to satisfy constraints, found %v", spawnpoints)
+	}
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 412)
+
+	config.Constraints["arch"] = "amd64"
+	if spawnpoints, err := spawnClient.ScanMatching(spawnpointURI, config.Constraints); err != nil {
+		t.Fatalf("Failed to scan for spawnpoints: %s", err)
+	} else if hb, ok := spawnpoints[spawnpointURI]; !ok || hb.Labels["arch"] != "amd64" {
+		t.Fatalf("Expected spawnpoint to satisfy constraints, found %v", spawnpoints)
+	}
+	logChan, errChan := spawnClient.Tail(ctx, "constrainedsvc", spawnpointURI)
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
 		t.Fatalf("Failed to deploy service: %s", err)
 	}
-	awaitFailure(t, logChan, errChan, 403)
+	awaitSuccess(t, logChan, errChan, 1)
+	if _, err := spawnClient.Stop(spawnpointURI, "constrainedsvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+}
+
+// Stacks are started in order, rolled back if a service fails, and torn down in reverse
+func TestStack(t *testing.T) {
+	stackService := func(name string, cpuShares uint64) spawnclient.StackService {
+		return spawnclient.StackService{
+			Spawnpoint: spawnpointURI,
+			Service: service.Configuration{
+				Name:      name,
+				BW2Entity: bw2Entity,
+				CPUShares: cpuShares,
+				Memory:    128,
+				Run:       []string{"./" + name},
+			},
+		}
+	}
+	stack := spawnclient.Stack{
+		Name:     "teststack",
+		Services: []spawnclient.StackService{stackService("cachesvc", 128), stackService("consumersvc", 128)},
+	}
+	if err := spawnclient.ValidateStack(&stack); err != nil {
+		t.Fatalf("Invalid stack: %s", err)
+	}
+
+	results, err := spawnClient.StackUp(&stack)
+	if err != nil {
+		t.Fatalf("Failed to bring up stack: %s", err)
+	}
+	for _, result := range results {
+		if result.Err != nil || result.Status == nil || result.Status.Phase != service.PhaseSucceeded {
+			t.Fatalf("Unexpected result for %s: %v", result.Name, result)
+		}
+	}
+	results, err = spawnClient.StackDown(&stack)
+	if err != nil {
+		t.Fatalf("Failed to tear down stack: %s", err)
+	} else if results[0].Name != "consumersvc" || results[1].Name != "cachesvc" {
+		t.Fatalf("Expected stack to be torn down in reverse order, found %v", results)
+	}
+
+	// A service that can't start takes the services before it down with it
+	stack.Services = []spawnclient.StackService{
+		stackService("loadersvc", 128), stackService("greedysvc", totalCPUShares+1), stackService("readersvc", 128),
+	}
+	results, err = spawnClient.StackUp(&stack)
+	if err == nil {
+		t.Fatal("Expected stack with oversized service to fail")
+	}
+	awaitOperationError(t, results[1].Err, 503)
+	if !strings.HasPrefix(results[0].Detail, "Stopped after failure") || results[2].Detail != "Not deployed" {
+		t.Fatalf("Unexpected results after failure: %v", results)
+	}
+	if id, _ := fakeBackend.LookupService("loadersvc"); fakeBackend.IsRunning(id) {
+		t.Fatal("Service started before failure is still running")
+	}
+
+	// A service whose host port is taken fails rather than being taken for already running
+	holder := service.Configuration{Name: "portholdersvc", BW2Entity: bw2Entity, CPUShares: 128, Memory: 128,
+		Run: []string{"./portholdersvc"}, Ports: []service.Port{{Host: 8090, Container: 80}}}
+	if _, err = spawnClient.DeployAndWait(&holder, spawnpointURI); err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	clashing := stackService("clashingsvc", 128)
+	clashing.Service.Ports = []service.Port{{Host: 8090, Container: 80}}
+	stack.Services = []spawnclient.StackService{stackService("listenersvc", 128), clashing}
+	results, err = spawnClient.StackUp(&stack)
+	if err == nil {
+		t.Fatal("Expected stack with clashing port to fail")
+	}
+	awaitOperationError(t, results[1].Err, 409)
+	if !strings.HasPrefix(results[0].Detail, "Stopped after failure") {
+		t.Fatalf("Unexpected results after port clash: %v", results)
+	}
+	if _, err = spawnClient.Stop(spawnpointURI, "portholdersvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+}
+
+// Services wait for their dependencies to start, and may be stopped along with them
+func TestDependencies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := service.Configuration{
+		Name:      "localcachesvc",
+		BW2Entity: bw2Entity,
+		CPUShares: 128,
+		Memory:    128,
+		Run:       []string{"./localcachesvc"},
+	}
+	consumer := service.Configuration{
+		Name:                 "cacheconsumersvc",
+		BW2Entity:            bw2Entity,
+		CPUShares:            128,
+		Memory:               128,
+		Run:                  []string{"./cacheconsumersvc"},
+		DependsOn:            []string{"localcachesvc"},
+		StopWithDependencies: true,
+	}
+
+	logChan, errChan := spawnClient.Tail(ctx, "cacheconsumersvc", spawnpointURI)
+	status, err := spawnClient.Deploy(&consumer, spawnpointURI)
+	if err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	} else if !strings.HasPrefix(status.Message, "Waiting for dependencies") {
+		t.Fatalf("Expected service to wait for its dependencies, found %s", status)
+	}
+	var hb daemon.ServiceHeartbeat
+	if err = json.Unmarshal(awaitAPI(t, "GET", "/services/cacheconsumersvc/heartbeat", nil, http.StatusOK), &hb); err != nil {
+		t.Fatalf("Failed to decode service heartbeat: %s", err)
+	} else if hb.State != daemon.ServiceWaiting {
+		t.Fatalf("Expected waiting service, found %s", hb.State)
+	}
+	if _, ok := fakeBackend.LookupService("cacheconsumersvc"); ok {
+		t.Fatal("Service started before its dependencies")
+	}
+	_, err = spawnClient.Deploy(&consumer, spawnpointURI)
+	awaitOperationError(t, err, 409)
+
+	// A dependency can't in turn depend on its dependents
+	cache.DependsOn = []string{"cacheconsumersvc"}
+	_, err = spawnClient.Deploy(&cache, spawnpointURI)
+	awaitOperationError(t, err, 400)
+
+	cache.DependsOn = nil
+	if _, err = spawnClient.Deploy(&cache, spawnpointURI); err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	awaitLog(t, logChan, errChan, "[SUCCESS] Service container has started")
+
+	if _, err = spawnClient.Stop(spawnpointURI, "localcachesvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+
+	// A service can be stopped while it waits
+	_, err = spawnClient.Deploy(&consumer, spawnpointURI)
+	if err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	if status, err = spawnClient.Stop(spawnpointURI, "cacheconsumersvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	} else if status.Phase != service.PhaseSucceeded {
+		t.Fatalf("Expected waiting service to stop, found %s", status)
+	}
 }
 
 // Attempt to deploy a service with host networking and mapped devices, which aren't allowed
@@ -464,7 +733,7 @@ func TestDeployHostNetDevices(t *testing.T) {
 		Memory:        totalMemory / 2,
 		Build:         []string{"go get -d", "go build -o demosvc"},
 		Run:           []string{"./demosvc", "200"},
-		IncludedFiles: []string{"testing/params.yml"},
+		IncludedFiles: []string{paramsFile},
 		AutoRestart:   false,
 		UseHostNet:    true,
 		Devices:       []string{"/dev/tty0"},
@@ -478,10 +747,605 @@ func TestDeployHostNetDevices(t *testing.T) {
 	}
 
 	t.Log("Deploying service...")
-	if err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 403)
+	awaitFailure(t, logChan, errChan, 403)
+}
+
+// Attempt to deploy service that overrides a variable set by Spawnpoint
+func TestDeployReservedEnvironment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:        "demosvc",
+		BW2Entity:   bw2Entity,
+		CPUShares:   totalCPUShares / 2,
+		Memory:      totalMemory / 2,
+		Run:         []string{"./demosvc", "200"},
+		Environment: map[string]string{"LOG_LEVEL": "debug"},
+		Secrets:     []service.Secret{{Name: "BW2_AGENT", Value: "127.0.0.1:28589"}},
+	}
+
+	logChan, errChan := spawnClient.Tail(ctx, "demosvc", spawnpointURI)
+	_, err := spawnClient.Deploy(&config, spawnpointURI)
+	awaitOperationError(t, err, 400)
+	awaitFailure(t, logChan, errChan, 400)
+}
+
+// Service that keeps failing is eventually marked as crash-looping
+func TestCrashLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:      "crashsvc",
+		BW2Entity: bw2Entity,
+		CPUShares: totalCPUShares / 4,
+		Memory:    totalMemory / 4,
+		Run:       []string{"./crashsvc"},
+		RestartPolicy: &service.RestartPolicy{
+			Condition:      service.RestartOnFailure,
+			MaxRetries:     2,
+			InitialBackoff: 10 * time.Millisecond,
+		},
+	}
+
+	// Negative durations would defeat the backoff and retry limit
+	for _, policy := range []service.RestartPolicy{
+		{Condition: service.RestartOnFailure, InitialBackoff: -time.Second},
+		{Condition: service.RestartOnFailure, MaxBackoff: -time.Second},
+		{Condition: service.RestartOnFailure, ResetWindow: -time.Second},
+	} {
+		invalid := config
+		invalid.RestartPolicy = &policy
+		_, err := spawnClient.Deploy(&invalid, spawnpointURI)
+		awaitOperationError(t, err, 400)
+	}
+
+	logChan, errChan := spawnClient.Tail(ctx, "crashsvc", spawnpointURI)
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
 		t.Fatalf("Failed to deploy service: %s", err)
 	}
-	awaitFailure(t, logChan, errChan, 403)
+	awaitSuccess(t, logChan, errChan, 1)
+
+	for i := 0; i < 2; i++ {
+		killService(t, "crashsvc")
+		awaitSuccess(t, logChan, errChan, 1)
+	}
+	killService(t, "crashsvc")
+	awaitFailure(t, logChan, errChan, 500)
+
+	var hb daemon.ServiceHeartbeat
+	if err := json.Unmarshal(awaitAPI(t, "GET", "/services/crashsvc/heartbeat", nil, http.StatusOK), &hb); err != nil {
+		t.Fatalf("Failed to decode service heartbeat: %s", err)
+	} else if hb.State != daemon.ServiceCrashLooping {
+		t.Fatalf("Expected crash-looping service, found %s", hb.State)
+	}
+
+	// An explicit restart is still honored
+	if _, err := spawnClient.Restart(spawnpointURI, "crashsvc"); err != nil {
+		t.Fatalf("Failed to restart service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+	if _, err := spawnClient.Stop(spawnpointURI, "crashsvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 2)
+}
+
+// Service that exits cleanly is not restarted under an on-failure policy
+func TestRestartOnFailureCleanExit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:      "exitsvc",
+		BW2Entity: bw2Entity,
+		CPUShares: totalCPUShares / 4,
+		Memory:    totalMemory / 4,
+		Run:       []string{"./exitsvc"},
+		RestartPolicy: &service.RestartPolicy{
+			Condition: service.RestartOnFailure,
+		},
+	}
+
+	logChan, errChan := spawnClient.Tail(ctx, "exitsvc", spawnpointURI)
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+
+	id := awaitMonitored(t, "exitsvc")
+	if err := fakeBackend.InjectExit(id); err != nil {
+		t.Fatalf("Failed to inject exit: %s", err)
+	}
+	// Only the removal of the container follows
+	awaitSuccess(t, logChan, errChan, 1)
+	if fakeBackend.IsRunning(id) {
+		t.Fatal("Service container was restarted")
+	}
+}
+
+// Unhealthy service is restarted when its health check calls for it
+func TestHealthCheckRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:      "healthsvc",
+		BW2Entity: bw2Entity,
+		CPUShares: totalCPUShares / 4,
+		Memory:    totalMemory / 4,
+		Run:       []string{"./healthsvc"},
+		HealthCheck: &service.HealthCheck{
+			Command:          []string{"./healthcheck"},
+			Interval:         10 * time.Millisecond,
+			Retries:          2,
+			RestartUnhealthy: true,
+		},
+	}
+
+	// Negative durations are rejected rather than crashing the daemon
+	for _, check := range []service.HealthCheck{
+		{Command: []string{"./healthcheck"}, Interval: -time.Second},
+		{Command: []string{"./healthcheck"}, Timeout: -time.Second},
+	} {
+		invalid := config
+		invalid.HealthCheck = &check
+		_, err := spawnClient.Deploy(&invalid, spawnpointURI)
+		awaitOperationError(t, err, 400)
+	}
+
+	logChan, errChan := spawnClient.Tail(ctx, "healthsvc", spawnpointURI)
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+	awaitHealth(t, "healthsvc", daemon.HealthHealthy)
+
+	id, _ := fakeBackend.LookupService("healthsvc")
+	if err := fakeBackend.InjectExecResult(id, 1); err != nil {
+		t.Fatalf("Failed to inject health check failure: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+	fakeBackend.InjectExecResult(id, 0)
+	awaitHealth(t, "healthsvc", daemon.HealthHealthy)
+
+	if _, err := spawnClient.Stop(spawnpointURI, "healthsvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+	// Further restarts may have been triggered before the health check recovered
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+}
+
+// Attempt to deploy services whose host ports clash or fall outside the allowed range
+func TestPortConflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := []byte(`{"name": "portsvc1", "bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128, "run": ["./portsvc"],
+		"ports": [{"host": 8080, "container": 80}]}`)
+	conflicting := []byte(`{"name": "portsvc2", "bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128, "run": ["./portsvc"],
+		"ports": [{"host": 8081, "container": 80}, {"host": 8080, "container": 8080}]}`)
+	disallowed := []byte(`{"name": "portsvc3", "bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128, "run": ["./portsvc"],
+		"ports": [{"host": 9000, "container": 80}]}`)
+
+	logChan, errChan := spawnClient.Tail(ctx, "portsvc1", spawnpointURI)
+	awaitAPI(t, "POST", "/services", first, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+	awaitAPI(t, "POST", "/services", conflicting, http.StatusConflict)
+	awaitAPI(t, "POST", "/services", disallowed, http.StatusForbidden)
+
+	// Ports are available again once their service has stopped
+	awaitAPI(t, "POST", "/services/portsvc1/stop", nil, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 2)
+	secondLogChan, secondErrChan := spawnClient.Tail(ctx, "portsvc2", spawnpointURI)
+	awaitAPI(t, "POST", "/services", conflicting, http.StatusAccepted)
+	awaitSuccess(t, secondLogChan, secondErrChan, 1)
+	awaitAPI(t, "POST", "/services/portsvc2/stop", nil, http.StatusAccepted)
+	awaitSuccess(t, secondLogChan, secondErrChan, 2)
+}
+
+// Update a running service in place, replacing its container once the new one is up
+func TestUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:      "updatesvc",
+		BW2Entity: bw2Entity,
+		CPUShares: 128,
+		Memory:    128,
+		Run:       []string{"./updatesvc"},
+	}
+
+	logChan, errChan := spawnClient.Tail(ctx, "updatesvc", spawnpointURI)
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+	oldID := awaitMonitored(t, "updatesvc")
+	oldManifest, err := fakeBackend.InspectService(ctx, oldID)
+	if err != nil {
+		t.Fatalf("Failed to inspect service container: %s", err)
+	} else if oldManifest.Path != spawnpointURI || oldManifest.Config.CPUShares != 128 || len(oldManifest.Config.BW2Entity) > 0 {
+		t.Fatalf("Service container has unexpected manifest: %v", oldManifest)
+	}
+
+	config.CPUShares = 256
+	if _, err := spawnClient.Update(&config, spawnpointURI); err != nil {
+		t.Fatalf("Failed to update service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+	awaitLog(t, logChan, errChan, "[SUCCESS] Service update completed")
+	if newID, _ := fakeBackend.LookupService("updatesvc"); newID == oldID || !fakeBackend.IsRunning(newID) {
+		t.Fatal("Updated service container is not running")
+	} else if fakeBackend.IsRunning(oldID) {
+		t.Fatal("Previous service container is still running")
+	} else if newManifest, err := fakeBackend.InspectService(ctx, newID); err != nil {
+		t.Fatalf("Failed to inspect updated service container: %s", err)
+	} else if newManifest.ConfigHash == oldManifest.ConfigHash || newManifest.Time.Before(oldManifest.Time) {
+		t.Fatalf("Updated service container has unexpected manifest: %v", newManifest)
+	}
+
+	var summaries []struct {
+		Name      string
+		CPUShares uint64
+	}
+	if err := json.Unmarshal(awaitAPI(t, "GET", "/services", nil, http.StatusOK), &summaries); err != nil {
+		t.Fatalf("Failed to decode service list: %s", err)
+	}
+	for _, summary := range summaries {
+		if summary.Name == "updatesvc" && summary.CPUShares != 256 {
+			t.Fatalf("Expected 256 CPU shares after update, found %d", summary.CPUShares)
+		}
+	}
+
+	if _, err := spawnClient.Stop(spawnpointURI, "updatesvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+}
+
+// Updated service that fails to build or dies within its grace period leaves the previous version running
+func TestUpdateRollback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := []byte(`{"name": "rollbacksvc", "bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128, "run": ["./rollbacksvc"]}`)
+	awaitAPI(t, "POST", "/services/rollbacksvc/update", config, http.StatusNotFound)
+
+	logChan, errChan := spawnClient.Tail(ctx, "rollbacksvc", spawnpointURI)
+	awaitAPI(t, "POST", "/services", config, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+	oldID := awaitMonitored(t, "rollbacksvc")
+
+	// A failed build leaves the current version untouched
+	fakeBackend.InjectBuildFailure("rollbacksvc", errors.New("build failed"))
+	awaitAPI(t, "POST", "/services/rollbacksvc/update", config, http.StatusAccepted)
+	awaitFailure(t, logChan, errChan, 500)
+	fakeBackend.InjectBuildFailure("rollbacksvc", nil)
+	if !fakeBackend.IsRunning(oldID) {
+		t.Fatal("Service container stopped after failed build")
+	}
+
+	// An updated container that dies within the grace period is replaced by the previous version
+	awaitAPI(t, "POST", "/services/rollbacksvc/update", config, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+	newID := awaitMonitored(t, "rollbacksvc")
+	if err := fakeBackend.InjectDie(newID); err != nil {
+		t.Fatalf("Failed to inject failure: %s", err)
+	}
+	awaitFailure(t, logChan, errChan, 500)
+	if id := awaitMonitored(t, "rollbacksvc"); id != oldID || !fakeBackend.IsRunning(oldID) {
+		t.Fatal("Previous service container was not restored")
+	}
+
+	// Shares freed by shrinking a service stay reserved until its update is committed
+	large := []byte(`{"name": "rollbacksvc", "bw2Entity": "dGVzdGluZw==", "cpuShares": 1000, "memory": 128, "run": ["./rollbacksvc"]}`)
+	small := []byte(`{"name": "rollbacksvc", "bw2Entity": "dGVzdGluZw==", "cpuShares": 10, "memory": 128, "run": ["./rollbacksvc"]}`)
+	awaitAPI(t, "POST", "/services/rollbacksvc/update", large, http.StatusAccepted)
+	awaitLog(t, logChan, errChan, "[SUCCESS] Service update completed")
+	awaitAPI(t, "POST", "/services/rollbacksvc/update", small, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+	smallID := awaitMonitored(t, "rollbacksvc")
+	greedy := service.Configuration{Name: "greedysvc", BW2Entity: bw2Entity, CPUShares: 900, Memory: 128, Run: []string{"./greedysvc"}}
+	_, err := spawnClient.Deploy(&greedy, spawnpointURI)
+	awaitOperationError(t, err, 503)
+	if err = fakeBackend.InjectDie(smallID); err != nil {
+		t.Fatalf("Failed to inject failure: %s", err)
+	}
+	awaitFailure(t, logChan, errChan, 500)
+	awaitMonitored(t, "rollbacksvc")
+	greedy.CPUShares = 1000
+	_, err = spawnClient.Deploy(&greedy, spawnpointURI)
+	awaitOperationError(t, err, 503)
+
+	awaitAPI(t, "POST", "/services/rollbacksvc/stop", nil, http.StatusAccepted)
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+}
+
+// Deploy, list, and stop a service through the local management API
+func TestAPIDeploy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := []byte(`{"name": "apisvc", "bw2Entity": "dGVzdGluZw==", "cpuShares": 512, "memory": 512, "run": ["./apisvc"]}`)
+
+	logChan, errChan := spawnClient.Tail(ctx, "apisvc", spawnpointURI)
+	awaitAPI(t, "POST", "/services", config, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+	awaitAPI(t, "POST", "/services", config, http.StatusConflict)
+
+	var services []map[string]interface{}
+	if err := json.Unmarshal(awaitAPI(t, "GET", "/services", nil, http.StatusOK), &services); err != nil {
+		t.Fatalf("Failed to decode service list: %s", err)
+	} else if len(services) != 1 || services[0]["Name"] != "apisvc" {
+		t.Fatalf("Unexpected service list: %v", services)
+	}
+	var hb daemon.Heartbeat
+	if err := json.Unmarshal(awaitAPI(t, "GET", "/heartbeat", nil, http.StatusOK), &hb); err != nil {
+		t.Fatalf("Failed to decode daemon heartbeat: %s", err)
+	} else if hb.AvailableCPU != totalCPUShares-512 {
+		t.Fatalf("Unexpected available CPU in heartbeat: %v", hb.AvailableCPU)
+	}
+
+	awaitAPI(t, "POST", "/services/apisvc/stop", nil, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 2)
+	awaitAPI(t, "POST", "/services/apisvc/stop", nil, http.StatusNotFound)
+}
+
+// The commit a pinned git source resolves to is reported in service heartbeats
+func TestPinnedSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conflicting := []byte(`{"name": "pinnedsvc", "source": "git+https://github.com/jhkolb/demosvc#v1.0.0", "sourceRef": "v2.0.0",
+		"bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128, "run": ["./demosvc"]}`)
+	awaitAPI(t, "POST", "/services", conflicting, http.StatusBadRequest)
+
+	config := []byte(`{"name": "pinnedsvc", "source": "git+https://github.com/jhkolb/demosvc#v1.0.0",
+		"bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128, "run": ["./demosvc"]}`)
+	logChan, errChan := spawnClient.Tail(ctx, "pinnedsvc", spawnpointURI)
+	awaitAPI(t, "POST", "/services", config, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+
+	id := awaitMonitored(t, "pinnedsvc")
+	manifest, err := fakeBackend.InspectService(ctx, id)
+	if err != nil {
+		t.Fatalf("Failed to inspect service container: %s", err)
+	} else if len(manifest.SourceCommit) == 0 {
+		t.Fatal("Service container does not record its source commit")
+	}
+	if err = fakeBackend.InjectStats(id, backend.Stats{}); err != nil {
+		t.Fatalf("Failed to inject stats: %s", err)
+	}
+	var hb daemon.ServiceHeartbeat
+	for attempt := 0; attempt < 50 && hb.SourceCommit != manifest.SourceCommit; attempt++ {
+		time.Sleep(20 * time.Millisecond)
+		if resp, err := apiClient.Get("http://spawnd/services/pinnedsvc/heartbeat"); err == nil {
+			json.NewDecoder(resp.Body).Decode(&hb)
+			resp.Body.Close()
+		}
+	}
+	if hb.SourceCommit != manifest.SourceCommit {
+		t.Fatalf("Expected source commit %s in heartbeat, found %s", manifest.SourceCommit, hb.SourceCommit)
+	}
+
+	awaitAPI(t, "POST", "/services/pinnedsvc/stop", nil, http.StatusAccepted)
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+}
+
+// Attempt to deploy services with malformed sources, then deploy from an archive and a prebuilt image
+func TestSourceTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, source := range []string{
+		`"source": "https+example.com/demosvc.tar.gz"`,
+		`"source": "https+https://example.com/demosvc.tar.gz", "sourceChecksum": "sha256:` + strings.Repeat("0", 64) + `"`,
+		`"source": "archive+demosvc.tar.gz"`,
+		`"source": "image+jhkolb/demosvc:1.0", "build": ["go build"]`,
+		`"source": "svn+https://example.com/demosvc"`,
+	} {
+		config := []byte(`{"name": "sourcesvc", ` + source + `, "bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128}`)
+		awaitAPI(t, "POST", "/services", config, http.StatusBadRequest)
+	}
+
+	// Archives are uploaded by the client, and identified by their checksum once deployed
+	archivePath := filepath.Join(filepath.Dir(bw2Entity), "sourcesvc.tar.gz")
+	if err := ioutil.WriteFile(archivePath, []byte("sourcesvc"), 0600); err != nil {
+		t.Fatalf("Failed to create source archive: %s", err)
+	}
+	config := service.Configuration{
+		Name:      "sourcesvc",
+		Source:    "archive+" + archivePath,
+		BW2Entity: bw2Entity,
+		CPUShares: 128,
+		Memory:    128,
+		Run:       []string{"./sourcesvc"},
+	}
+	logChan, errChan := spawnClient.Tail(ctx, "sourcesvc", spawnpointURI)
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+	manifest, err := fakeBackend.InspectService(ctx, awaitMonitored(t, "sourcesvc"))
+	if err != nil {
+		t.Fatalf("Failed to inspect service container: %s", err)
+	} else if manifest.Config.Source != "archive+sourcesvc.tar.gz" || len(manifest.Config.SourceArchive) > 0 {
+		t.Fatalf("Service container records archive source %s incorrectly", manifest.Config.Source)
+	} else if expected := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("sourcesvc"))); manifest.Config.SourceChecksum != expected {
+		t.Fatalf("Expected source checksum %s, found %s", expected, manifest.Config.SourceChecksum)
+	}
+	awaitAPI(t, "POST", "/services/sourcesvc/stop", nil, http.StatusAccepted)
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+
+	// Prebuilt images are run without a build
+	logChan, errChan = spawnClient.Tail(ctx, "imagesvc", spawnpointURI)
+	imageConfig := []byte(`{"name": "imagesvc", "source": "image+jhkolb/demosvc:1.0",
+		"bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128}`)
+	awaitAPI(t, "POST", "/services", imageConfig, http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+	awaitMonitored(t, "imagesvc")
+	awaitAPI(t, "POST", "/services/imagesvc/stop", nil, http.StatusAccepted)
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+}
+
+// Attempt to deploy services with invalid dockerfiles, then deploy one built from a valid dockerfile
+func TestDockerfile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deploy := func(dockerfile string, expectedCode int) {
+		var buf bytes.Buffer
+		tarWriter := tar.NewWriter(&buf)
+		tarWriter.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))})
+		tarWriter.Write([]byte(dockerfile))
+		tarWriter.Close()
+		config, _ := yaml.Marshal(service.Configuration{
+			Name:          "dockersvc",
+			BW2Entity:     "dGVzdGluZw==",
+			CPUShares:     128,
+			Memory:        128,
+			Dockerfile:    "Dockerfile",
+			IncludedFiles: []string{"Dockerfile", base64.StdEncoding.EncodeToString(buf.Bytes())},
+			Run:           []string{"./dockersvc"},
+		})
+		awaitAPI(t, "POST", "/services", config, expectedCode)
+	}
+	deploy("RUN go build\nFROM golang\n", http.StatusBadRequest)
+	deploy("FROM golang\nCOMPILE dockersvc\n", http.StatusBadRequest)
+
+	logChan, errChan := spawnClient.Tail(ctx, "dockersvc", spawnpointURI)
+	deploy("FROM golang AS build\nRUN go build -o dockersvc\nFROM alpine\nCOPY --from=build /go/dockersvc .\n", http.StatusAccepted)
+	awaitSuccess(t, logChan, errChan, 1)
+	awaitAPI(t, "POST", "/services/dockersvc/stop", nil, http.StatusAccepted)
+	awaitLog(t, logChan, errChan, "[SUCCESS] Removed service container")
+}
+
+// Follow a failed build through typed build events
+func TestBuildEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fakeBackend.InjectBuildLog("buildsvc", "Step 1/2 : FROM jhkolb/spawnable:amd64", " ---> Using cache",
+		"Step 2/2 : RUN make", "make: *** No rule to make target 'all'.  Stop.")
+	fakeBackend.InjectBuildFailure("buildsvc", &backend.BuildError{Step: 2, Steps: 2, ExitCode: 2, Message: "RUN make failed"})
+	defer fakeBackend.InjectBuildFailure("buildsvc", nil)
+
+	logChan, errChan := spawnClient.Tail(ctx, "buildsvc", spawnpointURI)
+	events, eventErrs := spawnClient.WatchBuild(ctx, "buildsvc", spawnpointURI)
+	config := []byte(`{"name": "buildsvc", "bw2Entity": "dGVzdGluZw==", "cpuShares": 128, "memory": 128, "run": ["./buildsvc"]}`)
+	awaitAPI(t, "POST", "/services", config, http.StatusAccepted)
+	awaitFailure(t, logChan, errChan, 422)
+
+	var kinds []string
+	for len(kinds) < 5 {
+		select {
+		case event := <-events:
+			kinds = append(kinds, event.Kind)
+			if event.Kind == service.BuildError && (event.Step != 2 || event.ExitCode != 2) {
+				t.Fatalf("Build error reported for step %d with exit code %d", event.Step, event.ExitCode)
+			}
+		case err := <-eventErrs:
+			t.Fatalf("Failed to watch build: %s", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Build events incomplete, received %v", kinds)
+		}
+	}
+	expected := []string{service.BuildStep, service.BuildCached, service.BuildStep, service.BuildOutput, service.BuildError}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("Expected build events %v, received %v", expected, kinds)
+	}
+}
+
+// Resource allocation, restarts, and builds are reflected in the exported metrics
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := service.Configuration{
+		Name:      "metricsvc",
+		BW2Entity: bw2Entity,
+		CPUShares: totalCPUShares / 4,
+		Memory:    totalMemory / 2,
+		Run:       []string{"./metricsvc"},
+	}
+	restarts := `spawnd_service_restarts_total{service="metricsvc",spawnpoint="testing"}`
+	builds := `spawnd_service_build_duration_seconds_count{service="metricsvc",spawnpoint="testing"}`
+	// Counters outlive the service, so only their increase is checked
+	before := scrapeMetrics(t)
+
+	logChan, errChan := spawnClient.Tail(ctx, "metricsvc", spawnpointURI)
+	if _, err := spawnClient.Deploy(&config, spawnpointURI); err != nil {
+		t.Fatalf("Failed to deploy service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+	if _, err := spawnClient.Restart(spawnpointURI, "metricsvc"); err != nil {
+		t.Fatalf("Failed to restart service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 1)
+
+	after := scrapeMetrics(t)
+	for _, expected := range []string{
+		`spawnd_cpu_shares_allocated{spawnpoint="testing"} 256`,
+		`spawnd_memory_available_mebibytes{spawnpoint="testing"} 512`,
+		`spawnd_service_cpu_shares_allocated{service="metricsvc",spawnpoint="testing"} 256`,
+	} {
+		if !strings.Contains(after, expected) {
+			t.Errorf("Metrics do not contain %s", expected)
+		}
+	}
+	for _, series := range []string{restarts, builds} {
+		if delta := metricValue(after, series) - metricValue(before, series); delta != 1 {
+			t.Errorf("Expected %s to increase by 1, increased by %v", series, delta)
+		}
+	}
+
+	if _, err := spawnClient.Stop(spawnpointURI, "metricsvc"); err != nil {
+		t.Fatalf("Failed to stop service: %s", err)
+	}
+	awaitSuccess(t, logChan, errChan, 2)
+}
+
+func scrapeMetrics(t *testing.T) string {
+	// The metrics listener starts asynchronously with the daemon's main loop
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		if resp, err = http.Get("http://" + metricsAddress + "/metrics"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %s", err)
+	}
+	defer resp.Body.Close()
+	contents, _ := ioutil.ReadAll(resp.Body)
+	return string(contents)
+}
+
+// metricValue finds a series in Prometheus text output, treating a missing series as 0
+func metricValue(metrics string, series string) float64 {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			value, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return value
+		}
+	}
+	return 0
+}
+
+func awaitAPI(t *testing.T, method string, path string, body []byte, expectedCode int) []byte {
+	// The API listener starts asynchronously with the daemon's main loop
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		req, _ := http.NewRequest(method, "http://spawnd"+path, bytes.NewReader(body))
+		if resp, err = apiClient.Do(req); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	contents, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != expectedCode {
+		t.Fatalf("%s %s returned %d, expected %d: %s", method, path, resp.StatusCode, expectedCode, contents)
+	}
+	return contents
 }
 
 func awaitSuccess(t *testing.T, logChan <-chan service.LogMessage, errChan <-chan error, successTotal int) {
@@ -505,6 +1369,16 @@ func awaitSuccess(t *testing.T, logChan <-chan service.LogMessage, errChan <-cha
 	}
 }
 
+// awaitOperationError checks that a client request was refused with a specific code
+func awaitOperationError(t *testing.T, err error, code int) {
+	opErr, ok := err.(*spawnclient.OperationError)
+	if !ok {
+		t.Fatalf("Expected operation error %d, found %v", code, err)
+	} else if opErr.Code != code {
+		t.Fatalf("Expected operation error %d, found %s", code, opErr)
+	}
+}
+
 func awaitFailure(t *testing.T, logChan <-chan service.LogMessage, errChan <-chan error, code uint) {
 	for {
 		select {
@@ -522,3 +1396,54 @@ func awaitFailure(t *testing.T, logChan <-chan service.LogMessage, errChan <-cha
 		}
 	}
 }
+
+func awaitHealth(t *testing.T, svcName string, health string) {
+	var hb daemon.ServiceHeartbeat
+	for attempt := 0; attempt < 50; attempt++ {
+		// No heartbeat exists until the health check's first verdict
+		resp, err := apiClient.Get("http://spawnd/services/" + svcName + "/heartbeat")
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&hb)
+			resp.Body.Close()
+			if err == nil && hb.Health == health {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Expected service health %s, found %s", health, hb.Health)
+}
+
+// awaitLog waits for a specific log message, skipping any others
+func awaitLog(t *testing.T, logChan <-chan service.LogMessage, errChan <-chan error, contents string) {
+	for {
+		select {
+		case logMsg := <-logChan:
+			if logMsg.Contents == contents {
+				return
+			}
+		case err := <-errChan:
+			t.Fatalf("Failure while tailing service logs: %s", err)
+		}
+	}
+}
+
+// killService simulates the failure of a service's container
+func killService(t *testing.T, svcName string) {
+	id := awaitMonitored(t, svcName)
+	if err := fakeBackend.InjectDie(id); err != nil {
+		t.Fatalf("Failed to inject failure: %s", err)
+	}
+}
+
+// awaitMonitored returns a service's container ID once the daemon is watching its events
+func awaitMonitored(t *testing.T, svcName string) string {
+	for attempt := 0; attempt < 50; attempt++ {
+		if id, ok := fakeBackend.LookupService(svcName); ok && fakeBackend.IsMonitored(id) {
+			return id
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Daemon is not monitoring service %s", svcName)
+	return ""
+}
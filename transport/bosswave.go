@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	bw2 "github.com/immesys/bw2bind"
+	"github.com/pkg/errors"
+)
+
+// Bosswave is a Transport backed by a connection to a Bosswave agent
+type Bosswave struct {
+	client       *bw2.BW2Client
+	services     map[string]*bw2.Service
+	servicesLock sync.Mutex
+}
+
+type bosswaveObject struct {
+	payloadType PayloadType
+	po          interface {
+		ValueInto(v interface{}) error
+	}
+}
+
+// Build events and service statuses are msgpack objects (2.0.2.5 and 2.0.2.6),
+// alongside the other Spawnpoint payload types
+const (
+	poNumSpawnpointBuildEvent = 0x02000205
+	poNumSpawnpointStatus     = 0x02000206
+)
+
+var bw2PONums = map[PayloadType]int{
+	ConfigPayload:           bw2.PONumSpawnpointConfig,
+	LogPayload:              bw2.PONumSpawnpointLog,
+	HeartbeatPayload:        bw2.PONumSpawnpointHeartbeat,
+	ServiceHeartbeatPayload: bw2.PONumSpawnpointSvcHb,
+	BuildEventPayload:       poNumSpawnpointBuildEvent,
+	StatusPayload:           poNumSpawnpointStatus,
+}
+
+func NewBosswave(agent string, entityFile string) (*Bosswave, error) {
+	bw2.SilenceLog()
+	client, err := bw2.Connect(agent)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to Bosswave")
+	}
+	if _, err = client.SetEntityFile(entityFile); err != nil {
+		return nil, errors.Wrap(err, "Failed to set Bosswave entity")
+	}
+	return &Bosswave{client: client, services: make(map[string]*bw2.Service)}, nil
+}
+
+// RegisterInterface registers the service an interface belongs to, once, and then
+// the interface itself, so that Bosswave keeps metadata about both
+func (bw *Bosswave) RegisterInterface(iface Interface, errorHandler func(error)) {
+	bw.servicesLock.Lock()
+	defer bw.servicesLock.Unlock()
+	key := iface.Base + "/" + iface.Service
+	svc, ok := bw.services[key]
+	if !ok {
+		svc = bw.client.RegisterServiceNoHb(iface.Base, iface.Service)
+		svc.SetErrorHandler(errorHandler)
+		bw.services[key] = svc
+	}
+	svc.RegisterInterface(iface.Name, iface.Type)
+}
+
+func (bw *Bosswave) PublishSignal(iface Interface, signal string, payloads ...Payload) error {
+	return bw.publish(iface.SignalURI(signal), true, payloads)
+}
+
+func (bw *Bosswave) PublishSlot(iface Interface, slot string, payloads ...Payload) error {
+	return bw.publish(iface.SlotURI(slot), false, payloads)
+}
+
+func (bw *Bosswave) SubscribeSignal(iface Interface, signal string, handler func(*Message)) (string, error) {
+	return bw.subscribe(iface.SignalURI(signal), handler)
+}
+
+func (bw *Bosswave) SubscribeSlot(iface Interface, slot string, handler func(*Message)) (string, error) {
+	return bw.subscribe(iface.SlotURI(slot), handler)
+}
+
+func (bw *Bosswave) SubscribeURI(uri string, handler func(*Message)) (string, error) {
+	return bw.subscribe(uri, handler)
+}
+
+func (bw *Bosswave) Unsubscribe(handle string) error {
+	return bw.client.Unsubscribe(handle)
+}
+
+func (bw *Bosswave) QuerySignal(iface Interface, signal string) ([]*Message, error) {
+	// Results may name the namespace by its VK rather than the alias we queried
+	namespace := strings.Split(iface.Base, "/")[0]
+	vk, _, err := bw.client.ResolveLongAlias(namespace)
+	aliased := (err == nil)
+	var encodedVk string
+	if aliased {
+		encodedVk = base64.URLEncoding.EncodeToString(vk)
+	}
+
+	results, err := bw.client.Query(&bw2.QueryParams{
+		URI: iface.SignalURI(signal),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Bosswave query failed")
+	}
+
+	var msgs []*Message
+	for result := range results {
+		msg := convertMessage(result)
+		if aliased {
+			msg.URI = strings.Replace(msg.URI, encodedVk, namespace, 1)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (bw *Bosswave) publish(uri string, persist bool, payloads []Payload) error {
+	pos := make([]bw2.PayloadObject, len(payloads))
+	for i, payload := range payloads {
+		poNum, ok := bw2PONums[payload.Type]
+		if !ok {
+			return fmt.Errorf("Unknown payload type %v", payload.Type)
+		}
+
+		var err error
+		if payload.Type == ConfigPayload {
+			pos[i], err = bw2.CreateYAMLPayloadObject(poNum, payload.Value)
+		} else {
+			pos[i], err = bw2.CreateMsgPackPayloadObject(poNum, payload.Value)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Failed to create payload object")
+		}
+	}
+
+	if err := bw.client.Publish(&bw2.PublishParams{
+		URI:            uri,
+		AutoChain:      true,
+		PayloadObjects: pos,
+		Persist:        persist,
+	}); err != nil {
+		return errors.Wrap(err, "Bosswave publication failed")
+	}
+	return nil
+}
+
+func (bw *Bosswave) subscribe(uri string, handler func(*Message)) (string, error) {
+	msgs, handle, err := bw.client.SubscribeH(&bw2.SubscribeParams{
+		URI:       uri,
+		AutoChain: true,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Bosswave subscription failed")
+	}
+
+	go func() {
+		for msg := range msgs {
+			handler(convertMessage(msg))
+		}
+	}()
+	return handle, nil
+}
+
+// convertMessage keeps only the payload objects that correspond to known payload types
+func convertMessage(msg *bw2.SimpleMessage) *Message {
+	converted := Message{URI: msg.URI, From: msg.From}
+	for _, po := range msg.POs {
+		for payloadType, poNum := range bw2PONums {
+			if po.GetPONum() != poNum {
+				continue
+			}
+			decodable, ok := po.(interface {
+				ValueInto(v interface{}) error
+			})
+			if ok {
+				converted.Objects = append(converted.Objects, bosswaveObject{
+					payloadType: payloadType,
+					po:          decodable,
+				})
+			}
+		}
+	}
+	return &converted
+}
+
+func (obj bosswaveObject) Type() PayloadType {
+	return obj.payloadType
+}
+
+func (obj bosswaveObject) ValueInto(v interface{}) error {
+	return obj.po.ValueInto(v)
+}
@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultLoopback is a process-wide message bus shared by every daemon and
+// client configured to use the loopback transport
+var DefaultLoopback = NewLoopback()
+
+// Loopback is an in-process Transport that needs no Bosswave router.
+// Payloads are serialized on publication, so subscribers never share memory
+// with publishers.
+type Loopback struct {
+	mutex         sync.Mutex
+	nextHandle    uint64
+	subscriptions map[string]*loopbackSubscription
+	persisted     map[string]*loopbackMessage
+}
+
+type loopbackSubscription struct {
+	pattern string
+	handler func(*Message)
+	queue   []*Message
+	cond    *sync.Cond
+	closed  bool
+}
+
+type loopbackMessage struct {
+	uri      string
+	payloads []loopbackObject
+}
+
+type loopbackObject struct {
+	payloadType PayloadType
+	contents    []byte
+}
+
+func NewLoopback() *Loopback {
+	return &Loopback{
+		subscriptions: make(map[string]*loopbackSubscription),
+		persisted:     make(map[string]*loopbackMessage),
+	}
+}
+
+func (lb *Loopback) PublishSignal(iface Interface, signal string, payloads ...Payload) error {
+	return lb.publish(iface.SignalURI(signal), true, payloads)
+}
+
+func (lb *Loopback) PublishSlot(iface Interface, slot string, payloads ...Payload) error {
+	return lb.publish(iface.SlotURI(slot), false, payloads)
+}
+
+func (lb *Loopback) SubscribeSignal(iface Interface, signal string, handler func(*Message)) (string, error) {
+	return lb.subscribe(iface.SignalURI(signal), handler), nil
+}
+
+func (lb *Loopback) SubscribeSlot(iface Interface, slot string, handler func(*Message)) (string, error) {
+	return lb.subscribe(iface.SlotURI(slot), handler), nil
+}
+
+func (lb *Loopback) SubscribeURI(uri string, handler func(*Message)) (string, error) {
+	return lb.subscribe(uri, handler), nil
+}
+
+func (lb *Loopback) Unsubscribe(handle string) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	sub, ok := lb.subscriptions[handle]
+	if !ok {
+		return fmt.Errorf("Unknown subscription handle %s", handle)
+	}
+	delete(lb.subscriptions, handle)
+	sub.cond.L.Lock()
+	sub.closed = true
+	sub.cond.L.Unlock()
+	sub.cond.Signal()
+	return nil
+}
+
+func (lb *Loopback) QuerySignal(iface Interface, signal string) ([]*Message, error) {
+	pattern := iface.SignalURI(signal)
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	var results []*Message
+	for uri, msg := range lb.persisted {
+		if matchURI(pattern, uri) {
+			results = append(results, msg.toMessage())
+		}
+	}
+	return results, nil
+}
+
+func (lb *Loopback) publish(uri string, persist bool, payloads []Payload) error {
+	msg := loopbackMessage{
+		uri:      uri,
+		payloads: make([]loopbackObject, len(payloads)),
+	}
+	for i, payload := range payloads {
+		contents, err := json.Marshal(payload.Value)
+		if err != nil {
+			return errors.Wrap(err, "Failed to serialize payload")
+		}
+		msg.payloads[i] = loopbackObject{payloadType: payload.Type, contents: contents}
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if persist {
+		// A message without payloads clears the persisted message
+		if len(payloads) == 0 {
+			delete(lb.persisted, uri)
+		} else {
+			lb.persisted[uri] = &msg
+		}
+	}
+	for _, sub := range lb.subscriptions {
+		if matchURI(sub.pattern, uri) {
+			sub.enqueue(msg.toMessage())
+		}
+	}
+	return nil
+}
+
+func (lb *Loopback) subscribe(pattern string, handler func(*Message)) string {
+	sub := &loopbackSubscription{
+		pattern: pattern,
+		handler: handler,
+		cond:    sync.NewCond(&sync.Mutex{}),
+	}
+	lb.mutex.Lock()
+	lb.nextHandle++
+	handle := fmt.Sprintf("loopback-%d", lb.nextHandle)
+	lb.subscriptions[handle] = sub
+	lb.mutex.Unlock()
+
+	go sub.deliver()
+	return handle
+}
+
+func (sub *loopbackSubscription) enqueue(msg *Message) {
+	sub.cond.L.Lock()
+	sub.queue = append(sub.queue, msg)
+	sub.cond.L.Unlock()
+	sub.cond.Signal()
+}
+
+// Messages are handed to the subscriber one at a time, in publication order
+func (sub *loopbackSubscription) deliver() {
+	for {
+		sub.cond.L.Lock()
+		for len(sub.queue) == 0 && !sub.closed {
+			sub.cond.Wait()
+		}
+		if sub.closed {
+			sub.cond.L.Unlock()
+			return
+		}
+		msg := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.cond.L.Unlock()
+		sub.handler(msg)
+	}
+}
+
+func (msg *loopbackMessage) toMessage() *Message {
+	objects := make([]Object, len(msg.payloads))
+	for i := range msg.payloads {
+		objects[i] = msg.payloads[i]
+	}
+	return &Message{URI: msg.uri, Objects: objects}
+}
+
+func (obj loopbackObject) Type() PayloadType {
+	return obj.payloadType
+}
+
+func (obj loopbackObject) ValueInto(v interface{}) error {
+	return json.Unmarshal(obj.contents, v)
+}
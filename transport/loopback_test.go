@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchURI(t *testing.T) {
+	cases := []struct {
+		pattern string
+		uri     string
+		match   bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b/d", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/b/c", false},
+		{"a/*/c", "a/c", true},
+		{"a/*/c", "a/b/b/c", true},
+		{"a/*", "a/b/c", true},
+		{"a/*/d", "a/b/c", false},
+	}
+	for _, c := range cases {
+		if matchURI(c.pattern, c.uri) != c.match {
+			t.Errorf("matchURI(%s, %s) should be %v", c.pattern, c.uri, c.match)
+		}
+	}
+}
+
+// Signals are persisted for queries, slots are only delivered to subscribers
+func TestLoopbackPublish(t *testing.T) {
+	lb := NewLoopback()
+	alpha := NewInterface("ns/spawnpoint/alpha", "s.spawnpoint", "daemon", "i.spawnpoint")
+	beta := NewInterface("ns/spawnpoint/beta", "s.spawnpoint", "daemon", "i.spawnpoint")
+	all := NewInterface("ns/*", "s.spawnpoint", "daemon", "i.spawnpoint")
+
+	received := make(chan string, 10)
+	handle, err := lb.SubscribeSlot(alpha, "config", func(msg *Message) {
+		var value string
+		if err := msg.Objects[0].ValueInto(&value); err != nil {
+			t.Errorf("Failed to decode payload: %s", err)
+		}
+		received <- value
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+	lb.PublishSlot(alpha, "config", Payload{Type: ConfigPayload, Value: "first"})
+	lb.PublishSlot(beta, "config", Payload{Type: ConfigPayload, Value: "other"})
+	lb.PublishSlot(alpha, "config", Payload{Type: ConfigPayload, Value: "second"})
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case value := <-received:
+			if value != expected {
+				t.Fatalf("Expected %s, received %s", expected, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for slot message")
+		}
+	}
+	if err = lb.Unsubscribe(handle); err != nil {
+		t.Fatalf("Failed to unsubscribe: %s", err)
+	}
+
+	lb.PublishSignal(alpha, "heartbeat", Payload{Type: HeartbeatPayload, Value: 1})
+	lb.PublishSignal(beta, "heartbeat", Payload{Type: HeartbeatPayload, Value: 2})
+	lb.PublishSignal(beta, "heartbeat", Payload{Type: HeartbeatPayload, Value: 3})
+	results, _ := lb.QuerySignal(all, "heartbeat")
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 persisted heartbeats, found %v", len(results))
+	}
+
+	// Publishing without payloads removes the persisted message
+	lb.PublishSignal(alpha, "heartbeat")
+	results, _ = lb.QuerySignal(all, "heartbeat")
+	if len(results) != 1 || results[0].URI != beta.SignalURI("heartbeat") {
+		t.Fatalf("Expected only beta heartbeat, found %v", results)
+	}
+	var latest int
+	results[0].Objects[0].ValueInto(&latest)
+	if latest != 3 {
+		t.Fatalf("Expected most recent heartbeat, found %v", latest)
+	}
+}
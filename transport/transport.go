@@ -0,0 +1,112 @@
+package transport
+
+import "strings"
+
+// Transport carries all messages between Spawnpoint daemons and their clients.
+// Its semantics follow Bosswave: signals are persisted, so the most recent
+// message on each signal URI can be retrieved with a query, while slot
+// messages are only delivered to current subscribers.
+type Transport interface {
+	PublishSignal(iface Interface, signal string, payloads ...Payload) error
+	PublishSlot(iface Interface, slot string, payloads ...Payload) error
+	SubscribeSignal(iface Interface, signal string, handler func(*Message)) (string, error)
+	SubscribeSlot(iface Interface, slot string, handler func(*Message)) (string, error)
+	// SubscribeURI subscribes to an arbitrary URI, e.g. one published to by a service
+	// Payloads of types unknown to the transport are omitted from its messages
+	SubscribeURI(uri string, handler func(*Message)) (string, error)
+	Unsubscribe(handle string) error
+	QuerySignal(iface Interface, signal string) ([]*Message, error)
+}
+
+// Registrar is implemented by transports that keep metadata of their own about the
+// interfaces a daemon provides, as Bosswave does
+type Registrar interface {
+	// RegisterInterface registers an interface and the service it belongs to
+	// Failures to maintain the service's metadata are passed to errorHandler
+	RegisterInterface(iface Interface, errorHandler func(error))
+}
+
+type PayloadType int
+
+const (
+	ConfigPayload = iota
+	LogPayload
+	HeartbeatPayload
+	ServiceHeartbeatPayload
+	BuildEventPayload
+	StatusPayload
+)
+
+// Payload is a value to be serialized and published
+type Payload struct {
+	Type  PayloadType
+	Value interface{}
+}
+
+// Object is a received payload that can be deserialized into a value
+type Object interface {
+	Type() PayloadType
+	ValueInto(v interface{}) error
+}
+
+type Message struct {
+	URI     string
+	Objects []Object
+	// VK of the sending entity, empty if the transport doesn't identify senders
+	From string
+}
+
+// Interface identifies the URI prefix <base>/<service>/<name>/<type>
+// Base and Name may contain '+' and '*' wildcards when subscribing or querying
+type Interface struct {
+	Base    string
+	Service string
+	Name    string
+	Type    string
+}
+
+func NewInterface(base, service, name, ifaceType string) Interface {
+	return Interface{
+		Base:    base,
+		Service: service,
+		Name:    name,
+		Type:    ifaceType,
+	}
+}
+
+func (iface Interface) URI() string {
+	return strings.Join([]string{iface.Base, iface.Service, iface.Name, iface.Type}, "/")
+}
+
+func (iface Interface) SignalURI(signal string) string {
+	return iface.URI() + "/signal/" + signal
+}
+
+func (iface Interface) SlotURI(slot string) string {
+	return iface.URI() + "/slot/" + slot
+}
+
+// matchURI reports if uri matches pattern, where '+' in the pattern matches
+// exactly one URI element and '*' matches zero or more elements
+func matchURI(pattern string, uri string) bool {
+	return matchElements(strings.Split(pattern, "/"), strings.Split(uri, "/"))
+}
+
+func matchElements(pattern []string, uri []string) bool {
+	if len(pattern) == 0 {
+		return len(uri) == 0
+	}
+	switch pattern[0] {
+	case "*":
+		for i := 0; i <= len(uri); i++ {
+			if matchElements(pattern[1:], uri[i:]) {
+				return true
+			}
+		}
+		return false
+	case "+":
+		return len(uri) > 0 && matchElements(pattern[1:], uri[1:])
+	default:
+		return len(uri) > 0 && pattern[0] == uri[0] && matchElements(pattern[1:], uri[1:])
+	}
+}